@@ -0,0 +1,377 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// actor names the staff member making an admin request. Admin routes sit
+// behind RequireRole, so the claims are always there.
+func actor(r *http.Request) model.Actor {
+	claims, _ := r.Context().Value(middleware.ContextKeyClaims).(*utils.Claims)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return model.Actor{UserID: claims.UserID, Role: claims.Role, IP: ip}
+}
+
+// audit records an admin read. The data has already been loaded, but it is
+// only handed out once the read is on record.
+func (ru *Router) audit(w http.ResponseWriter, r *http.Request, action, targetType string, targetID int64, details map[string]any) bool {
+	if err := model.RecordAudit(ru.DB, actor(r), action, targetType, targetID, details); err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return false
+	}
+	return true
+}
+
+func (ru *Router) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	search := r.URL.Query().Get("q")
+	role := r.URL.Query().Get("role")
+	if role != "" && !model.ValidRole(role) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "unknown role", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	pagination := utils.GetPagination(r)
+	users, total, err := model.SearchUsers(ru.DB, search, role, pagination)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if !ru.audit(w, r, model.AuditUserSearch, "user", 0, map[string]any{"q": search, "role": role, "page": pagination.Page}) {
+		return
+	}
+	resp := utils.BuildResponse(http.StatusOK, "users", users, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid user id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	user := &model.User{}
+	if err := user.GetWallets(ru.DB, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			resp := utils.BuildResponse(http.StatusNotFound, "user not found", nil, nil, nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if !ru.audit(w, r, model.AuditUserView, "user", user.ID, nil) {
+		return
+	}
+	resp := utils.BuildResponse(http.StatusOK, "user", user, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid user id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	user, err := model.SetUserRole(ru.DB, actor(r), userId, body.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrorUnknownRole), errors.Is(err, model.ErrorOwnRole):
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot change role", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorUserNotFound):
+			resp := utils.BuildResponse(http.StatusNotFound, "user not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		default:
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+		}
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "role updated, it applies from the user's next token", user, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminGetWallet(w http.ResponseWriter, r *http.Request) {
+	walletId, ok := walletID(w, r)
+	if !ok {
+		return
+	}
+
+	wallet, err := model.GetAnyWallet(ru.DB, walletId)
+	if err != nil {
+		walletError(w, err)
+		return
+	}
+
+	if !ru.audit(w, r, model.AuditWalletView, "wallet", wallet.ID, nil) {
+		return
+	}
+	resp := utils.BuildResponse(http.StatusOK, "wallet", wallet, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminListWalletTransactions(w http.ResponseWriter, r *http.Request) {
+	walletId, ok := walletID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := model.GetAnyWallet(ru.DB, walletId); err != nil {
+		walletError(w, err)
+		return
+	}
+
+	pagination := utils.GetPagination(r)
+	transactions, total, err := model.ListWalletTransactions(ru.DB, walletId, pagination)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if !ru.audit(w, r, model.AuditWalletHistory, "wallet", walletId, map[string]any{"page": pagination.Page}) {
+		return
+	}
+	resp := utils.BuildResponse(http.StatusOK, "wallet transactions list", transactions, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminFreezeWallet(w http.ResponseWriter, r *http.Request) {
+	ru.setWalletStatus(w, r, model.WalletStatusFrozen)
+}
+
+func (ru *Router) AdminUnfreezeWallet(w http.ResponseWriter, r *http.Request) {
+	ru.setWalletStatus(w, r, model.WalletStatusActive)
+}
+
+// AdminSetWalletStatus moves a wallet to the status named in the body, which
+// is also how wallets are blocked for debits and closed.
+func (ru *Router) AdminSetWalletStatus(w http.ResponseWriter, r *http.Request) {
+	ru.setWalletStatus(w, r, "")
+}
+
+// setWalletStatus sets status, or the status in the body when it is empty.
+func (ru *Router) setWalletStatus(w http.ResponseWriter, r *http.Request, status string) {
+	walletId, ok := walletID(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Reason == "" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "reason is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if status == "" {
+		status = body.Status
+	}
+
+	wallet, err := model.SetWalletStatus(ru.DB, actor(r), walletId, status, body.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrorUnknownWalletStatus):
+			resp := utils.BuildResponse(http.StatusBadRequest, "status must be active, frozen, debit_blocked or closed", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorWalletStatusUnchanged):
+			resp := utils.BuildResponse(http.StatusConflict, "wallet is already "+status, nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorWalletClosed):
+			resp := utils.BuildResponse(http.StatusConflict, "closed wallets cannot be reopened", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorWalletNotEmpty):
+			resp := utils.BuildResponse(http.StatusConflict, "only an empty wallet without open holds can be closed", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		default:
+			walletError(w, err)
+		}
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "wallet status updated", wallet, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminAdjustWallet(w http.ResponseWriter, r *http.Request) {
+	walletId, ok := walletID(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Entry     string `json:"entry"`
+		Amount    int64  `json:"amount"`
+		Reason    string `json:"reason"`
+		Reference string `json:"reference"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Entry != "credit" && body.Entry != "debit" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "entry must be credit or debit", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Amount <= 0 {
+		resp := utils.BuildResponse(http.StatusBadRequest, "amount must be positive", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Reason == "" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "reason is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	// the client may provide its own reference so retries can be detected
+	if body.Reference == "" {
+		body.Reference = uuid.New().String()
+	}
+
+	adj := &model.Adjustment{
+		WalletID:  walletId,
+		Entry:     body.Entry,
+		Amount:    body.Amount,
+		Reason:    body.Reason,
+		Reference: body.Reference,
+	}
+	if err := adj.Apply(ru.DB, actor(r)); err != nil {
+		switch {
+		case errors.Is(err, model.ErrorDuplicateTransaction):
+			resp := utils.BuildResponse(http.StatusConflict, "duplicate adjustment", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorInsuffcientBalance):
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot debit wallet: balance is too low", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorWalletClosed):
+			resp := utils.BuildResponse(http.StatusConflict, "closed wallets cannot be adjusted", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		default:
+			walletError(w, err)
+		}
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "wallet adjusted", adj, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminListAuditLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := model.AuditFilter{
+		Action:     q.Get("action"),
+		TargetType: q.Get("target_type"),
+	}
+	var err error
+	if v := q.Get("actor_id"); v != "" {
+		if filter.ActorID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid actor_id", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+	if v := q.Get("target_id"); v != "" {
+		if filter.TargetID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid target_id", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = utils.ParseTime(v, false); err != nil {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid from", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = utils.ParseTime(v, true); err != nil {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid to", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+
+	pagination := utils.GetPagination(r)
+	logs, total, err := model.ListAuditLogs(ru.DB, filter, pagination)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	// reading the audit log is itself audited
+	if !ru.audit(w, r, model.AuditLogsView, "audit_logs", 0, map[string]any{"filter": filter, "page": pagination.Page}) {
+		return
+	}
+	resp := utils.BuildResponse(http.StatusOK, "audit logs", logs, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
+
+func walletID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	walletId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid wallet id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return 0, false
+	}
+	return walletId, true
+}
+
+func walletError(w http.ResponseWriter, err error) {
+	if errors.Is(err, model.ErrorWalletNotFound) {
+		resp := utils.BuildResponse(http.StatusNotFound, "wallet not found", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	log.Println(err.Error())
+	resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+	resp.BadResponse(w)
+}
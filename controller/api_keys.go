@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func (ru *Router) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresAt string   `json:"expires_at"` // optional, RFC 3339 or YYYY-MM-DD
+		TOTPCode  string   `json:"totp_code"`  // required with two-factor authentication
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	key := &model.APIKey{Name: strings.TrimSpace(body.Name), Scopes: body.Scopes}
+	if key.Name == "" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "name is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.ExpiresAt != "" {
+		expiresAt, err := utils.ParseTime(body.ExpiresAt, false)
+		if err != nil || !expiresAt.After(time.Now()) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "expires_at must be a future RFC 3339 time or YYYY-MM-DD date", nil, nil, nil)
+			resp.BadResponse(w)
+			return
+		}
+		key.ExpiresAt = expiresAt
+	}
+
+	// a key skips the step-up on large debits, so it costs the step-up once
+	if !ru.requireSecondFactor(w, id, body.TOTPCode) {
+		return
+	}
+
+	if err := key.CreateAPIKey(ru.DB, id); err != nil {
+		if errors.Is(err, model.ErrorUnknownScope) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "scopes must be a non-empty list of known scopes", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusCreated, "api key created, store the key safely as it is not shown again", key, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	keys, err := model.ListAPIKeys(ru.DB, id)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "api keys", keys, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	keyID, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid api key id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := model.RevokeAPIKey(ru.DB, id, keyID); err != nil {
+		if errors.Is(err, model.ErrorAPIKeyNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "api key not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "api key revoked", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
@@ -2,19 +2,23 @@ package controller
 
 import (
 	"errors"
+	"io"
 	"log"
 	"net/http"
 	"time"
 
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
 	"github.com/lupppig/stream-ledger-api/model"
 	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/mailer"
 	"github.com/lupppig/stream-ledger-api/repository/postgres"
 	"github.com/lupppig/stream-ledger-api/utils"
 )
 
 type Router struct {
-	DB   *postgres.PostgresDB
-	Prod *kafka.Producer
+	DB     *postgres.PostgresDB
+	Prod   *kafka.Producer
+	Mailer mailer.Mailer
 }
 
 func (ru *Router) RegisterUser(w http.ResponseWriter, r *http.Request) {
@@ -62,7 +66,13 @@ func (ru *Router) RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := authResponse(user.FirstName, user.LastName, user.Email, usre.ID)
+	// the account works without a delivered email, it only cannot debit
+	// until the address is verified
+	if err := ru.sendUserToken(r.Context(), usre, model.TokenPurposeEmailVerification); err != nil {
+		log.Println(err.Error())
+	}
+
+	resp, err := ru.authResponse(usre, nil)
 	if err != nil {
 		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
 		resp.BadResponse(w)
@@ -107,7 +117,27 @@ func (ru *Router) SignIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rsp, err := authResponse(usr.FirstName, usr.LastName, usr.Email, usr.ID)
+	// with two-factor authentication the password only earns a challenge
+	// that POST /auth/2fa/verify exchanges for tokens
+	if usr.TOTPEnabledAt != nil {
+		challenge, err := model.IssueUserToken(ru.DB, usr.ID, model.TokenPurposeMFAChallenge)
+		if err != nil {
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+			return
+		}
+		data := struct {
+			MFARequired    bool   `json:"mfa_required"`
+			ChallengeToken string `json:"challenge_token"`
+			ExpiresAt      int64  `json:"expires_at"`
+		}{true, challenge.Token, challenge.ExpiresAt.UnixNano()}
+		resp := utils.BuildResponse(http.StatusOK, "two-factor authentication required", data, nil, nil)
+		resp.SuccessResponse(w)
+		return
+	}
+
+	rsp, err := ru.authResponse(usr, nil)
 	if err != nil {
 		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
 		resp.BadResponse(w)
@@ -118,34 +148,134 @@ func (ru *Router) SignIn(w http.ResponseWriter, r *http.Request) {
 	resp.BadResponse(w)
 }
 
-func authResponse(firstName, lastName, email string, id int64) (interface{}, error) {
+func (ru *Router) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.RefreshToken == "" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "refresh_token is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	refresh, err := model.RotateRefreshToken(ru.DB, body.RefreshToken)
+	if err != nil {
+		if errors.Is(err, model.ErrorInvalidRefreshToken) || errors.Is(err, model.ErrorRefreshTokenReused) {
+			resp := utils.BuildResponse(http.StatusUnauthorized, "invalid refresh token", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	usr, err := model.GetUser(ru.DB, refresh.UserID)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusUnauthorized, "invalid refresh token", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	rsp, err := ru.authResponse(usr, refresh)
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "token refreshed", rsp, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// Logout revokes the access token of the request and, when one is sent, the
+// refresh token of the same login.
+func (ru *Router) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.ContextKeyClaims).(*utils.Claims)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	// the body is optional, without it only the access token is revoked
+	if err := utils.ReadJSONRequest(r, &body); err != nil && !errors.Is(err, io.EOF) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := model.RevokeAccessToken(ru.DB, claims.ID, claims.ExpiresAt.Time); err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.RefreshToken != "" {
+		if err := model.RevokeRefreshToken(ru.DB, body.RefreshToken, claims.UserID); err != nil {
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "logged out", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// authResponse issues an access token carrying the user's current role and
+// returns it with refresh, or with a new refresh token when refresh is nil.
+func (ru *Router) authResponse(user *model.User, refresh *model.RefreshToken) (interface{}, error) {
 	duration := time.Minute * 30
-	token, err := utils.CreateToken(id, duration)
+	token, err := utils.CreateToken(user.ID, user.Role, duration)
 	if err != nil {
 		return nil, err
 	}
 
+	if refresh == nil {
+		if refresh, err = model.IssueRefreshToken(ru.DB, user.ID); err != nil {
+			return nil, err
+		}
+	}
+
 	resp := struct {
-		ID          int64  `json:"id"`
-		FirstName   string `json:"first_name"`
-		LastName    string `json:"last_name"`
-		Email       string `json:"email"`
-		AccessToken struct {
-			Token     string `json:"token"`
-			ExpiresAt int64  `json:"expires_at"`
-		} `json:"access_token"`
+		ID           int64         `json:"id"`
+		FirstName    string        `json:"first_name"`
+		LastName     string        `json:"last_name"`
+		Email        string        `json:"email"`
+		Role         string        `json:"role"`
+		AccessToken  tokenResponse `json:"access_token"`
+		RefreshToken tokenResponse `json:"refresh_token"`
 	}{
-		ID:        id,
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-		AccessToken: struct {
-			Token     string `json:"token"`
-			ExpiresAt int64  `json:"expires_at"`
-		}{
+		ID:        user.ID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Email:     user.Email,
+		Role:      user.Role,
+		AccessToken: tokenResponse{
 			Token:     token,
 			ExpiresAt: time.Now().Add(duration).UnixNano(),
 		},
+		RefreshToken: tokenResponse{
+			Token:     refresh.Token,
+			ExpiresAt: refresh.ExpiresAt.UnixNano(),
+		},
 	}
 
 	return resp, nil
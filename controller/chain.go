@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// AdminVerifyWalletChain walks the hash chain of a wallet and reports the
+// first broken link, if any.
+func (ru *Router) AdminVerifyWalletChain(w http.ResponseWriter, r *http.Request) {
+	walletId, ok := walletID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := model.GetAnyWallet(ru.DB, walletId); err != nil {
+		walletError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 25*time.Second)
+	defer cancel()
+	result, err := model.VerifyChain(ctx, ru.DB, walletId)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if !ru.audit(w, r, model.AuditWalletVerify, "wallet", walletId, map[string]any{"valid": result.Valid}) {
+		return
+	}
+	resp := utils.BuildResponse(http.StatusOK, "wallet chain verification", result, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminListCheckpoints(w http.ResponseWriter, r *http.Request) {
+	pagination := utils.GetPagination(r)
+	checkpoints, total, err := model.ListCheckpoints(ru.DB, pagination)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !ru.audit(w, r, model.AuditCheckpointsView, "ledger_checkpoints", 0, map[string]any{"page": pagination.Page}) {
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "ledger checkpoints", checkpoints, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
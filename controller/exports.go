@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func (ru *Router) GetExport(w http.ResponseWriter, r *http.Request) {
+	export, ok := ru.loadExport(w, r)
+	if !ok {
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "export status", export, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	export, ok := ru.loadExport(w, r)
+	if !ok {
+		return
+	}
+
+	if export.Status != model.ExportStatusCompleted {
+		resp := utils.BuildResponse(http.StatusConflict, "export is not ready for download", nil, export.Status, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	f, err := os.Open(export.FilePath)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusGone, "export file is no longer available", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.FileName))
+	http.ServeContent(w, r, export.FileName, info.ModTime(), f)
+}
+
+// loadExport fetches the export named in the route for the authenticated
+// user. Exports of other users are reported as not found.
+func (ru *Router) loadExport(w http.ResponseWriter, r *http.Request) (*model.Export, bool) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return nil, false
+	}
+
+	exportID, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid export id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return nil, false
+	}
+
+	export, err := model.GetExport(ru.DB, exportID, id)
+	if err != nil {
+		if errors.Is(err, model.ErrorExportNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "export not found", nil, nil, nil)
+			resp.BadResponse(w)
+			return nil, false
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return nil, false
+	}
+	return export, true
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func (ru *Router) AdminListFeeRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := model.ListFeeRules(ru.DB)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !ru.audit(w, r, model.AuditFeesView, "fee_rule", 0, nil) {
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "fee schedule", rules, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// AdminSaveFeeRule sets the fee of one kind of transaction in one currency,
+// replacing the rule set before.
+func (ru *Router) AdminSaveFeeRule(w http.ResponseWriter, r *http.Request) {
+	var rule model.FeeRule
+	if err := utils.ReadJSONRequest(r, &rule); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := rule.SaveFeeRule(ru.DB, actor(r)); err != nil {
+		if errors.Is(err, model.ErrorInvalidFeeRule) || errors.Is(err, model.ErrorUnsupportedCurrency) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid fee rule", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "fee rule saved", rule, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminDeleteFeeRule(w http.ResponseWriter, r *http.Request) {
+	id, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid fee rule id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := model.DeleteFeeRule(ru.DB, actor(r), id); err != nil {
+		if errors.Is(err, model.ErrorFeeRuleNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "fee rule not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "fee rule deleted", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
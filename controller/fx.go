@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func (ru *Router) ListExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := model.ListExchangeRates(ru.DB)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "exchange rates", rates, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// ImportExchangeRates replaces rates from a JSON array or, when the request
+// is sent as text/csv, from CSV rows of base, quote, rate and spread_bps.
+func (ru *Router) ImportExchangeRates(w http.ResponseWriter, r *http.Request) {
+	var rates []*model.ExchangeRate
+	var err error
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		rates, err = model.ParseExchangeRatesCSV(http.MaxBytesReader(w, r.Body, 1<<20))
+	} else {
+		err = utils.ReadJSONRequest(r, &rates)
+	}
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := model.UpsertExchangeRates(ru.DB, actor(r), rates); err != nil {
+		if errors.Is(err, model.ErrorInvalidRate) || errors.Is(err, model.ErrorUnsupportedCurrency) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid exchange rate", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "exchange rates updated", rates, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) CreateQuote(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		FromCurrency string `json:"from_currency"`
+		ToCurrency   string `json:"to_currency"`
+		Amount       int64  `json:"amount"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if body.Amount <= 0 {
+		resp := utils.BuildResponse(http.StatusBadRequest, "amount must be greater than zero", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	from, ok := requireCurrency(w, body.FromCurrency)
+	if !ok {
+		return
+	}
+	to, ok := requireCurrency(w, body.ToCurrency)
+	if !ok {
+		return
+	}
+	if from == to {
+		resp := utils.BuildResponse(http.StatusBadRequest, "from_currency and to_currency must differ", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	quote := &model.FXQuote{FromCurrency: from, ToCurrency: to, SourceAmount: body.Amount}
+	if err := quote.CreateQuote(ru.DB, id); err != nil {
+		if errors.Is(err, model.ErrorRateNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "no exchange rate for this currency pair", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorAmountTooSmall) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "amount is too small to convert", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusCreated, "quote created", quote, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) CreateConversion(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		QuoteID   string `json:"quote_id"`
+		Reference string `json:"reference"`
+		TOTPCode  string `json:"totp_code"` // required for conversions above the step-up threshold
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.QuoteID == "" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "quote_id is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !requireReference(w, "reference", body.Reference) {
+		return
+	}
+
+	quote, err := model.GetQuote(ru.DB, body.QuoteID, id)
+	if err != nil {
+		if errors.Is(err, model.ErrorQuoteNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "quote not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !ru.requireStepUp(w, r, id, quote.SourceAmount, body.TOTPCode) {
+		return
+	}
+
+	conversion := &model.Conversion{QuoteID: body.QuoteID, Reference: body.Reference}
+	if err := conversion.Convert(ru.DB, id); err != nil {
+		var limitErr *model.LimitExceededError
+		switch {
+		case errors.As(err, &limitErr):
+			resp := utils.BuildResponse(http.StatusUnprocessableEntity, "limit exceeded", nil, limitErr, nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorQuoteNotFound):
+			resp := utils.BuildResponse(http.StatusNotFound, "quote not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorWalletNotFound):
+			resp := utils.BuildResponse(http.StatusNotFound, "a wallet in both currencies is required", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorQuoteExpired), errors.Is(err, model.ErrorQuoteUsed):
+			resp := utils.BuildResponse(http.StatusConflict, "quote can no longer be used", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorDuplicateTransaction):
+			resp := utils.BuildResponse(http.StatusConflict, "duplicate conversion", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorEmailNotVerified):
+			resp := utils.BuildResponse(http.StatusForbidden, "verify your email address before debiting your wallet", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorWalletFrozen), errors.Is(err, model.ErrorWalletDebitBlocked), errors.Is(err, model.ErrorWalletClosed):
+			resp := utils.BuildResponse(http.StatusForbidden, "wallet status does not allow this transaction", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorInsuffcientBalance):
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot debit wallet: balance is too low", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		default:
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+		}
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "conversion successful", conversion, nil, nil)
+	resp.SuccessResponse(w)
+}
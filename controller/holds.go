@@ -0,0 +1,217 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// maxHoldTTL caps how far in the future a client can push a hold's expiry.
+const maxHoldTTL = 30 * 24 * time.Hour
+
+func (ru *Router) CreateHold(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Amount    int64  `json:"amount"`
+		Currency  string `json:"currency"`
+		Reference string `json:"reference"`
+		ExpiresIn int64  `json:"expires_in"` // seconds
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if body.Amount <= 0 {
+		resp := utils.BuildResponse(http.StatusBadRequest, "amount must be greater than zero", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	ttl := time.Duration(body.ExpiresIn) * time.Second
+	if body.ExpiresIn < 0 || ttl > maxHoldTTL {
+		resp := utils.BuildResponse(http.StatusBadRequest, "expires_in must be between 1 second and 30 days", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	currency, ok := requireCurrency(w, body.Currency)
+	if !ok {
+		return
+	}
+	if !requireReference(w, "reference", body.Reference) {
+		return
+	}
+
+	hold := &model.Hold{Amount: body.Amount, Currency: currency, Reference: body.Reference}
+	if ttl > 0 {
+		hold.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	if err := hold.CreateHold(ru.DB, id); err != nil {
+		if errors.Is(err, model.ErrorEmailNotVerified) {
+			resp := utils.BuildResponse(http.StatusForbidden, "verify your email address before debiting your wallet", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorWalletFrozen) || errors.Is(err, model.ErrorWalletDebitBlocked) || errors.Is(err, model.ErrorWalletClosed) {
+			resp := utils.BuildResponse(http.StatusForbidden, "wallet status does not allow this transaction", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorWalletNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "no wallet in this currency", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		var limitErr *model.LimitExceededError
+		if errors.As(err, &limitErr) {
+			resp := utils.BuildResponse(http.StatusUnprocessableEntity, "limit exceeded", nil, limitErr, nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorInsuffcientBalance) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot place hold: available balance is too low", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorDuplicateTransaction) {
+			resp := utils.BuildResponse(http.StatusConflict, "duplicate hold", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusCreated, "hold placed", hold, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	holdId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid hold id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Amount   int64  `json:"amount"`
+		TOTPCode string `json:"totp_code"` // required for captures above the step-up threshold
+	}
+	// the body is optional, an empty one captures the full hold
+	if err := utils.ReadJSONRequest(r, &body); err != nil && !errors.Is(err, io.EOF) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Amount < 0 {
+		resp := utils.BuildResponse(http.StatusBadRequest, "amount must be greater than zero", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	amount := body.Amount
+	if amount == 0 {
+		held, err := model.GetHold(ru.DB, holdId, id)
+		if err != nil {
+			holdError(w, err)
+			return
+		}
+		amount = held.Amount
+	}
+	if !ru.requireStepUp(w, r, id, amount, body.TOTPCode) {
+		return
+	}
+
+	hold := new(model.Hold)
+	t, err := hold.Capture(ru.DB, id, holdId, body.Amount)
+	if err != nil {
+		if errors.Is(err, model.ErrorCaptureExceedsHold) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot capture more than was held", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		holdError(w, err)
+		return
+	}
+
+	data := map[string]any{"hold": hold, "transaction": t}
+	resp := utils.BuildResponse(http.StatusOK, "hold captured", data, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	holdId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid hold id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	hold := new(model.Hold)
+	if err := hold.Release(ru.DB, id, holdId); err != nil {
+		holdError(w, err)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "hold released", hold, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// holdError writes the response for errors shared by capture and release.
+func holdError(w http.ResponseWriter, err error) {
+	var limitErr *model.LimitExceededError
+	switch {
+	case errors.As(err, &limitErr):
+		resp := utils.BuildResponse(http.StatusUnprocessableEntity, "limit exceeded", nil, limitErr, nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorHoldNotFound):
+		resp := utils.BuildResponse(http.StatusNotFound, "hold not found", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorHoldNotOpen), errors.Is(err, model.ErrorHoldExpired):
+		resp := utils.BuildResponse(http.StatusConflict, "hold can no longer be changed", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorInsuffcientBalance):
+		resp := utils.BuildResponse(http.StatusBadRequest, "cannot debit wallet: balance is too low", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorWalletFrozen), errors.Is(err, model.ErrorWalletDebitBlocked), errors.Is(err, model.ErrorWalletClosed):
+		resp := utils.BuildResponse(http.StatusForbidden, "wallet status does not allow this transaction", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	default:
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+	}
+}
@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// JWKS serves the public keys access tokens can be verified with. The body
+// is a plain JWK set rather than the usual response envelope since JWT
+// libraries read it directly.
+func (ru *Router) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.SendJSONResponse(w, struct {
+		Keys []utils.JWK `json:"keys"`
+	}{utils.JWKS()}, http.StatusOK)
+}
+
+// CheckpointKeys serves the public keys ledger checkpoints can be verified
+// with, retired ones included, in the same format as JWKS.
+func (ru *Router) CheckpointKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.SendJSONResponse(w, struct {
+		Keys []utils.JWK `json:"keys"`
+	}{utils.CheckpointJWKS()}, http.StatusOK)
+}
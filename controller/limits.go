@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func (ru *Router) AdminListLimits(w http.ResponseWriter, r *http.Request) {
+	limits, err := model.ListLimits(ru.DB)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !ru.audit(w, r, model.AuditLimitsView, "transaction_limit", 0, nil) {
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "transaction limits", limits, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// AdminSaveLimit sets the limits of a tier or of a single user in one
+// currency, replacing the ones set before.
+func (ru *Router) AdminSaveLimit(w http.ResponseWriter, r *http.Request) {
+	var limit model.TransactionLimit
+	if err := utils.ReadJSONRequest(r, &limit); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := limit.SaveLimit(ru.DB, actor(r)); err != nil {
+		switch {
+		case errors.Is(err, model.ErrorInvalidLimit), errors.Is(err, model.ErrorUnsupportedCurrency):
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid limit", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorUserNotFound):
+			resp := utils.BuildResponse(http.StatusNotFound, "user not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		default:
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+		}
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "limit saved", limit, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) AdminSetUserTier(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid user id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Tier string `json:"tier"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	user, err := model.SetUserTier(ru.DB, actor(r), userId, body.Tier)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrorInvalidTier):
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid tier", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorUserNotFound):
+			resp := utils.BuildResponse(http.StatusNotFound, "user not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		default:
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+		}
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "tier updated", user, nil, nil)
+	resp.SuccessResponse(w)
+}
@@ -2,9 +2,14 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
 	"github.com/lupppig/stream-ledger-api/utils"
 )
 
@@ -12,31 +17,81 @@ type CtxKey string
 
 const ContextKeyUserID CtxKey = "userID"
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
-			resp := utils.BuildResponse(http.StatusUnauthorized, "missing auth header", nil, nil, nil)
-			resp.BadResponse(w)
-			return
-		}
-
-		var tokenStr string
-		fmt.Sscanf(auth, "Bearer %s", &tokenStr)
-		if tokenStr == "" {
-			resp := utils.BuildResponse(http.StatusUnauthorized, "invalid auth header", nil, nil, nil)
-			resp.BadResponse(w)
-			return
-		}
-
-		claims, err := utils.ParseToken(tokenStr)
-		if err != nil {
-			resp := utils.BuildResponse(http.StatusUnauthorized, "invalid token", nil, err.Error(), nil)
-			resp.BadResponse(w)
-			return
-		}
-
-		ctx := context.WithValue(r.Context(), ContextKeyUserID, claims.UserID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// ContextKeyClaims holds the *utils.Claims of the access token.
+const ContextKeyClaims CtxKey = "claims"
+
+// ContextKeyAPIKey holds the *model.APIKey when the request was made with
+// an API key instead of an access token.
+const ContextKeyAPIKey CtxKey = "apiKey"
+
+// AuthMiddleware returns middleware that accepts a valid bearer access token
+// that has not been revoked through logout, or an API key sent either in
+// the X-API-Key header or as the bearer token.
+func AuthMiddleware(db *postgres.PostgresDB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenStr := r.Header.Get("X-API-Key")
+			if tokenStr == "" {
+				auth := r.Header.Get("Authorization")
+				if auth == "" {
+					resp := utils.BuildResponse(http.StatusUnauthorized, "missing auth header", nil, nil, nil)
+					resp.BadResponse(w)
+					return
+				}
+
+				fmt.Sscanf(auth, "Bearer %s", &tokenStr)
+				if tokenStr == "" {
+					resp := utils.BuildResponse(http.StatusUnauthorized, "invalid auth header", nil, nil, nil)
+					resp.BadResponse(w)
+					return
+				}
+			}
+
+			if strings.HasPrefix(tokenStr, model.APIKeyPrefix) {
+				key, err := model.AuthenticateAPIKey(r.Context(), db, tokenStr)
+				if err != nil {
+					if errors.Is(err, model.ErrorInvalidAPIKey) {
+						resp := utils.BuildResponse(http.StatusUnauthorized, "invalid api key", nil, err.Error(), nil)
+						resp.BadResponse(w)
+						return
+					}
+					log.Println(err.Error())
+					resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+					resp.BadResponse(w)
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), ContextKeyUserID, key.UserID)
+				ctx = context.WithValue(ctx, ContextKeyAPIKey, key)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			claims, err := utils.ParseToken(tokenStr)
+			if err != nil {
+				resp := utils.BuildResponse(http.StatusUnauthorized, "invalid token", nil, err.Error(), nil)
+				resp.BadResponse(w)
+				return
+			}
+
+			if claims.ID != "" {
+				revoked, err := model.IsAccessTokenRevoked(r.Context(), db, claims.ID)
+				if err != nil {
+					log.Println(err.Error())
+					resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+					resp.BadResponse(w)
+					return
+				}
+				if revoked {
+					resp := utils.BuildResponse(http.StatusUnauthorized, "token has been revoked", nil, nil, nil)
+					resp.BadResponse(w)
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), ContextKeyUserID, claims.UserID)
+			ctx = context.WithValue(ctx, ContextKeyClaims, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
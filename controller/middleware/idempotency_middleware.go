@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// recordingWriter passes the response through and keeps a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.statusCode == 0 {
+		rw.statusCode = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// Idempotency makes mutating requests sent with an Idempotency-Key header
+// safe to retry. The first request with a key runs and its response is kept
+// for model.IdempotencyKeyTTL; a retry with the same method, path and body
+// gets that response again with Idempotent-Replayed: true instead of running
+// twice. Reusing a key for a different request is rejected with 422 and a
+// retry while the first is still running with 409. Keys are per user, so it
+// has to run after AuthMiddleware. Server errors are not kept, so those
+// requests can be retried with the same key.
+func Idempotency(db *postgres.PostgresDB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			userId, ok := r.Context().Value(ContextKeyUserID).(int64)
+			if key == "" || !ok || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				resp := utils.BuildResponse(http.StatusBadRequest, "idempotency key is too long", nil, nil, nil)
+				resp.BadResponse(w)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+				resp.BadResponse(w)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+
+			stored, err := model.ClaimIdempotencyKey(db, userId, key, hex.EncodeToString(sum[:]))
+			if err != nil {
+				switch {
+				case errors.Is(err, model.ErrorIdempotencyKeyReused):
+					resp := utils.BuildResponse(http.StatusUnprocessableEntity, "idempotency key reused", nil, err.Error(), nil)
+					resp.BadResponse(w)
+				case errors.Is(err, model.ErrorIdempotencyKeyInUse):
+					resp := utils.BuildResponse(http.StatusConflict, "idempotency key in use", nil, err.Error(), nil)
+					resp.BadResponse(w)
+				default:
+					log.Println(err.Error())
+					resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+					resp.BadResponse(w)
+				}
+				return
+			}
+			if stored != nil {
+				if stored.ContentType != "" {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				_, _ = w.Write(stored.Response)
+				return
+			}
+
+			rw := &recordingWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+
+			if rw.statusCode == 0 || rw.statusCode >= http.StatusInternalServerError {
+				err = model.ReleaseIdempotencyKey(db, userId, key)
+			} else {
+				err = model.CompleteIdempotencyKey(db, userId, key, rw.statusCode, rw.Header().Get("Content-Type"), rw.body.Bytes())
+			}
+			if err != nil {
+				// the response has gone out already, a retry will wait for
+				// the claim to time out
+				log.Printf("failed to store idempotent response: %v", err)
+			}
+		})
+	}
+}
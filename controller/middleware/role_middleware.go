@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// RequireRole only lets through users whose access token carries one of
+// roles. API keys never act with a role. It has to run after AuthMiddleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(ContextKeyClaims).(*utils.Claims)
+			if !ok || !slices.Contains(roles, claims.Role) {
+				resp := utils.BuildResponse(http.StatusForbidden, "your role does not allow this action", nil, nil, nil)
+				resp.BadResponse(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
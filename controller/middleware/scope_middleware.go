@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// RequireScope only lets API keys through that were granted scope. Users
+// signed in with an access token have every scope. It has to run after
+// AuthMiddleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := r.Context().Value(ContextKeyAPIKey).(*model.APIKey); ok && !key.HasScope(scope) {
+				resp := utils.BuildResponse(http.StatusForbidden, "api key is missing the "+scope+" scope", nil, nil, nil)
+				resp.BadResponse(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession rejects API keys on routes that manage the account itself,
+// such as API keys and two-factor authentication. It has to run after
+// AuthMiddleware.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(ContextKeyAPIKey).(*model.APIKey); ok {
+			resp := utils.BuildResponse(http.StatusForbidden, "this route needs a signed in user, api keys are not accepted", nil, nil, nil)
+			resp.BadResponse(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
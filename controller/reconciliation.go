@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func (ru *Router) AdminListReconciliationRuns(w http.ResponseWriter, r *http.Request) {
+	pagination := utils.GetPagination(r)
+	runs, total, err := model.ListReconciliationRuns(ru.DB, pagination)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !ru.audit(w, r, model.AuditReconcileView, "reconciliation_runs", 0, map[string]any{"page": pagination.Page}) {
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "reconciliation runs", runs, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
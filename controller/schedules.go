@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func (ru *Router) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Entry               string    `json:"entry"` // credit, debit or transfer
+		Amount              int64     `json:"amount"`
+		Currency            string    `json:"currency"`
+		RecipientEmail      string    `json:"recipient_email"`
+		RecipientWalletID   int64     `json:"recipient_wallet_id"`
+		Frequency           string    `json:"frequency"`
+		Cron                string    `json:"cron"`
+		StartAt             time.Time `json:"start_at"`
+		OnInsufficientFunds string    `json:"on_insufficient_funds"`
+		MaxRetries          int       `json:"max_retries"`
+		RetryInterval       int64     `json:"retry_interval"`
+		TOTPCode            string    `json:"totp_code"` // required for debits and transfers above the step-up threshold
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	currency, ok := requireCurrency(w, body.Currency)
+	if !ok {
+		return
+	}
+
+	// a schedule may only post what the key could post directly
+	if key, viaAPIKey := r.Context().Value(middleware.ContextKeyAPIKey).(*model.APIKey); viaAPIKey {
+		scope := model.ScopeTransactionsWrite
+		if body.Entry == "transfer" {
+			scope = model.ScopeTransfersWrite
+		}
+		if !key.HasScope(scope) {
+			resp := utils.BuildResponse(http.StatusForbidden, "api key is missing the "+scope+" scope", nil, nil, nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+	// occurrences run unattended, so the second factor is taken now
+	if (body.Entry == "debit" || body.Entry == "transfer") && !ru.requireStepUp(w, r, id, body.Amount, body.TOTPCode) {
+		return
+	}
+
+	schedule := &model.Schedule{
+		Entry:               body.Entry,
+		Amount:              body.Amount,
+		Currency:            currency,
+		RecipientEmail:      body.RecipientEmail,
+		RecipientWalletID:   body.RecipientWalletID,
+		Frequency:           body.Frequency,
+		Cron:                body.Cron,
+		StartAt:             body.StartAt,
+		OnInsufficientFunds: body.OnInsufficientFunds,
+		MaxRetries:          body.MaxRetries,
+		RetryInterval:       body.RetryInterval,
+	}
+	if err := schedule.CreateSchedule(ru.DB, id); err != nil {
+		if errors.Is(err, model.ErrorInvalidSchedule) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid schedule", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorWalletNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "no wallet in this currency", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusCreated, "schedule created", schedule, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	pagination := utils.GetPagination(r)
+	schedules, total, err := model.ListSchedules(ru.DB, id, pagination)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "schedules", schedules, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	userId, scheduleId, ok := scheduleParams(w, r)
+	if !ok {
+		return
+	}
+
+	schedule, err := model.GetSchedule(ru.DB, scheduleId, userId)
+	if err != nil {
+		scheduleError(w, err)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "schedule", schedule, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) ListScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	userId, scheduleId, ok := scheduleParams(w, r)
+	if !ok {
+		return
+	}
+
+	pagination := utils.GetPagination(r)
+	runs, total, err := model.ListScheduleRuns(ru.DB, scheduleId, userId, pagination)
+	if err != nil {
+		scheduleError(w, err)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "schedule runs", runs, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) PauseSchedule(w http.ResponseWriter, r *http.Request) {
+	ru.setScheduleStatus(w, r, model.ScheduleStatusPaused)
+}
+
+func (ru *Router) ResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	ru.setScheduleStatus(w, r, model.ScheduleStatusActive)
+}
+
+func (ru *Router) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	ru.setScheduleStatus(w, r, model.ScheduleStatusCancelled)
+}
+
+func (ru *Router) setScheduleStatus(w http.ResponseWriter, r *http.Request, status string) {
+	userId, scheduleId, ok := scheduleParams(w, r)
+	if !ok {
+		return
+	}
+
+	schedule, err := model.SetScheduleStatus(ru.DB, scheduleId, userId, status)
+	if err != nil {
+		scheduleError(w, err)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "schedule "+schedule.Status, schedule, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func scheduleParams(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	userId, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return 0, 0, false
+	}
+	scheduleId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid schedule id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return 0, 0, false
+	}
+	return userId, scheduleId, true
+}
+
+func scheduleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, model.ErrorScheduleNotFound):
+		resp := utils.BuildResponse(http.StatusNotFound, "schedule not found", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorScheduleStatus):
+		resp := utils.BuildResponse(http.StatusConflict, "schedule cannot be changed", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	default:
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+	}
+}
@@ -3,14 +3,18 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/lupppig/stream-ledger-api/controller/middleware"
 	"github.com/lupppig/stream-ledger-api/jobs"
 	"github.com/lupppig/stream-ledger-api/model"
 	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	services "github.com/lupppig/stream-ledger-api/service"
 	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/riverqueue/river"
 )
 
 func (ru *Router) CreateTransactions(w http.ResponseWriter, r *http.Request) {
@@ -22,9 +26,11 @@ func (ru *Router) CreateTransactions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var transaction struct {
-		Entry   string `json:"entry"`
-		Amount  int    `json:"amount"`
-		TransID string `json:"trans_id"`
+		Entry    string `json:"entry"`
+		Amount   int    `json:"amount"`
+		Currency string `json:"currency"`
+		TransID  string `json:"trans_id"`
+		TOTPCode string `json:"totp_code"` // required for debits above the step-up threshold
 	}
 	if err := utils.ReadJSONRequest(r, &transaction); err != nil {
 		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
@@ -32,20 +38,66 @@ func (ru *Router) CreateTransactions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if transaction.Entry != "credit" && transaction.Entry != "debit" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "entry must be credit or debit", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if transaction.Amount <= 0 {
+		resp := utils.BuildResponse(http.StatusBadRequest, "amount must be greater than zero", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	currency, ok := requireCurrency(w, transaction.Currency)
+	if !ok {
+		return
+	}
+	if !requireReference(w, "trans_id", transaction.TransID) {
+		return
+	}
+
+	if transaction.Entry == "debit" && !ru.requireStepUp(w, r, id, int64(transaction.Amount), transaction.TOTPCode) {
+		return
+	}
+
 	var trx = &model.Transaction{
-		Entry:   transaction.Entry,
-		Amount:  int64(transaction.Amount),
-		TransID: transaction.TransID,
+		Entry:    transaction.Entry,
+		Amount:   int64(transaction.Amount),
+		Currency: currency,
+		TransID:  transaction.TransID,
 	}
 
 	if err := trx.CreateTransaction(ru.DB, id); err != nil {
+		if errors.Is(err, model.ErrorWalletNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "no wallet in this currency", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorEmailNotVerified) {
+			resp := utils.BuildResponse(http.StatusForbidden, "verify your email address before debiting your wallet", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorWalletFrozen) || errors.Is(err, model.ErrorWalletDebitBlocked) || errors.Is(err, model.ErrorWalletClosed) {
+			resp := utils.BuildResponse(http.StatusForbidden, "wallet status does not allow this transaction", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		// the body says which limit was hit and how much of it is left
+		var limitErr *model.LimitExceededError
+		if errors.As(err, &limitErr) {
+			resp := utils.BuildResponse(http.StatusUnprocessableEntity, "limit exceeded", nil, limitErr, nil)
+			resp.BadResponse(w)
+			return
+		}
 		if errors.Is(err, model.ErrorInsuffcientBalance) {
 			resp := utils.BuildResponse(http.StatusBadRequest, "cannot debit wallet: balance is too low", nil, err.Error(), nil)
 			resp.BadResponse(w)
 			return
 		}
 		if errors.Is(err, model.ErrorDuplicateTransaction) {
-			resp := utils.BuildResponse(http.StatusConflict, "duplicate transaction entry", nil, err.Error(), nil)
+			resp := utils.BuildResponse(http.StatusConflict, "trans_id was already used for a different transaction", nil, err.Error(), nil)
 			resp.BadResponse(w)
 			return
 		}
@@ -56,29 +108,29 @@ func (ru *Router) CreateTransactions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	trans := kafka.TransactionEvent{
-		UserID:  id,
-		Entry:   trx.Entry,
-		Amount:  trx.Amount,
-		Balance: trx.Wallet.Balance,
-	}
-
-	go ru.Prod.PublishTransaction(trans)
-
 	var resData = struct {
-		TransactionID int64  `json:"transaction_id"`
-		WalletID      int64  `json:"wallet_id"`
-		Entry         string `json:"entry"`
-		Amount        int64  `json:"amount"`
-		TransID       string `json:"trans_id"`
+		TransactionID int64               `json:"transaction_id"`
+		WalletID      int64               `json:"wallet_id"`
+		Entry         string              `json:"entry"`
+		Amount        int64               `json:"amount"`
+		Currency      string              `json:"currency"`
+		TransID       string              `json:"trans_id"`
+		Fee           *kafka.FeeBreakdown `json:"fee,omitempty"`
 	}{
 		TransactionID: trx.ID,
 		WalletID:      trx.WalletID,
 		Entry:         trx.Entry,
 		Amount:        trx.Amount,
+		Currency:      trx.Currency,
 		TransID:       trx.TransID,
+		Fee:           trx.Fee,
+	}
+	message := "transaction successfully"
+	if trx.Replayed {
+		// a retry of a trans_id already posted gets the original back
+		message = "transaction already recorded"
 	}
-	resp := utils.BuildResponse(http.StatusOK, "transaction successfully", resData, nil, nil)
+	resp := utils.BuildResponse(http.StatusOK, message, resData, nil, nil)
 	resp.SuccessResponse(w)
 }
 
@@ -99,6 +151,13 @@ func (ru *Router) ListUserTransactions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	resp := utils.BuildResponse(http.StatusOK, "user transactions list", transactions, nil, pageInfo(r, pagination, total))
+	resp.SuccessResponse(w)
+}
+
+// pageInfo describes the page of a list response with links to the pages
+// around it.
+func pageInfo(r *http.Request, pagination utils.Pagination, total int) interface{} {
 	q := r.URL.Query()
 	nextPage := ""
 	prevPage := ""
@@ -113,7 +172,7 @@ func (ru *Router) ListUserTransactions(w http.ResponseWriter, r *http.Request) {
 		prevPage = fmt.Sprintf("%s?%s", r.URL.Path, q.Encode())
 	}
 
-	var pagin = struct {
+	return struct {
 		Page     int    `json:"page"`
 		Limit    int    `limit:"limit"`
 		Total    int    `total:"total"`
@@ -126,8 +185,81 @@ func (ru *Router) ListUserTransactions(w http.ResponseWriter, r *http.Request) {
 		NextPage: nextPage,
 		PrevPage: prevPage,
 	}
+}
+
+func (ru *Router) ReverseTransaction(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	transId, err := utils.PathInt64(r, "id")
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid transaction id", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Amount    int64  `json:"amount"`
+		Reason    string `json:"reason"`
+		Reference string `json:"reference"`
+	}
+	// the body is optional, an empty one reverses everything left
+	if err := utils.ReadJSONRequest(r, &body); err != nil && !errors.Is(err, io.EOF) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Amount < 0 {
+		resp := utils.BuildResponse(http.StatusBadRequest, "amount must be greater than zero", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !requireReference(w, "reference", body.Reference) {
+		return
+	}
+
+	reversal := &model.Reversal{
+		TransactionID: transId,
+		Amount:        body.Amount,
+		Reason:        body.Reason,
+		Reference:     body.Reference,
+	}
+	if err := reversal.Reverse(ru.DB, id); err != nil {
+		switch {
+		case errors.Is(err, model.ErrorTransactionNotFound):
+			resp := utils.BuildResponse(http.StatusNotFound, "transaction not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorAlreadyReversed):
+			resp := utils.BuildResponse(http.StatusConflict, "transaction already reversed", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorDuplicateTransaction):
+			resp := utils.BuildResponse(http.StatusConflict, "reference was already used for a reversal", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorReversalExceedsOriginal), errors.Is(err, model.ErrorNotReversible):
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot reverse transaction", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorEmailNotVerified):
+			resp := utils.BuildResponse(http.StatusForbidden, "verify your email address before debiting your wallet", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorWalletFrozen), errors.Is(err, model.ErrorWalletDebitBlocked), errors.Is(err, model.ErrorWalletClosed):
+			resp := utils.BuildResponse(http.StatusForbidden, "wallet status does not allow this transaction", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		case errors.Is(err, model.ErrorInsuffcientBalance):
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot debit wallet: balance is too low", nil, err.Error(), nil)
+			resp.BadResponse(w)
+		default:
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+		}
+		return
+	}
 
-	resp := utils.BuildResponse(http.StatusOK, "user transactions list", transactions, nil, pagin)
+	resp := utils.BuildResponse(http.StatusOK, "transaction reversed", reversal, nil, nil)
 	resp.SuccessResponse(w)
 }
 
@@ -139,6 +271,44 @@ func (ru *Router) ExportTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var body struct {
+		Format    string `json:"format"`
+		Currency  string `json:"currency"`
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Entry     string `json:"entry"`
+		MinAmount int64  `json:"min_amount"`
+		MaxAmount int64  `json:"max_amount"`
+	}
+	// the body is optional, an empty one exports the default wallet to Excel
+	if err := utils.ReadJSONRequest(r, &body); err != nil && !errors.Is(err, io.EOF) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Format == "" {
+		body.Format = services.FormatExcel
+	}
+	body.Format = strings.ToLower(body.Format)
+	if _, err := services.ExporterFor(body.Format); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "unsupported export format", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	filter, err := exportFilter(body.From, body.To, body.Entry, body.MinAmount, body.MaxAmount)
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid export filters", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if body.Currency == "" {
+		body.Currency = model.DefaultCurrency
+	}
+	if filter.Currency, ok = requireCurrency(w, body.Currency); !ok {
+		return
+	}
+
 	user, err := model.GetUser(ru.DB, id)
 	if err != nil {
 		log.Println(err.Error())
@@ -147,19 +317,87 @@ func (ru *Router) ExportTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jbArg := jobs.ExportTransactionsArgs{
-		UserID: user.ID,
-		Email:  user.Email,
-	}
-
-	_, err = ru.DB.River.Insert(r.Context(), jbArg, nil)
+	export := &model.Export{UserID: user.ID, Format: body.Format}
+	err = export.CreateExport(ru.DB, func(exportID int64) river.JobArgs {
+		return jobs.ExportTransactionsArgs{
+			ExportID: exportID,
+			UserID:   user.ID,
+			Email:    user.Email,
+			Format:   body.Format,
+			Filter:   filter,
+		}
+	})
 
 	if err != nil {
 		log.Println(err.Error())
 		resp := utils.BuildResponse(http.StatusInternalServerError, "failed to queue export job", nil, nil, nil)
 		resp.BadResponse(w)
+		return
 	}
 
-	rsp := utils.BuildResponse(http.StatusOK, "your transaction data has been successfully exported to Excel", nil, nil, nil)
+	rsp := utils.BuildResponse(http.StatusAccepted, "your transaction export has been queued", export, nil, nil)
 	rsp.SuccessResponse(w)
 }
+
+func exportFilter(from, to, entry string, minAmount, maxAmount int64) (model.TransactionFilter, error) {
+	var filter model.TransactionFilter
+	var err error
+
+	if from != "" {
+		if filter.From, err = utils.ParseTime(from, false); err != nil {
+			return filter, err
+		}
+	}
+	if to != "" {
+		if filter.To, err = utils.ParseTime(to, true); err != nil {
+			return filter, err
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, errors.New("from must be before to")
+	}
+
+	if entry != "" && entry != "credit" && entry != "debit" {
+		return filter, errors.New("entry must be credit or debit")
+	}
+	filter.Entry = entry
+
+	if minAmount < 0 || maxAmount < 0 {
+		return filter, errors.New("amount bounds cannot be negative")
+	}
+	if maxAmount > 0 && minAmount > maxAmount {
+		return filter, errors.New("min_amount cannot be greater than max_amount")
+	}
+	filter.MinAmount = minAmount
+	filter.MaxAmount = maxAmount
+
+	return filter, nil
+}
+
+// requireCurrency validates a currency code from a request body and writes
+// a 400 response when it is missing or unsupported.
+func requireCurrency(w http.ResponseWriter, code string) (string, bool) {
+	if code == "" {
+		resp := utils.BuildResponse(http.StatusBadRequest, "currency is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return "", false
+	}
+	currency, err := model.NormalizeCurrency(code)
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "unsupported currency", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return "", false
+	}
+	return currency, true
+}
+
+// requireReference rejects a client chosen trans_id or reference that could
+// collide with an id the ledger makes itself.
+func requireReference(w http.ResponseWriter, field, ref string) bool {
+	if err := model.ValidateReference(ref); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, field+" cannot contain '"+model.ReferenceSeparator+"'", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return false
+	}
+	return true
+}
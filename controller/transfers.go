@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// counterpartyLeg is the leg of a transfer on the recipient's wallet as the
+// sender sees it, without the balance_after and hashes of that wallet.
+type counterpartyLeg struct {
+	TransactionID int64     `json:"transaction_id"`
+	WalletID      int64     `json:"wallet_id"`
+	Entry         string    `json:"entry"`
+	Amount        int64     `json:"amount"`
+	Currency      string    `json:"currency"`
+	TransID       string    `json:"trans_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (ru *Router) CreateTransfer(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var transfer struct {
+		RecipientEmail    string `json:"recipient_email"`
+		RecipientWalletID int64  `json:"recipient_wallet_id"`
+		Amount            int64  `json:"amount"`
+		Currency          string `json:"currency"`
+		TransferRef       string `json:"transfer_ref"`
+		TOTPCode          string `json:"totp_code"` // required for transfers above the step-up threshold
+	}
+	if err := utils.ReadJSONRequest(r, &transfer); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if transfer.Amount <= 0 {
+		resp := utils.BuildResponse(http.StatusBadRequest, "amount must be greater than zero", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if transfer.RecipientWalletID == 0 && !utils.CheckValidEmail(transfer.RecipientEmail) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "recipient_email or recipient_wallet_id is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	currency, ok := requireCurrency(w, transfer.Currency)
+	if !ok {
+		return
+	}
+	if !requireReference(w, "transfer_ref", transfer.TransferRef) {
+		return
+	}
+
+	if !ru.requireStepUp(w, r, id, transfer.Amount, transfer.TOTPCode) {
+		return
+	}
+
+	var trf = &model.Transfer{
+		Reference:         transfer.TransferRef,
+		Amount:            transfer.Amount,
+		Currency:          currency,
+		RecipientEmail:    transfer.RecipientEmail,
+		RecipientWalletID: transfer.RecipientWalletID,
+	}
+
+	if err := trf.CreateTransfer(ru.DB, id); err != nil {
+		if errors.Is(err, model.ErrorEmailNotVerified) {
+			resp := utils.BuildResponse(http.StatusForbidden, "verify your email address before debiting your wallet", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorWalletFrozen) || errors.Is(err, model.ErrorWalletDebitBlocked) || errors.Is(err, model.ErrorWalletClosed) {
+			resp := utils.BuildResponse(http.StatusForbidden, "wallet status does not allow this transaction", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		// the body says which limit was hit and how much of it is left
+		var limitErr *model.LimitExceededError
+		if errors.As(err, &limitErr) {
+			resp := utils.BuildResponse(http.StatusUnprocessableEntity, "limit exceeded", nil, limitErr, nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorInsuffcientBalance) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot debit wallet: balance is too low", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorWalletNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "no wallet in this currency", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorCurrencyMismatch) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "recipient wallet is in a different currency", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorRecipientNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "recipient wallet not found", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorSelfTransfer) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "cannot transfer to your own wallet", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorDuplicateTransaction) {
+			resp := utils.BuildResponse(http.StatusConflict, "duplicate transfer", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var resData = struct {
+		Reference         string             `json:"transfer_ref"`
+		Amount            int64              `json:"amount"`
+		Currency          string             `json:"currency"`
+		RecipientEmail    string             `json:"recipient_email,omitempty"`
+		RecipientWalletID int64              `json:"recipient_wallet_id"`
+		Debit             *model.Transaction `json:"debit"`
+		Credit            counterpartyLeg    `json:"credit"`
+	}{
+		Reference:         trf.Reference,
+		Amount:            trf.Amount,
+		Currency:          trf.Currency,
+		RecipientEmail:    trf.RecipientEmail,
+		RecipientWalletID: trf.RecipientWalletID,
+		Debit:             trf.Debit,
+		Credit: counterpartyLeg{
+			TransactionID: trf.Credit.ID,
+			WalletID:      trf.Credit.WalletID,
+			Entry:         trf.Credit.Entry,
+			Amount:        trf.Credit.Amount,
+			Currency:      trf.Credit.Currency,
+			TransID:       trf.Credit.TransID,
+			CreatedAt:     trf.Credit.CreatedAt,
+		},
+	}
+	resp := utils.BuildResponse(http.StatusOK, "transfer successful", resData, nil, nil)
+	resp.SuccessResponse(w)
+}
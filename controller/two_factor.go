@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// stepUpThreshold is the debit amount, in minor units of any currency,
+// above which debits, transfers, hold captures and conversions ask for a
+// fresh TOTP code. It is read from STEP_UP_THRESHOLD.
+var stepUpThreshold = envInt64("STEP_UP_THRESHOLD", 1_000_000)
+
+func envInt64(key string, def int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func (ru *Router) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	enrollment, err := model.EnrollTOTP(ru.DB, id)
+	if err != nil {
+		twoFactorError(w, err)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "scan the secret with an authenticator app and confirm a code", enrollment, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	codes, err := model.ConfirmTOTP(ru.DB, id, body.Code)
+	if err != nil {
+		twoFactorError(w, err)
+		return
+	}
+
+	data := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes}
+	resp := utils.BuildResponse(http.StatusOK, "two-factor authentication enabled, store the recovery codes safely", data, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := model.DisableTOTP(ru.DB, id, body.Code); err != nil {
+		twoFactorError(w, err)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "two-factor authentication disabled", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// VerifyTwoFactor completes a sign in with the challenge SignIn returned and a
+// TOTP or recovery code.
+func (ru *Router) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	usr, err := model.CompleteMFAChallenge(ru.DB, body.ChallengeToken, body.Code)
+	if err != nil {
+		if errors.Is(err, model.ErrorInvalidUserToken) {
+			resp := utils.BuildResponse(http.StatusUnauthorized, "invalid or expired challenge, sign in again", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		if errors.Is(err, model.ErrorInvalidTOTPCode) {
+			resp := utils.BuildResponse(http.StatusUnauthorized, "invalid two-factor code, sign in again", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		twoFactorError(w, err)
+		return
+	}
+
+	rsp, err := ru.authResponse(usr, nil)
+	if err != nil {
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "user login successful", rsp, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// requireStepUp checks the TOTP code debits above stepUpThreshold must
+// carry. It writes the error response and returns false when the debit
+// cannot go ahead.
+func (ru *Router) requireStepUp(w http.ResponseWriter, r *http.Request, userId, amount int64, code string) bool {
+	if amount <= stepUpThreshold {
+		return true
+	}
+	// API keys belong to servers that cannot answer a TOTP prompt. Creating
+	// one takes a fresh TOTP code instead, see CreateAPIKey, which only
+	// stands in for the step-up when the owner has two-factor enabled
+	if _, viaAPIKey := r.Context().Value(middleware.ContextKeyAPIKey).(*model.APIKey); viaAPIKey {
+		user, err := model.GetUser(ru.DB, userId)
+		if err != nil {
+			log.Println(err.Error())
+			resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+			resp.BadResponse(w)
+			return false
+		}
+		if user.TOTPEnabledAt == nil {
+			resp := utils.BuildResponse(http.StatusForbidden, "enable two-factor authentication for debits of this size", nil, model.ErrorTOTPNotEnabled.Error(), nil)
+			resp.BadResponse(w)
+			return false
+		}
+		return true
+	}
+	if code == "" {
+		resp := utils.BuildResponse(http.StatusForbidden, "a totp_code is required for debits of this size", nil, nil, nil)
+		resp.BadResponse(w)
+		return false
+	}
+
+	if err := model.VerifyTOTP(ru.DB, userId, code); err != nil {
+		if errors.Is(err, model.ErrorTOTPNotEnabled) {
+			resp := utils.BuildResponse(http.StatusForbidden, "enable two-factor authentication for debits of this size", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return false
+		}
+		twoFactorError(w, err)
+		return false
+	}
+	return true
+}
+
+// requireSecondFactor asks users with two-factor authentication for a fresh
+// TOTP code before handing out a credential that outlives the session. Users
+// without it go ahead. It writes the error response and returns false when
+// the request cannot go ahead.
+func (ru *Router) requireSecondFactor(w http.ResponseWriter, userId int64, code string) bool {
+	user, err := model.GetUser(ru.DB, userId)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return false
+	}
+	if user.TOTPEnabledAt == nil {
+		return true
+	}
+	if code == "" {
+		resp := utils.BuildResponse(http.StatusForbidden, "a totp_code is required", nil, nil, nil)
+		resp.BadResponse(w)
+		return false
+	}
+	if err := model.VerifyTOTP(ru.DB, userId, code); err != nil {
+		twoFactorError(w, err)
+		return false
+	}
+	return true
+}
+
+func twoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, model.ErrorTOTPAlreadyEnabled):
+		resp := utils.BuildResponse(http.StatusConflict, "two-factor authentication is already enabled", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorTOTPNotEnabled):
+		resp := utils.BuildResponse(http.StatusBadRequest, "two-factor authentication is not enabled", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorInvalidTOTPCode):
+		resp := utils.BuildResponse(http.StatusForbidden, "invalid two-factor code", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	case errors.Is(err, model.ErrorTOTPLocked):
+		resp := utils.BuildResponse(http.StatusTooManyRequests, "too many invalid two-factor codes, try again later", nil, err.Error(), nil)
+		resp.BadResponse(w)
+	default:
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+	}
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/mailer"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+// ForgotPassword emails a password reset token. It answers the same way
+// whether or not the email belongs to a user so accounts cannot be probed.
+func (ru *Router) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !utils.CheckValidEmail(body.Email) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid email provided", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	user, err := model.GetUserByEmail(ru.DB, body.Email)
+	if err == nil {
+		err = ru.sendUserToken(r.Context(), user, model.TokenPurposePasswordReset)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println(err.Error())
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "if the email belongs to an account, a reset token has been sent to it", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+	if !utils.CheckValidPassword(body.Password) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "password field cannot be empty", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := model.ResetPassword(ru.DB, body.Token, body.Password); err != nil {
+		if errors.Is(err, model.ErrorInvalidUserToken) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid or expired reset token", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "password has been reset", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := model.VerifyEmail(ru.DB, body.Token); err != nil {
+		if errors.Is(err, model.ErrorInvalidUserToken) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid or expired verification token", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "email verified", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// ResendVerification emails a new verification token to the signed in user.
+func (ru *Router) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	user, err := model.GetUser(ru.DB, id)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		resp := utils.BuildResponse(http.StatusConflict, "email is already verified", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	if err := ru.sendUserToken(r.Context(), user, model.TokenPurposeEmailVerification); err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "verification email sent", nil, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// sendUserToken issues a token for purpose and emails it to the user.
+func (ru *Router) sendUserToken(ctx context.Context, user *model.User, purpose string) error {
+	token, err := model.IssueUserToken(ru.DB, user.ID, purpose)
+	if err != nil {
+		return err
+	}
+
+	msg := mailer.Message{To: user.Email}
+	switch purpose {
+	case model.TokenPurposePasswordReset:
+		msg.Subject = "Reset your password"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nUse this token to reset your password:\n\n%s\n\nIt expires at %s. If you did not ask for a password reset you can ignore this email.\n",
+			user.FirstName, token.Token, token.ExpiresAt.UTC().Format(time.RFC1123))
+	case model.TokenPurposeEmailVerification:
+		msg.Subject = "Verify your email address"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nUse this token to verify your email address:\n\n%s\n\nIt expires at %s.\n",
+			user.FirstName, token.Token, token.ExpiresAt.UTC().Format(time.RFC1123))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return ru.Mailer.Send(ctx, msg)
+}
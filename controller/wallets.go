@@ -1,7 +1,10 @@
 package controller
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/lupppig/stream-ledger-api/controller/middleware"
 	"github.com/lupppig/stream-ledger-api/model"
@@ -18,7 +21,7 @@ func (ru *Router) GetWallet(w http.ResponseWriter, r *http.Request) {
 
 	var user = &model.User{}
 
-	if err := user.GetWallet(ru.DB, id); err != nil {
+	if err := user.GetWallets(ru.DB, id); err != nil {
 		resp := utils.BuildResponse(http.StatusNotFound, "user wallet not found", nil, nil, nil)
 		resp.BadResponse(w)
 		return
@@ -27,3 +30,157 @@ func (ru *Router) GetWallet(w http.ResponseWriter, r *http.Request) {
 	resp := utils.BuildResponse(http.StatusOK, "user info", user, nil, nil)
 	resp.SuccessResponse(w)
 }
+
+func (ru *Router) CreateWallet(w http.ResponseWriter, r *http.Request) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	var body struct {
+		Currency string `json:"currency"`
+	}
+	if err := utils.ReadJSONRequest(r, &body); err != nil {
+		resp := utils.BuildResponse(http.StatusBadRequest, "invalid request sent", nil, err.Error(), nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	currency, ok := requireCurrency(w, body.Currency)
+	if !ok {
+		return
+	}
+
+	wallet := &model.Wallet{UserID: id, Currency: currency}
+	if err := wallet.CreateWallet(ru.DB); err != nil {
+		if errors.Is(err, model.ErrorWalletExists) {
+			resp := utils.BuildResponse(http.StatusConflict, "wallet already exists for this currency", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusCreated, "wallet created", wallet, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) GetWalletBalance(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := ru.balanceWallet(w, r)
+	if !ok {
+		return
+	}
+
+	at := time.Now().UTC()
+	if v := r.URL.Query().Get("at"); v != "" {
+		var err error
+		// a date on its own means the close of that day
+		if at, err = utils.ParseTime(v, true); err != nil {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid at", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+
+	balance, err := model.GetBalanceAt(ru.DB, wallet, at)
+	if err != nil {
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "wallet balance", balance, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+func (ru *Router) GetWalletBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := ru.balanceWallet(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	to := time.Now().UTC()
+	var err error
+	if v := q.Get("to"); v != "" {
+		if to, err = utils.ParseTime(v, true); err != nil {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid to", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if v := q.Get("from"); v != "" {
+		if from, err = utils.ParseTime(v, false); err != nil {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid from", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+	}
+	if !from.Before(to) {
+		resp := utils.BuildResponse(http.StatusBadRequest, "from must be before to", nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+	interval := q.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+
+	history, err := model.GetBalanceHistory(ru.DB, wallet.ID, from, to, interval)
+	if err != nil {
+		if errors.Is(err, model.ErrorInvalidInterval) || errors.Is(err, model.ErrorTooManyPeriods) {
+			resp := utils.BuildResponse(http.StatusBadRequest, "invalid interval", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return
+	}
+
+	resp := utils.BuildResponse(http.StatusOK, "wallet balance history", history, nil, nil)
+	resp.SuccessResponse(w)
+}
+
+// balanceWallet loads the caller's wallet in the currency query parameter,
+// the default currency when it is missing.
+func (ru *Router) balanceWallet(w http.ResponseWriter, r *http.Request) (*model.Wallet, bool) {
+	id, ok := r.Context().Value(middleware.ContextKeyUserID).(int64)
+	if !ok {
+		resp := utils.BuildResponse(http.StatusUnauthorized, "unauthorized user", nil, nil, nil)
+		resp.BadResponse(w)
+		return nil, false
+	}
+
+	code := r.URL.Query().Get("currency")
+	if code == "" {
+		code = model.DefaultCurrency
+	}
+	currency, ok := requireCurrency(w, code)
+	if !ok {
+		return nil, false
+	}
+
+	wallet, err := model.GetUserWallet(ru.DB, id, currency)
+	if err != nil {
+		if errors.Is(err, model.ErrorWalletNotFound) {
+			resp := utils.BuildResponse(http.StatusNotFound, "no wallet in this currency", nil, err.Error(), nil)
+			resp.BadResponse(w)
+			return nil, false
+		}
+		log.Println(err.Error())
+		resp := utils.BuildResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil, nil, nil)
+		resp.BadResponse(w)
+		return nil, false
+	}
+	return wallet, true
+}
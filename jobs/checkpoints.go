@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/riverqueue/river"
+)
+
+type LedgerCheckpointArgs struct{}
+
+func (LedgerCheckpointArgs) Kind() string {
+	return "ledger_checkpoint"
+}
+
+// LedgerCheckpointWorker signs the chain heads of the previous UTC day once
+// it is over. It runs as a periodic job and does nothing once the day is
+// checkpointed, or when no checkpoint keys are configured.
+type LedgerCheckpointWorker struct {
+	river.WorkerDefaults[LedgerCheckpointArgs]
+	DB *postgres.PostgresDB
+}
+
+func (w *LedgerCheckpointWorker) Work(ctx context.Context, job *river.Job[LedgerCheckpointArgs]) error {
+	if !utils.CheckpointKeysConfigured() {
+		return nil
+	}
+	cp, err := model.CreateCheckpoint(ctx, w.DB, time.Now().UTC().AddDate(0, 0, -1))
+	if errors.Is(err, model.ErrorCheckpointExists) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create ledger checkpoint: %w", err)
+	}
+	log.Printf("Signed ledger checkpoint for %s over %d wallets", cp.Day, len(cp.Heads))
+	return nil
+}
@@ -0,0 +1,41 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/riverqueue/river"
+)
+
+const expireHoldsBatchSize = 100
+
+type ExpireHoldsArgs struct{}
+
+func (ExpireHoldsArgs) Kind() string {
+	return "expire_holds"
+}
+
+// ExpireHoldsWorker releases open holds whose expiry has passed so the
+// reserved funds become available again. It runs as a periodic job.
+type ExpireHoldsWorker struct {
+	river.WorkerDefaults[ExpireHoldsArgs]
+	DB *postgres.PostgresDB
+}
+
+func (w *ExpireHoldsWorker) Work(ctx context.Context, job *river.Job[ExpireHoldsArgs]) error {
+	for {
+		expired, err := model.ExpireHolds(ctx, w.DB, expireHoldsBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to expire holds: %w", err)
+		}
+		if expired > 0 {
+			log.Printf("Expired %d holds", expired)
+		}
+		if expired < expireHoldsBatchSize {
+			return nil
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/lupppig/stream-ledger-api/model"
 	"github.com/lupppig/stream-ledger-api/repository/postgres"
@@ -11,9 +12,16 @@ import (
 	"github.com/riverqueue/river"
 )
 
+// exportBatchSize is the number of transactions read from the database at a
+// time while an export is written.
+const exportBatchSize = 1000
+
 type ExportTransactionsArgs struct {
-	UserID int64  `json:"user_id"`
-	Email  string `json:"email"`
+	ExportID int64                   `json:"export_id"`
+	UserID   int64                   `json:"user_id"`
+	Email    string                  `json:"email"`
+	Format   string                  `json:"format"`
+	Filter   model.TransactionFilter `json:"filter"`
 }
 
 func (ExportTransactionsArgs) Kind() string {
@@ -28,18 +36,81 @@ type ExportTransactionsWorker struct {
 func (w *ExportTransactionsWorker) Work(ctx context.Context, job *river.Job[ExportTransactionsArgs]) error {
 	args := job.Args
 
-	log.Printf("Starting transaction export for user %d", args.UserID)
+	log.Printf("Starting transaction export %d for user %d", args.ExportID, args.UserID)
 
-	transactions, err := model.FetchUserTransactions(context.Background(), w.DB, args.UserID)
-	if err != nil {
-		return fmt.Errorf("failed to fetch transactions: %w", err)
+	if err := model.UpdateExportStatus(ctx, w.DB, args.ExportID, model.ExportStatusRunning, "", ""); err != nil {
+		return fmt.Errorf("failed to mark export running: %w", err)
 	}
 
-	filePath, err := services.GenerateExcel(transactions, args.UserID)
+	filePath, err := w.export(ctx, args)
 	if err != nil {
-		return fmt.Errorf("failed to generate Excel report: %w", err)
+		// leave the export queued while river still has retries left
+		status := model.ExportStatusQueued
+		if job.Attempt >= job.MaxAttempts {
+			status = model.ExportStatusFailed
+		}
+		if uerr := model.UpdateExportStatus(ctx, w.DB, args.ExportID, status, "", err.Error()); uerr != nil {
+			log.Printf("failed to update export %d status: %v", args.ExportID, uerr)
+		}
+		return err
+	}
+
+	if err := model.UpdateExportStatus(ctx, w.DB, args.ExportID, model.ExportStatusCompleted, filePath, ""); err != nil {
+		return fmt.Errorf("failed to mark export completed: %w", err)
 	}
 
 	log.Printf("Transaction export completed for user %d: %s", args.UserID, filePath)
 	return nil
 }
+
+func (w *ExportTransactionsWorker) export(ctx context.Context, args ExportTransactionsArgs) (string, error) {
+	// exports queued before wallets had currencies cover the default wallet
+	if args.Filter.Currency == "" {
+		args.Filter.Currency = model.DefaultCurrency
+	}
+	wallet, err := model.GetUserWallet(w.DB, args.UserID, args.Filter.Currency)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch wallet: %w", err)
+	}
+
+	count, earliest, err := model.SummarizeUserTransactions(ctx, w.DB, args.UserID, args.Filter)
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize transactions: %w", err)
+	}
+
+	opening, closing, err := model.PeriodBalances(ctx, w.DB, wallet.ID, args.Filter)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute statement balances: %w", err)
+	}
+
+	now := time.Now()
+	stmt := services.Statement{
+		UserID:         args.UserID,
+		Email:          args.Email,
+		WalletID:       wallet.ID,
+		Currency:       wallet.Currency,
+		From:           args.Filter.From,
+		To:             args.Filter.To,
+		Count:          count,
+		OpeningBalance: opening,
+		ClosingBalance: closing,
+		Filter:         args.Filter,
+		GeneratedAt:    now,
+	}
+	if stmt.From.IsZero() {
+		stmt.From = earliest
+	}
+	if stmt.To.IsZero() {
+		stmt.To = now
+	}
+
+	rows := func(fn func(model.Transaction) error) error {
+		return model.EachUserTransaction(ctx, w.DB, args.UserID, args.Filter, exportBatchSize, fn)
+	}
+
+	filePath, err := services.GenerateExport(args.Format, stmt, rows)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate %s report: %w", args.Format, err)
+	}
+	return filePath, nil
+}
@@ -0,0 +1,56 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/riverqueue/river"
+)
+
+const outboxBatchSize = 100
+
+type PublishOutboxArgs struct{}
+
+func (PublishOutboxArgs) Kind() string {
+	return "publish_outbox"
+}
+
+// PublishOutboxWorker relays pending outbox events to Kafka. It is scheduled
+// as a periodic job and drains the outbox batch by batch until it is empty or
+// the broker stops acknowledging.
+type PublishOutboxWorker struct {
+	river.WorkerDefaults[PublishOutboxArgs]
+	DB   *postgres.PostgresDB
+	Prod *kafka.Producer
+}
+
+func (w *PublishOutboxWorker) Work(ctx context.Context, job *river.Job[PublishOutboxArgs]) error {
+	if w.Prod == nil {
+		return errors.New("kafka producer is not configured")
+	}
+
+	send := func(event *model.OutboxEvent) error {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		return w.Prod.Send(ctx, event.Key, event.EventID, event.EventType, event.Payload)
+	}
+
+	for {
+		sent, err := model.PublishPendingEvents(ctx, w.DB, outboxBatchSize, send)
+		if sent > 0 {
+			log.Printf("Published %d outbox events", sent)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish outbox events: %w", err)
+		}
+		if sent < outboxBatchSize {
+			return nil
+		}
+	}
+}
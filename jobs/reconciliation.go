@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/riverqueue/river"
+)
+
+type ReconcileArgs struct {
+	AutoFreeze bool `json:"auto_freeze"`
+}
+
+func (ReconcileArgs) Kind() string {
+	return "reconcile"
+}
+
+// ReconcileWorker checks every wallet balance against its transactions and
+// records the result as a reconciliation run. It runs as a periodic job.
+type ReconcileWorker struct {
+	river.WorkerDefaults[ReconcileArgs]
+	DB *postgres.PostgresDB
+}
+
+func (w *ReconcileWorker) Work(ctx context.Context, job *river.Job[ReconcileArgs]) error {
+	run, err := model.Reconcile(ctx, w.DB, model.ReconcileSourceJob, job.Args.AutoFreeze)
+	if err != nil {
+		return fmt.Errorf("failed to reconcile wallets: %w", err)
+	}
+	if run.Mismatches > 0 {
+		log.Printf("Reconciliation run %d found %d of %d wallets out of balance", run.ID, run.Mismatches, run.WalletsChecked)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/riverqueue/river"
+)
+
+const scheduleBatchSize = 100
+
+type RunSchedulesArgs struct{}
+
+func (RunSchedulesArgs) Kind() string {
+	return "run_schedules"
+}
+
+// RunSchedulesWorker posts the occurrences of standing orders that are due,
+// including retries of earlier ones. It runs as a periodic job.
+type RunSchedulesWorker struct {
+	river.WorkerDefaults[RunSchedulesArgs]
+	DB *postgres.PostgresDB
+}
+
+func (w *RunSchedulesWorker) Work(ctx context.Context, job *river.Job[RunSchedulesArgs]) error {
+	executed, err := model.RunDueSchedules(ctx, w.DB, time.Now().UTC(), scheduleBatchSize)
+	if executed > 0 {
+		log.Printf("Executed %d scheduled transactions", executed)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run schedules: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/riverqueue/river"
+)
+
+type PurgeExpiredTokensArgs struct{}
+
+func (PurgeExpiredTokensArgs) Kind() string {
+	return "purge_expired_tokens"
+}
+
+// PurgeExpiredTokensWorker removes refresh tokens, revoked access tokens,
+// email tokens and idempotency keys that have expired. It runs as a periodic
+// job.
+type PurgeExpiredTokensWorker struct {
+	river.WorkerDefaults[PurgeExpiredTokensArgs]
+	DB *postgres.PostgresDB
+}
+
+func (w *PurgeExpiredTokensWorker) Work(ctx context.Context, job *river.Job[PurgeExpiredTokensArgs]) error {
+	purged, err := model.PurgeExpiredTokens(ctx, w.DB)
+	if err != nil {
+		return fmt.Errorf("failed to purge expired tokens: %w", err)
+	}
+	if purged > 0 {
+		log.Printf("Purged %d expired tokens", purged)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,10 +13,13 @@ import (
 
 	"github.com/joho/godotenv"
 	"github.com/lupppig/stream-ledger-api/jobs"
+	"github.com/lupppig/stream-ledger-api/model"
 	"github.com/lupppig/stream-ledger-api/model/migrations"
 	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/mailer"
 	"github.com/lupppig/stream-ledger-api/repository/postgres"
 	"github.com/lupppig/stream-ledger-api/router"
+	"github.com/lupppig/stream-ledger-api/utils"
 	"github.com/riverqueue/river"
 	"github.com/riverqueue/river/riverdriver/riverdatabasesql"
 	"github.com/riverqueue/river/rivermigrate"
@@ -25,6 +29,17 @@ func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Printf("failed to load env variables: %v", err)
 	}
+	keys, err := utils.KeySetFromEnv()
+	if err != nil {
+		log.Fatalf("failed to load token signing keys: %v", err)
+	}
+	utils.UseKeySet(keys)
+	checkpointKeys, err := utils.CheckpointKeySetFromEnv()
+	if err != nil {
+		log.Fatalf("failed to load checkpoint signing keys: %v", err)
+	}
+	utils.UseCheckpointKeySet(checkpointKeys)
+
 	connString := os.Getenv("DB_URL")
 	portStr := os.Getenv("PORT")
 	if portStr == "" {
@@ -35,12 +50,21 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to connect to database: %v", err)
 	}
-	if err := setupRiver(db); err != nil {
-		log.Printf("error setting up river: %v", err)
-	}
-	// run database migrations
-	if err := migrations.RunMigrations(db.DB); err != nil {
-		log.Printf("failed to perform migrations: %v", err)
+	// `reconcile [-freeze]` and `verify-chain [-wallet id]` run once and exit
+	if len(os.Args) > 1 {
+		commands := map[string]func(*postgres.PostgresDB, []string) int{
+			"reconcile":    reconcile,
+			"verify-chain": verifyChain,
+		}
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown command %q, expected reconcile or verify-chain", os.Args[1])
+		}
+		// run database migrations
+		if err := migrations.RunMigrations(db.DB); err != nil {
+			log.Fatalf("failed to perform migrations: %v", err)
+		}
+		os.Exit(command(db, os.Args[2:]))
 	}
 	// kafka setup
 	brokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
@@ -49,9 +73,16 @@ func main() {
 	if err != nil {
 		log.Printf("failed to connect to kafka: %v", err)
 	}
-	subr := router.Router(db, prod)
+	if err := setupRiver(db, prod); err != nil {
+		log.Printf("error setting up river: %v", err)
+	}
+	// run database migrations
+	if err := migrations.RunMigrations(db.DB); err != nil {
+		log.Printf("failed to perform migrations: %v", err)
+	}
+	handler := router.Router(db, prod, mailer.FromEnv())
 	srv := &http.Server{
-		Handler:      subr,
+		Handler:      handler,
 		Addr:         fmt.Sprintf(":%d", port),
 		WriteTimeout: 30 * time.Second,
 		ReadTimeout:  30 * time.Second,
@@ -61,7 +92,7 @@ func main() {
 	log.Fatal(srv.ListenAndServe())
 }
 
-func setupRiver(db *postgres.PostgresDB) error {
+func setupRiver(db *postgres.PostgresDB, prod *kafka.Producer) error {
 
 	migrator, err := rivermigrate.New(riverdatabasesql.New(db.DB.DB), nil)
 
@@ -76,10 +107,75 @@ func setupRiver(db *postgres.PostgresDB) error {
 	river.AddWorker(workers, &jobs.ExportTransactionsWorker{
 		DB: db,
 	})
+	river.AddWorker(workers, &jobs.PublishOutboxWorker{
+		DB:   db,
+		Prod: prod,
+	})
+	river.AddWorker(workers, &jobs.ExpireHoldsWorker{
+		DB: db,
+	})
+	river.AddWorker(workers, &jobs.PurgeExpiredTokensWorker{
+		DB: db,
+	})
+	river.AddWorker(workers, &jobs.RunSchedulesWorker{
+		DB: db,
+	})
+	river.AddWorker(workers, &jobs.ReconcileWorker{
+		DB: db,
+	})
+	river.AddWorker(workers, &jobs.LedgerCheckpointWorker{
+		DB: db,
+	})
+
+	periodicJobs := []*river.PeriodicJob{
+		river.NewPeriodicJob(
+			river.PeriodicInterval(5*time.Second),
+			func() (river.JobArgs, *river.InsertOpts) {
+				return jobs.PublishOutboxArgs{}, nil
+			},
+			&river.PeriodicJobOpts{RunOnStart: true},
+		),
+		river.NewPeriodicJob(
+			river.PeriodicInterval(time.Minute),
+			func() (river.JobArgs, *river.InsertOpts) {
+				return jobs.ExpireHoldsArgs{}, nil
+			},
+			&river.PeriodicJobOpts{RunOnStart: true},
+		),
+		river.NewPeriodicJob(
+			river.PeriodicInterval(time.Hour),
+			func() (river.JobArgs, *river.InsertOpts) {
+				return jobs.PurgeExpiredTokensArgs{}, nil
+			},
+			&river.PeriodicJobOpts{RunOnStart: true},
+		),
+		river.NewPeriodicJob(
+			river.PeriodicInterval(time.Minute),
+			func() (river.JobArgs, *river.InsertOpts) {
+				return jobs.RunSchedulesArgs{}, nil
+			},
+			&river.PeriodicJobOpts{RunOnStart: true},
+		),
+		river.NewPeriodicJob(
+			river.PeriodicInterval(time.Hour),
+			func() (river.JobArgs, *river.InsertOpts) {
+				return jobs.ReconcileArgs{AutoFreeze: os.Getenv("RECONCILE_AUTO_FREEZE") == "true"}, nil
+			},
+			&river.PeriodicJobOpts{RunOnStart: true},
+		),
+		river.NewPeriodicJob(
+			river.PeriodicInterval(time.Hour),
+			func() (river.JobArgs, *river.InsertOpts) {
+				return jobs.LedgerCheckpointArgs{}, nil
+			},
+			&river.PeriodicJobOpts{RunOnStart: true},
+		),
+	}
 
 	riverClient, err := river.NewClient(riverdatabasesql.New(db.DB.DB), &river.Config{
-		JobTimeout: 10 * time.Minute,
-		Workers:    workers,
+		JobTimeout:   10 * time.Minute,
+		Workers:      workers,
+		PeriodicJobs: periodicJobs,
 		Queues: map[string]river.QueueConfig{
 			river.QueueDefault: {MaxWorkers: 10},
 		},
@@ -97,3 +193,69 @@ func setupRiver(db *postgres.PostgresDB) error {
 
 	return nil
 }
+
+// reconcile checks every wallet balance once and prints the wallets that
+// drifted. It exits with 1 when any did, so it can gate scripts. Events for
+// mismatches wait in the outbox until the server relays them.
+func reconcile(db *postgres.PostgresDB, args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	freeze := flags.Bool("freeze", os.Getenv("RECONCILE_AUTO_FREEZE") == "true", "freeze wallets that are out of balance")
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	run, err := model.Reconcile(ctx, db, model.ReconcileSourceCLI, *freeze)
+	if err != nil {
+		log.Printf("failed to reconcile wallets: %v", err)
+		return 2
+	}
+
+	fmt.Printf("run %d: %d wallets checked, %d out of balance\n", run.ID, run.WalletsChecked, run.Mismatches)
+	for _, d := range run.Drifts {
+		fmt.Printf("wallet %d (%s, user %d): balance %d, transactions sum to %d, drift %d, frozen %t\n",
+			d.WalletID, d.Currency, d.UserID, d.Balance, d.Expected, d.Drift, d.Frozen)
+	}
+	if run.Mismatches > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifyChain walks the hash chain of one wallet, or of every wallet, and
+// prints the first broken link of each. It exits with 1 when any is broken.
+func verifyChain(db *postgres.PostgresDB, args []string) int {
+	flags := flag.NewFlagSet("verify-chain", flag.ExitOnError)
+	walletId := flags.Int64("wallet", 0, "the wallet to verify, every wallet when 0")
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	walletIds := []int64{*walletId}
+	if *walletId == 0 {
+		walletIds = nil
+		if err := db.DB.NewSelect().Model((*model.Wallet)(nil)).Column("id").Order("id ASC").Scan(ctx, &walletIds); err != nil {
+			log.Printf("failed to list wallets: %v", err)
+			return 2
+		}
+	}
+
+	broken := 0
+	for _, id := range walletIds {
+		result, err := model.VerifyChain(ctx, db, id)
+		if err != nil {
+			log.Printf("failed to verify wallet %d: %v", id, err)
+			return 2
+		}
+		if !result.Valid {
+			broken++
+			b := result.Break
+			fmt.Printf("wallet %d: broken at transaction %d after %d good links: %s (expected %q, found %q)\n",
+				id, b.TransactionID, result.Checked, b.Reason, b.Expected, b.Actual)
+		}
+	}
+	fmt.Printf("%d wallets verified, %d broken\n", len(walletIds), broken)
+	if broken > 0 {
+		return 1
+	}
+	return 0
+}
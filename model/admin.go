@@ -0,0 +1,290 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/uptrace/bun"
+)
+
+var ErrorUserNotFound = errors.New("user not found")
+var ErrorUnknownRole = errors.New("unknown role")
+var ErrorOwnRole = errors.New("cannot change your own role")
+var ErrorWalletStatusUnchanged = errors.New("wallet already has this status")
+var ErrorUnknownWalletStatus = errors.New("unknown wallet status")
+var ErrorWalletNotEmpty = errors.New("wallet still holds funds or open holds")
+
+var roles = map[string]bool{
+	RoleUser:    true,
+	RoleSupport: true,
+	RoleAdmin:   true,
+	RoleAuditor: true,
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return roles[role]
+}
+
+// SearchUsers returns a page of users, oldest first, and the number of
+// matches. A non empty search matches part of the email or name, or the
+// user id; role only keeps users with that role.
+func SearchUsers(db *postgres.PostgresDB, search, role string, pagination utils.Pagination) ([]*User, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	users := []*User{}
+	query := db.DB.NewSelect().Model(&users)
+	if search = strings.TrimSpace(search); search != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search) + "%"
+		query = query.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			q = q.Where(`"user".email ILIKE ?`, pattern).
+				WhereOr(`"user".first_name || ' ' || "user".last_name ILIKE ?`, pattern)
+			if id, err := strconv.ParseInt(search, 10, 64); err == nil {
+				q = q.WhereOr(`"user".id = ?`, id)
+			}
+			return q
+		})
+	}
+	if role != "" {
+		query = query.Where(`"user".role = ?`, role)
+	}
+
+	total, err := query.
+		OrderExpr(`"user".id ASC`).
+		Limit(pagination.Limit).
+		Offset(pagination.Offset).
+		ScanAndCount(ctx)
+	return users, total, err
+}
+
+// GetAnyWallet loads a wallet by id together with its owner.
+func GetAnyWallet(db *postgres.PostgresDB, walletId int64) (*Wallet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	wallet := new(Wallet)
+	err := db.DB.NewSelect().
+		Model(wallet).
+		Relation("User").
+		Where("wallet.id = ?", walletId).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrorWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// ListWalletTransactions returns a page of the transactions of a wallet,
+// newest first, and the number of transactions on it.
+func ListWalletTransactions(db *postgres.PostgresDB, walletId int64, pagination utils.Pagination) ([]*Transaction, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transactions := []*Transaction{}
+	total, err := db.DB.NewSelect().
+		Model(&transactions).
+		Where("transaction.wallet_id = ?", walletId).
+		Order("transaction.created_at DESC", "transaction.id DESC").
+		Limit(pagination.Limit).
+		Offset(pagination.Offset).
+		ScanAndCount(ctx)
+	return transactions, total, err
+}
+
+// statusActions maps each wallet status to the audit action that sets it.
+var statusActions = map[string]string{
+	WalletStatusActive:       AuditWalletUnfreeze,
+	WalletStatusFrozen:       AuditWalletFreeze,
+	WalletStatusDebitBlocked: AuditWalletBlock,
+	WalletStatusClosed:       AuditWalletClose,
+}
+
+// SetWalletStatus moves a wallet to status. The change takes the wallet lock,
+// so it waits for postings in flight and every later one sees it, and is
+// published to Kafka through the outbox. Closed wallets stay closed and can
+// only be closed with nothing left in them.
+func SetWalletStatus(db *postgres.PostgresDB, actor Actor, walletId int64, status, reason string) (*Wallet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	action, ok := statusActions[status]
+	if !ok {
+		return nil, ErrorUnknownWalletStatus
+	}
+
+	var wallet *Wallet
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var err error
+		wallet, err = lockWallet(ctx, tx, walletId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if wallet.Status == WalletStatusClosed {
+			return ErrorWalletClosed
+		}
+		if wallet.Status == status {
+			return ErrorWalletStatusUnchanged
+		}
+		if status == WalletStatusClosed && (wallet.Balance != 0 || wallet.Held != 0) {
+			return ErrorWalletNotEmpty
+		}
+
+		previous := wallet.Status
+		_, err = tx.NewUpdate().
+			Model(wallet).
+			Set("status = ?", status).
+			Set("updated_at = CURRENT_TIMESTAMP").
+			WherePK().
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		// keyed by user like the transaction events, so consumers see the
+		// status change in order with the user's postings
+		event := kafka.WalletStatusEvent{
+			EventID:        uuid.New().String(),
+			UserID:         wallet.UserID,
+			WalletID:       wallet.ID,
+			Currency:       wallet.Currency,
+			Status:         status,
+			PreviousStatus: previous,
+			Reason:         reason,
+			Timestamp:      time.Now().UTC(),
+		}
+		if err := enqueueEvent(ctx, tx, event.EventID, EventTypeWalletStatus, strconv.FormatInt(wallet.UserID, 10), event); err != nil {
+			return err
+		}
+		return actor.audit(ctx, tx, action, "wallet", wallet.ID, map[string]any{
+			"from":   previous,
+			"to":     status,
+			"reason": reason,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// Adjustment is a manual correction of a wallet balance made by an admin. It
+// is booked against the adjustments system account and, unlike other
+// postings, also goes through on a frozen or debit blocked wallet. Closed
+// wallets take no adjustments either.
+type Adjustment struct {
+	WalletID    int64        `json:"wallet_id"`
+	Entry       string       `json:"entry"`  // credit or debit
+	Amount      int64        `json:"amount"` // in minor units of the wallet currency
+	Reason      string       `json:"reason"`
+	Reference   string       `json:"reference"`
+	Transaction *Transaction `json:"transaction"`
+}
+
+func (a *Adjustment) Apply(db *postgres.PostgresDB, actor Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		exists, err := tx.NewSelect().
+			Model((*Transaction)(nil)).
+			Where("trans_id = ?", "adjustment:"+a.Reference).
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrorDuplicateTransaction
+		}
+
+		wallet, err := lockWallet(ctx, tx, a.WalletID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if wallet.Status == WalletStatusClosed {
+			return ErrorWalletClosed
+		}
+		if a.Entry == "debit" && wallet.Available() < a.Amount {
+			return ErrorInsuffcientBalance
+		}
+
+		a.Transaction = &Transaction{Entry: a.Entry, Amount: a.Amount, TransID: "adjustment:" + a.Reference}
+		entry := newJournalEntry("adjustment:"+a.Reference, "manual adjustment: "+a.Reason)
+		entry.manual = true
+		entry.walletLeg(a.Transaction, wallet)
+		entry.systemLeg(AccountAdjustments, -a.Transaction.signedAmount())
+		if err := entry.post(ctx, tx); err != nil {
+			return err
+		}
+
+		if err := a.Transaction.enqueueEvent(ctx, tx, wallet.UserID); err != nil {
+			return err
+		}
+		return actor.audit(ctx, tx, AuditWalletAdjust, "wallet", wallet.ID, map[string]any{
+			"entry":          a.Entry,
+			"amount":         a.Amount,
+			"currency":       wallet.Currency,
+			"reason":         a.Reason,
+			"reference":      a.Reference,
+			"transaction_id": a.Transaction.ID,
+		})
+	})
+}
+
+// SetUserRole gives the user role. It applies to access tokens issued from
+// then on; tokens already out keep the old role until they expire.
+func SetUserRole(db *postgres.PostgresDB, actor Actor, userId int64, role string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if !ValidRole(role) {
+		return nil, ErrorUnknownRole
+	}
+	// keeps the last admin from locking everyone out of the admin API
+	if userId == actor.UserID {
+		return nil, ErrorOwnRole
+	}
+
+	user := new(User)
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().Model(user).Where("id = ?", userId).For("UPDATE").Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		previous := user.Role
+		user.Role = role
+		if _, err := tx.NewUpdate().Model(user).Column("role").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+		return actor.audit(ctx, tx, AuditUserRole, "user", user.ID, map[string]any{
+			"from": previous,
+			"to":   role,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
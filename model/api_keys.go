@@ -0,0 +1,178 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+var ErrorInvalidAPIKey = errors.New("invalid, expired or revoked api key")
+var ErrorAPIKeyNotFound = errors.New("api key not found")
+var ErrorUnknownScope = errors.New("unknown api key scope")
+
+// APIKeyPrefix starts every API key so it can be told apart from a JWT.
+const APIKeyPrefix = "sl_"
+
+// Scopes an API key can be granted. Each authenticated route requires one
+// of them from API keys; signed in users have all of them.
+const (
+	ScopeWalletRead        = "wallet:read"
+	ScopeWalletWrite       = "wallet:write"
+	ScopeTransactionsRead  = "transactions:read"
+	ScopeTransactionsWrite = "transactions:write"
+	ScopeTransfersWrite    = "transfers:write"
+	ScopeHoldsWrite        = "holds:write"
+	ScopeConversionsWrite  = "conversions:write"
+	ScopeExportsCreate     = "exports:create"
+	ScopeExportsRead       = "exports:read"
+	ScopeSchedulesRead     = "schedules:read"
+	ScopeSchedulesWrite    = "schedules:write"
+)
+
+var apiKeyScopes = map[string]bool{
+	ScopeWalletRead:        true,
+	ScopeWalletWrite:       true,
+	ScopeTransactionsRead:  true,
+	ScopeTransactionsWrite: true,
+	ScopeTransfersWrite:    true,
+	ScopeHoldsWrite:        true,
+	ScopeConversionsWrite:  true,
+	ScopeExportsCreate:     true,
+	ScopeExportsRead:       true,
+	ScopeSchedulesRead:     true,
+	ScopeSchedulesWrite:    true,
+}
+
+// APIKey lets a server act for its user without signing in. The key is
+// sl_<prefix>_<secret>; the prefix finds the row and only a hash of the
+// secret is stored.
+type APIKey struct {
+	ID         int64     `bun:",pk,autoincrement" json:"id"`
+	UserID     int64     `bun:",notnull" json:"-"`
+	Name       string    `bun:",notnull" json:"name"`
+	Prefix     string    `bun:",unique,notnull" json:"prefix"`
+	SecretHash string    `bun:",notnull" json:"-"`
+	Scopes     []string  `bun:",array,notnull" json:"scopes"`
+	ExpiresAt  time.Time `bun:",nullzero" json:"expires_at,omitzero"`
+	LastUsedAt time.Time `bun:",nullzero" json:"last_used_at,omitzero"`
+	RevokedAt  time.Time `bun:",nullzero" json:"revoked_at,omitzero"`
+	CreatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+
+	Key string `bun:"-" json:"key,omitempty"` // only set right after creating
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey stores k for userId and sets k.Key, which is not shown again.
+func (k *APIKey) CreateAPIKey(db *postgres.PostgresDB, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if len(k.Scopes) == 0 {
+		return ErrorUnknownScope
+	}
+	for _, s := range k.Scopes {
+		if !apiKeyScopes[s] {
+			return ErrorUnknownScope
+		}
+	}
+
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	secret, hash, err := utils.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+	k.UserID = userId
+	k.Prefix = strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	k.SecretHash = hash
+	k.Key = APIKeyPrefix + k.Prefix + "_" + secret
+
+	_, err = db.DB.NewInsert().Model(k).Returning("*").Exec(ctx)
+	return err
+}
+
+// ListAPIKeys returns the user's keys, newest first, revoked ones included.
+func ListAPIKeys(db *postgres.PostgresDB, userId int64) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	keys := []*APIKey{}
+	err := db.DB.NewSelect().
+		Model(&keys).
+		Where("user_id = ?", userId).
+		Order("id DESC").
+		Scan(ctx)
+	return keys, err
+}
+
+// RevokeAPIKey stops the user's key with id from working.
+func RevokeAPIKey(db *postgres.PostgresDB, userId, id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := db.DB.NewUpdate().
+		Model((*APIKey)(nil)).
+		Set("revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP)").
+		Where("id = ? AND user_id = ?", id, userId).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrorAPIKeyNotFound
+	}
+	return nil
+}
+
+// AuthenticateAPIKey returns the active key matching key.
+func AuthenticateAPIKey(ctx context.Context, db *postgres.PostgresDB, key string) (*APIKey, error) {
+	prefix, secret, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, ErrorInvalidAPIKey
+	}
+
+	k := new(APIKey)
+	err := db.DB.NewSelect().Model(k).Where("prefix = ?", prefix).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrorInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(secret)), []byte(k.SecretHash)) != 1 {
+		return nil, ErrorInvalidAPIKey
+	}
+	if !k.RevokedAt.IsZero() || (!k.ExpiresAt.IsZero() && !k.ExpiresAt.After(time.Now())) {
+		return nil, ErrorInvalidAPIKey
+	}
+
+	// last_used_at only needs to be roughly right, so it is written at
+	// most once a minute per key
+	if time.Since(k.LastUsedAt) > time.Minute {
+		_, err = db.DB.NewUpdate().
+			Model(k).
+			Set("last_used_at = CURRENT_TIMESTAMP").
+			WherePK().
+			Exec(ctx)
+	}
+	return k, err
+}
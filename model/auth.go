@@ -2,6 +2,7 @@ package model
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"time"
@@ -13,29 +14,96 @@ import (
 	"github.com/uptrace/bun"
 )
 
+var ErrorWalletNotFound = errors.New("wallet not found")
+var ErrorWalletExists = errors.New("wallet already exists for this currency")
+var ErrorWalletFrozen = errors.New("wallet is frozen")
+var ErrorWalletDebitBlocked = errors.New("wallet is blocked for debits")
+var ErrorWalletClosed = errors.New("wallet is closed")
+
+// Roles a user can have. Everyone signs up as RoleUser; the other roles open
+// parts of the admin API.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support" // looks up users and wallets, freezes wallets
+	RoleAdmin   = "admin"   // everything support can do, plus adjustments and roles
+	RoleAuditor = "auditor" // read only access to users, wallets and the audit log
+)
+
+// Wallet statuses. A frozen wallet takes no postings at all until it is
+// made active again, a debit blocked one still takes credits. Closing is
+// final and only allowed once nothing is left in the wallet.
+const (
+	WalletStatusActive       = "active"
+	WalletStatusFrozen       = "frozen"
+	WalletStatusDebitBlocked = "debit_blocked"
+	WalletStatusClosed       = "closed"
+)
+
 type User struct {
-	bun.BaseModel `bun:"table:users"`
-	ID            int64     `bun:",pk,autoincrement" json:"user_id"`
-	FirstName     string    `json:"first_name"`
-	LastName      string    `json:"last_name"`
-	Email         string    `bun:",unique" json:"email"`
-	Password      string    `json:"-"`
-	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
-	Wallet        *Wallet   `bun:"rel:has-one,join:id=user_id" json:"wallet"`
+	bun.BaseModel   `bun:"table:users"`
+	ID              int64      `bun:",pk,autoincrement" json:"user_id"`
+	FirstName       string     `json:"first_name"`
+	LastName        string     `json:"last_name"`
+	Email           string     `bun:",unique" json:"email"`
+	Password        string     `json:"-"`
+	CreatedAt       time.Time  `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	EmailVerifiedAt *time.Time `bun:",nullzero" json:"email_verified_at"` // nil until the email address is verified
+	TOTPSecret      string     `bun:"totp_secret,nullzero" json:"-"`      // set on enrollment, used once confirmed
+	TOTPEnabledAt   *time.Time `bun:"totp_enabled_at,nullzero" json:"totp_enabled_at"`
+	TOTPLastCounter int64      `bun:"totp_last_counter,notnull,default:0" json:"-"` // last accepted time step, rejects replays
+	TOTPFailures    int        `bun:"totp_failures,notnull,default:0" json:"-"`     // wrong codes in a row, see MaxTOTPFailures
+	TOTPLockedUntil *time.Time `bun:"totp_locked_until,nullzero" json:"-"`
+	Role            string     `bun:",notnull,default:'user'" json:"role"`
+	Tier            string     `bun:",notnull,default:'standard'" json:"tier"` // picks the transaction limits that apply
+	Wallets         []*Wallet  `bun:"rel:has-many,join:id=user_id" json:"wallets"`
 }
 
 type Wallet struct {
 	ID        int64     `bun:",pk,autoincrement" json:"wallet_id"`
-	UserID    int64     `bun:",unique,notnull" json:"-"`          // each wallet belongs to a single user
-	Balance   int64     `bun:",notnull,default:0" json:"balance"` // balance in kobo
-	Currency  string    `bun:",notnull,default:'NGN'" json:"currency"`
+	UserID    int64     `bun:",notnull,unique:wallets_user_currency" json:"-"`                      // a user has at most one wallet per currency
+	Balance   int64     `bun:",notnull,default:0" json:"balance"`                                   // in minor units, cached sum of the wallet account postings
+	Held      int64     `bun:",notnull,default:0" json:"held"`                                      // reserved by open holds, in minor units
+	Currency  string    `bun:",notnull,default:'NGN',unique:wallets_user_currency" json:"currency"` // ISO 4217 code
+	Status    string    `bun:",notnull,default:'active'" json:"status"`                             // active, frozen, debit_blocked or closed
 	CreatedAt time.Time `bun:",notnull,default:current_timestamp" json:"created_at"`
 	UpdatedAt time.Time `bun:",notnull,default:current_timestamp" json:"updated_at"`
 
+	// AvailableBalance is the balance that is not reserved by holds. It is
+	// computed after every scan and never stored.
+	AvailableBalance int64 `bun:"-" json:"available_balance"`
+
 	User         *User          `bun:"rel:belongs-to,join:user_id=id" json:"user,omitempty"`
 	Transactions []*Transaction `bun:"rel:has-many" json:"-"`
 }
 
+var _ bun.AfterScanRowHook = (*Wallet)(nil)
+
+func (w *Wallet) AfterScanRow(ctx context.Context) error {
+	w.AvailableBalance = w.Available()
+	return nil
+}
+
+// Available is the part of the balance that can still be debited.
+func (w *Wallet) Available() int64 {
+	return w.Balance - w.Held
+}
+
+// allows reports whether entry may be posted to the wallet in its current
+// status. The wallet has to be locked for the answer to hold.
+func (w *Wallet) allows(entry string) error {
+	switch w.Status {
+	case WalletStatusFrozen:
+		return ErrorWalletFrozen
+	case WalletStatusClosed:
+		return ErrorWalletClosed
+	case WalletStatusDebitBlocked:
+		if entry == "debit" {
+			return ErrorWalletDebitBlocked
+		}
+	}
+	return nil
+}
+
 func (u *User) CreateUser(db *postgres.PostgresDB) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -50,14 +118,7 @@ func (u *User) CreateUser(db *postgres.PostgresDB) error {
 			}
 			return err
 		}
-		wallet := &Wallet{
-			UserID:  u.ID,
-			Balance: 0,
-		}
-		if _, err := tx.NewInsert().Model(wallet).Exec(ctx); err != nil {
-			return err
-		}
-		return nil
+		return createWallet(ctx, tx, &Wallet{UserID: u.ID, Currency: DefaultCurrency})
 	})
 
 	if err != nil {
@@ -78,19 +139,72 @@ func (u *User) GetUser(db *postgres.PostgresDB, email string, password string) e
 	return nil
 }
 
-func (u *User) GetWallet(db *postgres.PostgresDB, id int64) error {
-	query := `"user".id = ?`
-	if err := db.SelectOneWithRelation(query, "Wallet", u, id); err != nil {
+// GetWallets loads the user together with all of their wallets.
+func (u *User) GetWallets(db *postgres.PostgresDB, id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return db.DB.NewSelect().
+		Model(u).
+		Relation("Wallets", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Order("wallet.id ASC")
+		}).
+		Where(`"user".id = ?`, id).
+		Scan(ctx)
+}
+
+// GetUserWallet loads the user's wallet in currency.
+func GetUserWallet(db *postgres.PostgresDB, userId int64, currency string) (*Wallet, error) {
+	wallet := new(Wallet)
+	if err := db.SelectSingleEntity("user_id = ? AND currency = ?", wallet, userId, currency); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrorWalletNotFound
+		}
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// CreateWallet opens a wallet in w.Currency for w.UserID.
+func (w *Wallet) CreateWallet(db *postgres.PostgresDB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		return createWallet(ctx, tx, w)
+	})
+}
+
+// createWallet inserts the wallet and its ledger account.
+func createWallet(ctx context.Context, tx bun.Tx, w *Wallet) error {
+	if _, err := tx.NewInsert().Model(w).Returning("*").Exec(ctx); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return ErrorWalletExists
+		}
 		return err
 	}
-	return nil
+	w.AvailableBalance = w.Available()
+	_, err := tx.NewInsert().Model(walletAccount(w.ID)).Exec(ctx)
+	return err
 }
 
-func (w *Wallet) getWallet(tx bun.Tx, userId int64) error {
-	query := "user_id = ?"
+func (w *Wallet) getWallet(tx bun.Tx, userId int64, currency string) error {
+	query := "user_id = ? AND currency = ?"
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	return tx.NewSelect().Model(w).Where(query, userId).Scan(ctx)
+	err := tx.NewSelect().Model(w).Where(query, userId, currency).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrorWalletNotFound
+	}
+	return err
+}
+
+// GetUserByEmail returns sql.ErrNoRows when no user has email.
+func GetUserByEmail(db *postgres.PostgresDB, email string) (*User, error) {
+	user := &User{}
+	if err := db.SelectSingleEntity("email = ?", user, email); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
 func GetUser(db *postgres.PostgresDB, id int64) (*User, error) {
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorInvalidInterval = errors.New("interval must be hour, day, week or month")
+var ErrorTooManyPeriods = errors.New("the range holds too many intervals")
+
+// MaxBalancePeriods bounds the length of a balance history.
+const MaxBalancePeriods = 1000
+
+// BalanceAt is the balance of a wallet at a moment, as left by the last
+// transaction applied before it.
+type BalanceAt struct {
+	WalletID      int64     `json:"wallet_id"`
+	Currency      string    `json:"currency"`
+	At            time.Time `json:"at"`
+	Balance       int64     `json:"balance"`
+	TransactionID int64     `json:"transaction_id,omitempty"` // the last transaction before At, if any
+}
+
+// BalancePeriod is one point of a balance history: the balances at the
+// start and the end of the period.
+type BalancePeriod struct {
+	PeriodStart    time.Time `json:"period_start"`
+	PeriodEnd      time.Time `json:"period_end"`
+	OpeningBalance int64     `json:"opening_balance"`
+	ClosingBalance int64     `json:"closing_balance"`
+}
+
+// GetBalanceAt reads the balance of wallet at at from the balance_after of
+// its transactions, so no history has to be replayed. Like the period
+// balances of a statement, at is exclusive.
+//
+// Transactions are taken in id order, the order the wallet lock applied them
+// and balance_after follows, and not by created_at. That is stamped by the
+// server making the posting, and on older rows at the start of their
+// database transaction, so it need not follow the order.
+func GetBalanceAt(db *postgres.PostgresDB, wallet *Wallet, at time.Time) (*BalanceAt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	balance := &BalanceAt{WalletID: wallet.ID, Currency: wallet.Currency, At: at}
+	var last []Transaction
+	err := db.DB.NewSelect().
+		Model(&last).
+		Column("id", "balance_after").
+		Where("wallet_id = ? AND created_at < ?", wallet.ID, at).
+		Order("id DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(last) == 1 {
+		balance.TransactionID = last[0].ID
+		balance.Balance = last[0].BalanceAfter
+	}
+	return balance, nil
+}
+
+// GetBalanceHistory splits from to to into periods of interval, the last one
+// cut short at to, and returns the opening and closing balance of each.
+func GetBalanceHistory(db *postgres.PostgresDB, walletID int64, from, to time.Time, interval string) ([]BalancePeriod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	step := map[string]func(time.Time) time.Time{
+		"hour":  func(t time.Time) time.Time { return t.Add(time.Hour) },
+		"day":   func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+		"week":  func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+		"month": func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+	}[interval]
+	if step == nil {
+		return nil, ErrorInvalidInterval
+	}
+
+	bounds := []time.Time{from.UTC()}
+	for t := from.UTC(); t.Before(to); {
+		t = step(t)
+		if t.After(to) {
+			t = to.UTC()
+		}
+		bounds = append(bounds, t)
+		if len(bounds) > MaxBalancePeriods+1 {
+			return nil, fmt.Errorf("%w, at most %d are allowed", ErrorTooManyPeriods, MaxBalancePeriods)
+		}
+	}
+
+	// the last transaction before each bound, in id order like GetBalanceAt
+	var balances []struct {
+		Bound   time.Time
+		Balance int64
+	}
+	err := db.DB.NewRaw(`
+		SELECT b.bound, COALESCE(t.balance_after, 0) AS balance
+		FROM unnest(ARRAY[?]::timestamptz[]) AS b(bound)
+		LEFT JOIN LATERAL (
+			SELECT balance_after FROM transactions
+			WHERE wallet_id = ? AND created_at < b.bound
+			ORDER BY id DESC
+			LIMIT 1
+		) AS t ON true
+		ORDER BY b.bound`,
+		bun.In(bounds), walletID).Scan(ctx, &balances)
+	if err != nil {
+		return nil, err
+	}
+
+	periods := make([]BalancePeriod, 0, len(balances))
+	for i := 1; i < len(balances); i++ {
+		periods = append(periods, BalancePeriod{
+			PeriodStart:    balances[i-1].Bound.UTC(),
+			PeriodEnd:      balances[i].Bound.UTC(),
+			OpeningBalance: balances[i-1].Balance,
+			ClosingBalance: balances[i].Balance,
+		})
+	}
+	return periods, nil
+}
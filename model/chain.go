@@ -0,0 +1,297 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/uptrace/bun"
+)
+
+var ErrorCheckpointExists = errors.New("a checkpoint for this day already exists")
+
+const chainBatchSize = 1000
+
+// ComputeHash returns the SHA-256, hex encoded, of the canonical content of
+// t: every column a ledger reader relies on plus PrevHash, so editing a row
+// breaks its own hash and removing or inserting one breaks the link of the
+// next. The id is left out as it is only known after the insert.
+func (t *Transaction) ComputeHash() string {
+	// encoding/json writes struct fields in order, which keeps this stable
+	content, _ := json.Marshal(struct {
+		WalletID       int64  `json:"wallet_id"`
+		Entry          string `json:"entry"`
+		Amount         int64  `json:"amount"`
+		Currency       string `json:"currency"`
+		TransID        string `json:"trans_id"`
+		TransferRef    string `json:"transfer_ref"`
+		JournalEntryID int64  `json:"journal_entry_id"`
+		ReversalOf     int64  `json:"reversal_of"`
+		FeeFor         string `json:"fee_for"`
+		BalanceAfter   int64  `json:"balance_after"`
+		CreatedAt      string `json:"created_at"`
+		PrevHash       string `json:"prev_hash"`
+	}{
+		WalletID:       t.WalletID,
+		Entry:          t.Entry,
+		Amount:         t.Amount,
+		Currency:       t.Currency,
+		TransID:        t.TransID,
+		TransferRef:    t.TransferRef,
+		JournalEntryID: t.JournalEntryID,
+		ReversalOf:     t.ReversalOf,
+		FeeFor:         t.FeeFor,
+		BalanceAfter:   t.BalanceAfter,
+		CreatedAt:      t.CreatedAt.UTC().Format(time.RFC3339Nano),
+		PrevHash:       t.PrevHash,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainHead returns the hash of the last transaction of a wallet, empty for a
+// wallet without any. The caller holds the wallet lock, so no other
+// transaction can be appended in between.
+func chainHead(ctx context.Context, tx bun.Tx, walletId int64) (string, error) {
+	var hash string
+	err := tx.NewSelect().
+		Model((*Transaction)(nil)).
+		Column("hash").
+		Where("wallet_id = ?", walletId).
+		Order("id DESC").
+		Limit(1).
+		Scan(ctx, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return hash, err
+}
+
+// ChainBreak is the first link of a wallet's chain that does not hold.
+type ChainBreak struct {
+	TransactionID int64  `json:"transaction_id"`
+	Reason        string `json:"reason"`
+	Expected      string `json:"expected"`
+	Actual        string `json:"actual"`
+}
+
+// ChainVerification is the result of walking the chain of one wallet.
+type ChainVerification struct {
+	WalletID           int64       `json:"wallet_id"`
+	Checked            int         `json:"checked"` // transactions walked up to the break
+	HeadTransactionID  int64       `json:"head_transaction_id,omitempty"`
+	Head               string      `json:"head,omitempty"`
+	CheckpointsChecked int         `json:"checkpoints_checked"`
+	Valid              bool        `json:"valid"`
+	Break              *ChainBreak `json:"break,omitempty"`
+}
+
+// VerifyChain walks the transactions of a wallet in the order they were
+// appended and recomputes each hash and link. The heads recorded in signed
+// checkpoints are checked too, which catches a chain rewritten from some row
+// onwards with fresh hashes. It stops at the first break.
+func VerifyChain(ctx context.Context, db *postgres.PostgresDB, walletId int64) (*ChainVerification, error) {
+	result := &ChainVerification{WalletID: walletId}
+
+	// head transaction id -> hash and checkpoint day for every checkpoint
+	// naming the wallet
+	var checkpoints []*LedgerCheckpoint
+	filter, _ := json.Marshal([]map[string]int64{{"wallet_id": walletId}})
+	err := db.DB.NewSelect().
+		Model(&checkpoints).
+		Where("heads @> ?::jsonb", string(filter)).
+		Order("day ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type pinned struct{ day, hash string }
+	pins := map[int64]pinned{}
+	for _, cp := range checkpoints {
+		if err := cp.Verify(); err != nil {
+			result.Break = &ChainBreak{Reason: "checkpoint " + cp.Day + " is not authentic: " + err.Error()}
+			return result, nil
+		}
+		for _, head := range cp.Heads {
+			if head.WalletID == walletId {
+				pins[head.TransactionID] = pinned{day: cp.Day, hash: head.Hash}
+			}
+		}
+	}
+
+	var prev *Transaction
+	for {
+		var batch []*Transaction
+		query := db.DB.NewSelect().
+			Model(&batch).
+			Where("wallet_id = ?", walletId).
+			Order("id ASC").
+			Limit(chainBatchSize)
+		if prev != nil {
+			query = query.Where("id > ?", prev.ID)
+		}
+		if err := query.Scan(ctx); err != nil {
+			return nil, err
+		}
+
+		for _, t := range batch {
+			var expectedPrev string
+			var expectedBalance int64
+			if prev != nil {
+				expectedPrev, expectedBalance = prev.Hash, prev.BalanceAfter
+			}
+			switch {
+			case t.PrevHash != expectedPrev:
+				result.Break = &ChainBreak{TransactionID: t.ID, Reason: "prev_hash does not match the previous transaction", Expected: expectedPrev, Actual: t.PrevHash}
+			case t.ComputeHash() != t.Hash:
+				result.Break = &ChainBreak{TransactionID: t.ID, Reason: "content does not match its hash", Expected: t.ComputeHash(), Actual: t.Hash}
+			case t.BalanceAfter != expectedBalance+t.signedAmount():
+				result.Break = &ChainBreak{TransactionID: t.ID, Reason: "balance_after does not follow from the previous transaction",
+					Expected: fmt.Sprint(expectedBalance + t.signedAmount()), Actual: fmt.Sprint(t.BalanceAfter)}
+			}
+			if pin, ok := pins[t.ID]; ok && result.Break == nil {
+				if pin.hash != t.Hash {
+					result.Break = &ChainBreak{TransactionID: t.ID, Reason: "hash differs from checkpoint " + pin.day, Expected: pin.hash, Actual: t.Hash}
+				}
+				result.CheckpointsChecked++
+				delete(pins, t.ID)
+			}
+			if result.Break != nil {
+				return result, nil
+			}
+			result.Checked++
+			prev = t
+		}
+		if len(batch) < chainBatchSize {
+			break
+		}
+	}
+
+	// a head a checkpoint vouched for is gone
+	for id, pin := range pins {
+		result.Break = &ChainBreak{TransactionID: id, Reason: "transaction in checkpoint " + pin.day + " is missing", Expected: pin.hash}
+		return result, nil
+	}
+	if prev != nil {
+		result.HeadTransactionID, result.Head = prev.ID, prev.Hash
+	}
+	result.Valid = true
+	return result, nil
+}
+
+// ChainHead is the last transaction of a wallet at a checkpoint.
+type ChainHead struct {
+	WalletID      int64  `json:"wallet_id"`
+	TransactionID int64  `json:"transaction_id"`
+	Hash          string `json:"hash"`
+}
+
+// LedgerCheckpoint pins the chain head of every wallet at the end of a UTC
+// day. Root is the SHA-256 over the heads and is signed with the checkpoint
+// signing key, so the checkpoint can be checked against the public keys at
+// /.well-known/checkpoint-keys.json without access to the database.
+type LedgerCheckpoint struct {
+	ID        int64       `bun:",pk,autoincrement" json:"id"`
+	Day       string      `bun:",unique,notnull" json:"day"` // YYYY-MM-DD, the heads as of the end of it
+	Heads     []ChainHead `bun:",type:jsonb,notnull" json:"heads"`
+	Root      string      `bun:",notnull" json:"root"`
+	KeyID     string      `bun:",notnull" json:"kid"`
+	Signature string      `bun:",notnull" json:"signature"` // base64url, over SignedContent
+	CreatedAt time.Time   `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+}
+
+// checkpointRoot hashes one "wallet_id:transaction_id:hash" line per head,
+// ordered by wallet.
+func checkpointRoot(heads []ChainHead) string {
+	sorted := append([]ChainHead(nil), heads...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].WalletID < sorted[j].WalletID })
+	var b strings.Builder
+	for _, head := range sorted {
+		fmt.Fprintf(&b, "%d:%d:%s\n", head.WalletID, head.TransactionID, head.Hash)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// SignedContent is the message the signature covers.
+func (c *LedgerCheckpoint) SignedContent() []byte {
+	return []byte("stream-ledger-checkpoint\n" + c.Day + "\n" + c.Root)
+}
+
+// Verify checks the root against the heads and the signature against it.
+func (c *LedgerCheckpoint) Verify() error {
+	if root := checkpointRoot(c.Heads); root != c.Root {
+		return errors.New("root does not match the heads")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(c.Signature)
+	if err != nil {
+		return err
+	}
+	return utils.VerifyCheckpointSignature(c.KeyID, c.SignedContent(), sig)
+}
+
+// CreateCheckpoint records and signs the chain heads as of the end of the UTC
+// day that day falls in. A day is only checkpointed once.
+func CreateCheckpoint(ctx context.Context, db *postgres.PostgresDB, day time.Time) (*LedgerCheckpoint, error) {
+	start := day.UTC().Truncate(24 * time.Hour)
+	cp := &LedgerCheckpoint{Day: start.Format("2006-01-02"), Heads: []ChainHead{}}
+
+	exists, err := db.DB.NewSelect().Model((*LedgerCheckpoint)(nil)).Where("day = ?", cp.Day).Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrorCheckpointExists
+	}
+
+	err = db.DB.NewRaw(`
+		SELECT DISTINCT ON (wallet_id) wallet_id, id AS transaction_id, hash
+		FROM transactions
+		WHERE created_at < ?
+		ORDER BY wallet_id, id DESC`,
+		start.AddDate(0, 0, 1)).Scan(ctx, &cp.Heads)
+	if err != nil {
+		return nil, err
+	}
+	cp.Root = checkpointRoot(cp.Heads)
+	kid, sig, err := utils.SignCheckpoint(cp.SignedContent())
+	if err != nil {
+		return nil, err
+	}
+	cp.KeyID, cp.Signature = kid, base64.RawURLEncoding.EncodeToString(sig)
+
+	res, err := db.DB.NewInsert().Model(cp).On("CONFLICT (day) DO NOTHING").Returning("*").Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return nil, ErrorCheckpointExists
+	}
+	return cp, nil
+}
+
+// ListCheckpoints returns a page of checkpoints, newest day first, and the
+// number of checkpoints.
+func ListCheckpoints(db *postgres.PostgresDB, pagination utils.Pagination) ([]*LedgerCheckpoint, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	checkpoints := []*LedgerCheckpoint{}
+	total, err := db.DB.NewSelect().
+		Model(&checkpoints).
+		Order("day DESC").
+		Limit(pagination.Limit).
+		Offset(pagination.Offset).
+		ScanAndCount(ctx)
+	return checkpoints, total, err
+}
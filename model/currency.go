@@ -0,0 +1,46 @@
+package model
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrorUnsupportedCurrency = errors.New("unsupported currency")
+var ErrorCurrencyMismatch = errors.New("currencies of the postings do not match")
+
+// DefaultCurrency is the currency of the wallet every user gets on signup.
+const DefaultCurrency = "NGN"
+
+// currencyExponents maps the supported ISO 4217 codes to the number of
+// decimal places of their minor unit. Amounts are always stored as integers
+// in the minor unit, e.g. kobo for NGN, cents for USD and yen for JPY.
+var currencyExponents = map[string]int{
+	"NGN": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"GHS": 2,
+	"KES": 2,
+	"ZAR": 2,
+	"CAD": 2,
+	"JPY": 0,
+	"KWD": 3,
+}
+
+// NormalizeCurrency upper-cases code and checks it is supported.
+func NormalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if _, ok := currencyExponents[code]; !ok {
+		return "", ErrorUnsupportedCurrency
+	}
+	return code, nil
+}
+
+// CurrencyExponent is the number of minor unit decimal places of currency.
+// Unknown codes fall back to two, which is right for most currencies.
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
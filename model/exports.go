@@ -0,0 +1,97 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/riverqueue/river"
+	"github.com/uptrace/bun"
+)
+
+var ErrorExportNotFound = errors.New("export not found")
+
+const (
+	ExportStatusQueued    = "queued"
+	ExportStatusRunning   = "running"
+	ExportStatusCompleted = "completed"
+	ExportStatusFailed    = "failed"
+)
+
+type Export struct {
+	ID          int64     `bun:",pk,autoincrement" json:"export_id"`
+	UserID      int64     `bun:",notnull" json:"-"`
+	JobID       int64     `bun:",nullzero" json:"-"`
+	Status      string    `bun:",notnull,default:'queued'" json:"status"`
+	Format      string    `bun:",notnull,default:'xlsx'" json:"format"`
+	FilePath    string    `bun:",nullzero" json:"-"`
+	FileName    string    `bun:",nullzero" json:"file_name,omitempty"`
+	Error       string    `bun:",nullzero" json:"error,omitempty"`
+	CreatedAt   time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	UpdatedAt   time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"updated_at"`
+	CompletedAt time.Time `bun:",nullzero" json:"completed_at"`
+}
+
+// CreateExport records a queued export and enqueues the job built by args in
+// the same database transaction, so an export row never exists without a job.
+func (e *Export) CreateExport(db *postgres.PostgresDB, args func(exportID int64) river.JobArgs) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	e.Status = ExportStatusQueued
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(e).Returning("*").Exec(ctx); err != nil {
+			return err
+		}
+
+		res, err := db.River.InsertTx(ctx, tx.Tx, args(e.ID), nil)
+		if err != nil {
+			return err
+		}
+
+		e.JobID = res.Job.ID
+		_, err = tx.NewUpdate().Model(e).Column("job_id").WherePK().Exec(ctx)
+		return err
+	})
+}
+
+// GetExport loads an export owned by userId.
+func GetExport(db *postgres.PostgresDB, id, userId int64) (*Export, error) {
+	export := new(Export)
+	if err := db.SelectSingleEntity("id = ? AND user_id = ?", export, id, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrorExportNotFound
+		}
+		return nil, err
+	}
+	return export, nil
+}
+
+// UpdateExportStatus moves an export to status. filePath and errMsg are only
+// stored when they are set.
+func UpdateExportStatus(ctx context.Context, db *postgres.PostgresDB, id int64, status, filePath, errMsg string) error {
+	query := db.DB.NewUpdate().
+		Model((*Export)(nil)).
+		Set("status = ?", status).
+		Set("updated_at = CURRENT_TIMESTAMP").
+		Where("id = ?", id)
+
+	switch status {
+	case ExportStatusCompleted:
+		query = query.
+			Set("file_path = ?", filePath).
+			Set("file_name = ?", filepath.Base(filePath)).
+			Set("error = NULL").
+			Set("completed_at = CURRENT_TIMESTAMP")
+	case ExportStatusFailed, ExportStatusQueued:
+		if errMsg != "" {
+			query = query.Set("error = ?", errMsg)
+		}
+	}
+
+	_, err := query.Exec(ctx)
+	return err
+}
@@ -0,0 +1,281 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorInvalidFeeRule = errors.New("invalid fee rule")
+var ErrorFeeRuleNotFound = errors.New("fee rule not found")
+
+// What a fee rule is charged on.
+const (
+	FeeOnDebit    = "debit"
+	FeeOnCredit   = "credit"
+	FeeOnTransfer = "transfer"
+)
+
+// How a fee rule works out the fee.
+const (
+	FeeTypeFlat       = "flat"       // Flat on every transaction
+	FeeTypePercentage = "percentage" // BasisPoints of the amount
+	FeeTypeTiered     = "tiered"     // Flat plus BasisPoints of the first tier the amount fits in
+)
+
+// FeeRule is the fee schedule for one kind of transaction in one currency.
+// MinFee and MaxFee cap the result; a MaxFee of zero means no upper cap.
+type FeeRule struct {
+	ID          int64     `bun:",pk,autoincrement" json:"id"`
+	AppliesTo   string    `bun:",notnull,unique:fee_rules_scope" json:"applies_to"` // debit, credit or transfer
+	Currency    string    `bun:",notnull,unique:fee_rules_scope" json:"currency"`
+	Type        string    `bun:",notnull" json:"type"`
+	Flat        int64     `bun:",notnull,default:0" json:"flat"` // in minor units
+	BasisPoints int64     `bun:",notnull,default:0" json:"basis_points"`
+	Tiers       []FeeTier `bun:",type:jsonb" json:"tiers,omitempty"`
+	MinFee      int64     `bun:",notnull,default:0" json:"min_fee"`
+	MaxFee      int64     `bun:",notnull,default:0" json:"max_fee"`
+	CreatedAt   time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	UpdatedAt   time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"updated_at"`
+}
+
+// FeeTier prices amounts up to and including UpTo. The last tier has an
+// UpTo of zero and takes every larger amount.
+type FeeTier struct {
+	UpTo        int64 `json:"up_to"`
+	Flat        int64 `json:"flat"`
+	BasisPoints int64 `json:"basis_points"`
+}
+
+func (f *FeeRule) validate() error {
+	switch f.AppliesTo {
+	case FeeOnDebit, FeeOnCredit, FeeOnTransfer:
+	default:
+		return fmt.Errorf("%w: applies_to must be debit, credit or transfer", ErrorInvalidFeeRule)
+	}
+	if f.Flat < 0 || f.BasisPoints < 0 || f.BasisPoints > 10000 || f.MinFee < 0 || f.MaxFee < 0 {
+		return fmt.Errorf("%w: amounts must not be negative and basis_points at most 10000", ErrorInvalidFeeRule)
+	}
+	if f.MaxFee != 0 && f.MaxFee < f.MinFee {
+		return fmt.Errorf("%w: max_fee is below min_fee", ErrorInvalidFeeRule)
+	}
+
+	switch f.Type {
+	case FeeTypeFlat, FeeTypePercentage:
+		if len(f.Tiers) > 0 {
+			return fmt.Errorf("%w: only tiered rules have tiers", ErrorInvalidFeeRule)
+		}
+	case FeeTypeTiered:
+		if len(f.Tiers) == 0 || f.Tiers[len(f.Tiers)-1].UpTo != 0 {
+			return fmt.Errorf("%w: the last tier must have an up_to of 0", ErrorInvalidFeeRule)
+		}
+		var upTo int64
+		for i, tier := range f.Tiers {
+			if i < len(f.Tiers)-1 && tier.UpTo <= upTo {
+				return fmt.Errorf("%w: tiers must be in increasing up_to order", ErrorInvalidFeeRule)
+			}
+			if tier.Flat < 0 || tier.BasisPoints < 0 || tier.BasisPoints > 10000 {
+				return fmt.Errorf("%w: amounts must not be negative and basis_points at most 10000", ErrorInvalidFeeRule)
+			}
+			upTo = tier.UpTo
+		}
+	default:
+		return fmt.Errorf("%w: type must be flat, percentage or tiered", ErrorInvalidFeeRule)
+	}
+	return nil
+}
+
+// Charge works out the fee on amount. TransID is left for the caller.
+func (f *FeeRule) Charge(amount int64) kafka.FeeBreakdown {
+	fee := kafka.FeeBreakdown{Type: f.Type}
+	switch f.Type {
+	case FeeTypeFlat:
+		fee.Flat = f.Flat
+	case FeeTypePercentage:
+		fee.BasisPoints = f.BasisPoints
+	case FeeTypeTiered:
+		for _, tier := range f.Tiers {
+			if tier.UpTo == 0 || amount <= tier.UpTo {
+				fee.Flat, fee.BasisPoints = tier.Flat, tier.BasisPoints
+				break
+			}
+		}
+	}
+
+	// rounded half up, in big.Int so large amounts cannot overflow
+	pct := new(big.Int).Mul(big.NewInt(amount), big.NewInt(fee.BasisPoints))
+	pct.Add(pct, big.NewInt(5000))
+	fee.Percentage = pct.Quo(pct, big.NewInt(10000)).Int64()
+
+	fee.Amount = fee.Flat + fee.Percentage
+	if fee.Amount < f.MinFee {
+		fee.Amount, fee.Capped = f.MinFee, "min"
+	}
+	if f.MaxFee != 0 && fee.Amount > f.MaxFee {
+		fee.Amount, fee.Capped = f.MaxFee, "max"
+	}
+	// a credit must not take the wallet balance down, let alone below zero
+	if f.AppliesTo == FeeOnCredit && fee.Amount > amount {
+		fee.Amount, fee.Capped = amount, "amount"
+	}
+	return fee
+}
+
+// chargeFee adds the fee on principal, if its schedule asks for one, to the
+// journal entry as a debit of wallet credited to the fees income account.
+// The fee transaction is returned so the caller can check the wallet can
+// pay for it; nil means no fee.
+func chargeFee(ctx context.Context, tx bun.Tx, entry *JournalEntry, appliesTo string, principal *Transaction, wallet *Wallet) (*Transaction, error) {
+	rule := new(FeeRule)
+	err := tx.NewSelect().
+		Model(rule).
+		Where("applies_to = ? AND currency = ?", appliesTo, wallet.Currency).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := rule.Charge(principal.Amount)
+	if breakdown.Amount == 0 {
+		return nil, nil
+	}
+	breakdown.TransID = principal.TransID + ":fee"
+	principal.Fee = &breakdown
+
+	fee := &Transaction{
+		Entry:   "debit",
+		Amount:  breakdown.Amount,
+		TransID: breakdown.TransID,
+		FeeFor:  principal.TransID,
+	}
+	entry.walletLeg(fee, wallet)
+	entry.systemLeg(AccountFeesIncome, fee.Amount)
+	return fee, nil
+}
+
+// postedFee rebuilds the fee breakdown of principal from its fee
+// transaction, nil when none was charged. How the fee was worked out is not
+// stored, so it is taken from the rule when that still charges the same
+// amount; otherwise the breakdown only holds the amount.
+func postedFee(ctx context.Context, db bun.IDB, appliesTo string, principal *Transaction) (*kafka.FeeBreakdown, error) {
+	fee := new(Transaction)
+	err := db.NewSelect().
+		Model(fee).
+		Where("user_id = ? AND fee_for = ?", principal.UserID, principal.TransID).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := kafka.FeeBreakdown{Amount: fee.Amount}
+	rule := new(FeeRule)
+	err = db.NewSelect().
+		Model(rule).
+		Where("applies_to = ? AND currency = ?", appliesTo, principal.Currency).
+		Scan(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err == nil {
+		if charged := rule.Charge(principal.Amount); charged.Amount == fee.Amount {
+			breakdown = charged
+		}
+	}
+	breakdown.TransID = fee.TransID
+	return &breakdown, nil
+}
+
+// ListFeeRules returns the fee schedule.
+func ListFeeRules(db *postgres.PostgresDB) ([]*FeeRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rules := []*FeeRule{}
+	err := db.DB.NewSelect().
+		Model(&rules).
+		Order("applies_to ASC", "currency ASC").
+		Scan(ctx)
+	return rules, err
+}
+
+// SaveFeeRule creates f or replaces the rule for the same kind of
+// transaction and currency.
+func (f *FeeRule) SaveFeeRule(db *postgres.PostgresDB, actor Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if err := f.validate(); err != nil {
+		return err
+	}
+	currency, err := NormalizeCurrency(f.Currency)
+	if err != nil {
+		return err
+	}
+	f.Currency = currency
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().
+			Model(f).
+			On("CONFLICT (applies_to, currency) DO UPDATE").
+			Set("type = EXCLUDED.type").
+			Set("flat = EXCLUDED.flat").
+			Set("basis_points = EXCLUDED.basis_points").
+			Set("tiers = EXCLUDED.tiers").
+			Set("min_fee = EXCLUDED.min_fee").
+			Set("max_fee = EXCLUDED.max_fee").
+			Set("updated_at = CURRENT_TIMESTAMP").
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return actor.audit(ctx, tx, AuditFeeSave, "fee_rule", f.ID, map[string]any{
+			"applies_to":   f.AppliesTo,
+			"currency":     f.Currency,
+			"type":         f.Type,
+			"flat":         f.Flat,
+			"basis_points": f.BasisPoints,
+			"tiers":        f.Tiers,
+			"min_fee":      f.MinFee,
+			"max_fee":      f.MaxFee,
+		})
+	})
+}
+
+// DeleteFeeRule stops charging the fee of the rule with id.
+func DeleteFeeRule(db *postgres.PostgresDB, actor Actor, id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		rule := new(FeeRule)
+		err := tx.NewDelete().
+			Model(rule).
+			Where("id = ?", id).
+			Returning("*").
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorFeeRuleNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return actor.audit(ctx, tx, AuditFeeDelete, "fee_rule", id, map[string]any{
+			"applies_to": rule.AppliesTo,
+			"currency":   rule.Currency,
+		})
+	})
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+// TransactionFilter narrows down the transactions of a wallet. Zero values
+// mean the bound is not applied. From is inclusive and To is exclusive.
+type TransactionFilter struct {
+	Currency  string    `json:"currency,omitempty"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Entry     string    `json:"entry,omitempty"`
+	MinAmount int64     `json:"min_amount,omitempty"`
+	MaxAmount int64     `json:"max_amount,omitempty"`
+}
+
+func (f TransactionFilter) apply(q *bun.SelectQuery) *bun.SelectQuery {
+	if f.Currency != "" {
+		q = q.Where("transaction.currency = ?", f.Currency)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("transaction.created_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Where("transaction.created_at < ?", f.To)
+	}
+	if f.Entry != "" {
+		q = q.Where("transaction.entry = ?", f.Entry)
+	}
+	if f.MinAmount > 0 {
+		q = q.Where("transaction.amount >= ?", f.MinAmount)
+	}
+	if f.MaxAmount > 0 {
+		q = q.Where("transaction.amount <= ?", f.MaxAmount)
+	}
+	return q
+}
+
+// String describes the applied filters for report headers. The currency is
+// left out since statements already name their wallet currency.
+func (f TransactionFilter) String() string {
+	var parts []string
+	if !f.From.IsZero() {
+		parts = append(parts, "from "+f.From.UTC().Format(time.RFC3339))
+	}
+	if !f.To.IsZero() {
+		parts = append(parts, "to "+f.To.UTC().Format(time.RFC3339))
+	}
+	if f.Entry != "" {
+		parts = append(parts, "entry "+f.Entry)
+	}
+	if f.MinAmount > 0 {
+		parts = append(parts, fmt.Sprintf("amount >= %d", f.MinAmount))
+	}
+	if f.MaxAmount > 0 {
+		parts = append(parts, fmt.Sprintf("amount <= %d", f.MaxAmount))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// PeriodBalances returns the wallet balance at filter.From and at filter.To,
+// derived from the ledger postings. An unset From gives an opening balance of
+// zero and an unset To gives the current balance.
+func PeriodBalances(ctx context.Context, db *postgres.PostgresDB, walletID int64, filter TransactionFilter) (int64, int64, error) {
+	balanceBefore := func(at time.Time) (int64, error) {
+		var balance int64
+		q := db.DB.NewSelect().
+			TableExpr("postings AS p").
+			ColumnExpr("COALESCE(SUM(p.amount), 0)").
+			Join("JOIN accounts AS a ON a.id = p.account_id").
+			Where("a.wallet_id = ?", walletID)
+		if !at.IsZero() {
+			q = q.Where("p.created_at < ?", at)
+		}
+		err := q.Scan(ctx, &balance)
+		return balance, err
+	}
+
+	var opening int64
+	if !filter.From.IsZero() {
+		var err error
+		if opening, err = balanceBefore(filter.From); err != nil {
+			return 0, 0, err
+		}
+	}
+	closing, err := balanceBefore(filter.To)
+	if err != nil {
+		return 0, 0, err
+	}
+	return opening, closing, nil
+}
@@ -0,0 +1,395 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorRateNotFound = errors.New("no exchange rate for this currency pair")
+var ErrorInvalidRate = errors.New("invalid exchange rate")
+var ErrorQuoteNotFound = errors.New("quote not found")
+var ErrorQuoteExpired = errors.New("quote has expired")
+var ErrorQuoteUsed = errors.New("quote has already been used")
+var ErrorAmountTooSmall = errors.New("amount is too small to convert")
+
+// QuoteTTL is how long a quoted rate can be executed.
+const QuoteTTL = 30 * time.Second
+
+// ExchangeRate is the mid-market rate for one unit of Base in Quote. The
+// customer gets the rate less SpreadBps basis points; the difference is FX
+// income.
+type ExchangeRate struct {
+	ID            int64     `bun:",pk,autoincrement" json:"-"`
+	BaseCurrency  string    `bun:",notnull,unique:exchange_rates_pair" json:"base_currency"`
+	QuoteCurrency string    `bun:",notnull,unique:exchange_rates_pair" json:"quote_currency"`
+	Rate          string    `bun:"type:numeric(24,12),notnull" json:"rate"`
+	SpreadBps     int64     `bun:",notnull,default:0" json:"spread_bps"`
+	UpdatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"updated_at"`
+}
+
+// FXQuote locks a rate for one conversion until ExpiresAt.
+type FXQuote struct {
+	bun.BaseModel `bun:"table:fx_quotes"`
+	ID            string    `bun:",pk" json:"quote_id"`
+	UserID        int64     `bun:",notnull" json:"-"`
+	FromCurrency  string    `bun:",notnull" json:"from_currency"`
+	ToCurrency    string    `bun:",notnull" json:"to_currency"`
+	SourceAmount  int64     `bun:",notnull" json:"source_amount"` // debited, in minor units of FromCurrency
+	TargetAmount  int64     `bun:",notnull" json:"target_amount"` // credited, in minor units of ToCurrency
+	SpreadAmount  int64     `bun:",notnull" json:"spread_amount"` // kept as FX income, in minor units of ToCurrency
+	MidRate       string    `bun:"type:numeric(24,12),notnull" json:"mid_rate"`
+	SpreadBps     int64     `bun:",notnull" json:"spread_bps"`
+	ExpiresAt     time.Time `bun:",notnull" json:"expires_at"`
+	UsedAt        time.Time `bun:",nullzero" json:"-"`
+	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+}
+
+// Conversion moves funds between two wallets of the same user in different
+// currencies at a quoted rate. It is booked as two journal entries, one per
+// currency, through the fx_position system account.
+type Conversion struct {
+	ID           int64        `bun:",pk,autoincrement" json:"conversion_id"`
+	UserID       int64        `bun:",notnull,unique:conversions_user_reference" json:"-"`
+	QuoteID      string       `bun:",unique,notnull" json:"quote_id"`
+	Reference    string       `bun:",notnull,unique:conversions_user_reference" json:"reference"`
+	FromWalletID int64        `bun:",notnull" json:"from_wallet_id"`
+	ToWalletID   int64        `bun:",notnull" json:"to_wallet_id"`
+	SourceAmount int64        `bun:",notnull" json:"source_amount"`
+	TargetAmount int64        `bun:",notnull" json:"target_amount"`
+	SpreadAmount int64        `bun:",notnull" json:"spread_amount"`
+	MidRate      string       `bun:"type:numeric(24,12),notnull" json:"mid_rate"`
+	SpreadBps    int64        `bun:",notnull" json:"spread_bps"`
+	CreatedAt    time.Time    `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	Debit        *Transaction `bun:"-" json:"debit"`
+	Credit       *Transaction `bun:"-" json:"credit"`
+}
+
+// ListExchangeRates returns every configured rate.
+func ListExchangeRates(db *postgres.PostgresDB) ([]*ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rates []*ExchangeRate
+	err := db.DB.NewSelect().
+		Model(&rates).
+		Order("base_currency ASC", "quote_currency ASC").
+		Scan(ctx)
+	return rates, err
+}
+
+// UpsertExchangeRates validates rates and stores them, replacing existing
+// rates for the same currency pairs. The import is audited as actor's.
+func UpsertExchangeRates(db *postgres.PostgresDB, actor Actor, rates []*ExchangeRate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, r := range rates {
+		if err := r.normalize(); err != nil {
+			return err
+		}
+	}
+	if len(rates) == 0 {
+		return nil
+	}
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().
+			Model(&rates).
+			On("CONFLICT (base_currency, quote_currency) DO UPDATE").
+			Set("rate = EXCLUDED.rate").
+			Set("spread_bps = EXCLUDED.spread_bps").
+			Set("updated_at = CURRENT_TIMESTAMP").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		pairs := make([]string, len(rates))
+		for i, r := range rates {
+			pairs[i] = r.BaseCurrency + "/" + r.QuoteCurrency
+		}
+		return actor.audit(ctx, tx, AuditExchangeRates, "exchange_rates", 0, map[string]any{"pairs": pairs})
+	})
+}
+
+// ParseExchangeRatesCSV reads rates from CSV with the columns base, quote,
+// rate and an optional spread_bps. A header row is skipped.
+func ParseExchangeRatesCSV(r io.Reader) ([]*ExchangeRate, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var rates []*ExchangeRate
+	for i, rec := range records {
+		if i == 0 && strings.EqualFold(rec[0], "base") {
+			continue
+		}
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("line %d: expected base, quote, rate[, spread_bps]", i+1)
+		}
+		rate := &ExchangeRate{BaseCurrency: rec[0], QuoteCurrency: rec[1], Rate: rec[2]}
+		if len(rec) > 3 && rec[3] != "" {
+			if rate.SpreadBps, err = strconv.ParseInt(rec[3], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid spread_bps: %w", i+1, err)
+			}
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+func (r *ExchangeRate) normalize() error {
+	var err error
+	if r.BaseCurrency, err = NormalizeCurrency(r.BaseCurrency); err != nil {
+		return err
+	}
+	if r.QuoteCurrency, err = NormalizeCurrency(r.QuoteCurrency); err != nil {
+		return err
+	}
+	if r.BaseCurrency == r.QuoteCurrency {
+		return fmt.Errorf("%w: %s to itself", ErrorInvalidRate, r.BaseCurrency)
+	}
+	rate, ok := new(big.Rat).SetString(strings.TrimSpace(r.Rate))
+	if !ok || rate.Sign() <= 0 {
+		return fmt.Errorf("%w: %q", ErrorInvalidRate, r.Rate)
+	}
+	if r.SpreadBps < 0 || r.SpreadBps >= 10000 {
+		return fmt.Errorf("%w: spread_bps must be between 0 and 9999", ErrorInvalidRate)
+	}
+	r.Rate = rate.FloatString(12)
+	return nil
+}
+
+// CreateQuote prices a conversion of q.SourceAmount from q.FromCurrency to
+// q.ToCurrency and stores the quote for QuoteTTL.
+func (q *FXQuote) CreateQuote(db *postgres.PostgresDB, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mid, spreadBps, err := midRate(ctx, db.DB, q.FromCurrency, q.ToCurrency)
+	if err != nil {
+		return err
+	}
+
+	// the target amount is rounded down so the house never pays out more
+	// than the rate allows
+	scale := new(big.Rat).SetFrac(
+		pow10(CurrencyExponent(q.ToCurrency)),
+		pow10(CurrencyExponent(q.FromCurrency)),
+	)
+	gross := new(big.Rat).Mul(new(big.Rat).SetInt64(q.SourceAmount), mid)
+	gross.Mul(gross, scale)
+	net := new(big.Rat).Mul(gross, big.NewRat(10000-spreadBps, 10000))
+
+	grossAmount := floor(gross)
+	q.TargetAmount = floor(net)
+	q.SpreadAmount = grossAmount - q.TargetAmount
+	if q.TargetAmount <= 0 {
+		return ErrorAmountTooSmall
+	}
+
+	q.ID = uuid.New().String()
+	q.UserID = userId
+	q.MidRate = mid.FloatString(12)
+	q.SpreadBps = spreadBps
+	q.ExpiresAt = time.Now().Add(QuoteTTL)
+	_, err = db.DB.NewInsert().Model(q).Returning("*").Exec(ctx)
+	return err
+}
+
+// GetQuote loads a quote of userId.
+func GetQuote(db *postgres.PostgresDB, id string, userId int64) (*FXQuote, error) {
+	quote := new(FXQuote)
+	if err := db.SelectSingleEntity("id = ? AND user_id = ?", quote, id, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrorQuoteNotFound
+		}
+		return nil, err
+	}
+	return quote, nil
+}
+
+// midRate finds the rate for one unit of from in to. A rate stored for the
+// opposite direction is inverted.
+func midRate(ctx context.Context, db bun.IDB, from, to string) (*big.Rat, int64, error) {
+	rate := new(ExchangeRate)
+	err := db.NewSelect().
+		Model(rate).
+		Where("(base_currency = ? AND quote_currency = ?) OR (base_currency = ? AND quote_currency = ?)", from, to, to, from).
+		OrderExpr("base_currency = ? DESC", from).
+		Limit(1).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, ErrorRateNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	mid, ok := new(big.Rat).SetString(rate.Rate)
+	if !ok || mid.Sign() <= 0 {
+		return nil, 0, fmt.Errorf("%w: %q", ErrorInvalidRate, rate.Rate)
+	}
+	if rate.BaseCurrency != from {
+		mid.Inv(mid)
+	}
+	return mid, rate.SpreadBps, nil
+}
+
+// Convert executes the quote: it debits the source wallet, credits the
+// target wallet and books the spread as FX income, all in one database
+// transaction. A quote can be executed once, before it expires.
+func (c *Conversion) Convert(db *postgres.PostgresDB, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if c.Reference == "" {
+		c.Reference = uuid.New().String()
+	}
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		exists, err := tx.NewSelect().
+			Model((*Conversion)(nil)).
+			Where("user_id = ? AND reference = ?", userId, c.Reference).
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrorDuplicateTransaction
+		}
+		if err := requireVerified(ctx, tx, userId); err != nil {
+			return err
+		}
+
+		quote := new(FXQuote)
+		err = tx.NewSelect().
+			Model(quote).
+			Where("id = ? AND user_id = ?", c.QuoteID, userId).
+			For("UPDATE").
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorQuoteNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !quote.UsedAt.IsZero() {
+			return ErrorQuoteUsed
+		}
+		if !quote.ExpiresAt.After(time.Now()) {
+			return ErrorQuoteExpired
+		}
+		// the source leg is a debit of the user; checkLimits locks the
+		// user row before the wallets
+		if err := checkLimits(ctx, tx, userId, quote.FromCurrency, "debit", quote.SourceAmount); err != nil {
+			return err
+		}
+
+		// both wallets are locked in id order, like transfers
+		var wallets []*Wallet
+		err = tx.NewSelect().
+			Model(&wallets).
+			Where("user_id = ? AND currency IN (?)", userId, bun.In([]string{quote.FromCurrency, quote.ToCurrency})).
+			Order("id ASC").
+			For("UPDATE").
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+		if len(wallets) != 2 {
+			return ErrorWalletNotFound
+		}
+		source, target := wallets[0], wallets[1]
+		if source.Currency != quote.FromCurrency {
+			source, target = target, source
+		}
+
+		if err := source.allows("debit"); err != nil {
+			return err
+		}
+		if err := target.allows("credit"); err != nil {
+			return err
+		}
+		if source.Available() < quote.SourceAmount {
+			return ErrorInsuffcientBalance
+		}
+
+		c.Debit = &Transaction{
+			Entry:       "debit",
+			Amount:      quote.SourceAmount,
+			TransID:     "conversion:" + c.Reference + ":debit",
+			TransferRef: "conversion:" + c.Reference,
+		}
+		debit := newJournalEntry(userReference("conversion", userId, c.Reference+":debit"), "currency conversion "+quote.FromCurrency+" to "+quote.ToCurrency)
+		debit.walletLeg(c.Debit, source)
+		debit.systemLeg(AccountFXPosition, quote.SourceAmount)
+		if err := debit.post(ctx, tx); err != nil {
+			return err
+		}
+
+		c.Credit = &Transaction{
+			Entry:       "credit",
+			Amount:      quote.TargetAmount,
+			TransID:     "conversion:" + c.Reference + ":credit",
+			TransferRef: "conversion:" + c.Reference,
+		}
+		credit := newJournalEntry(userReference("conversion", userId, c.Reference+":credit"), "currency conversion "+quote.FromCurrency+" to "+quote.ToCurrency)
+		credit.walletLeg(c.Credit, target)
+		credit.systemLeg(AccountFXPosition, -(quote.TargetAmount + quote.SpreadAmount))
+		if quote.SpreadAmount > 0 {
+			credit.systemLeg(AccountFXIncome, quote.SpreadAmount)
+		}
+		if err := credit.post(ctx, tx); err != nil {
+			return err
+		}
+
+		quote.UsedAt = time.Now()
+		if _, err := tx.NewUpdate().Model(quote).Column("used_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+
+		c.UserID = userId
+		c.FromWalletID = source.ID
+		c.ToWalletID = target.ID
+		c.SourceAmount = quote.SourceAmount
+		c.TargetAmount = quote.TargetAmount
+		c.SpreadAmount = quote.SpreadAmount
+		c.MidRate = quote.MidRate
+		c.SpreadBps = quote.SpreadBps
+		if _, err := tx.NewInsert().Model(c).Returning("*").Exec(ctx); err != nil {
+			return err
+		}
+
+		if err := c.Debit.enqueueEvent(ctx, tx, userId); err != nil {
+			return err
+		}
+		return c.Credit.enqueueEvent(ctx, tx, userId)
+	})
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// floor rounds a non-negative rational down to an integer.
+func floor(r *big.Rat) int64 {
+	return new(big.Int).Quo(r.Num(), r.Denom()).Int64()
+}
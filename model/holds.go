@@ -0,0 +1,371 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorHoldNotFound = errors.New("hold not found")
+var ErrorHoldNotOpen = errors.New("hold is no longer open")
+var ErrorHoldExpired = errors.New("hold has expired")
+var ErrorCaptureExceedsHold = errors.New("capture amount exceeds held amount")
+
+const (
+	HoldStatusOpen     = "open"
+	HoldStatusCaptured = "captured"
+	HoldStatusReleased = "released"
+	HoldStatusExpired  = "expired"
+)
+
+// DefaultHoldTTL is how long a hold stays open when the client does not ask
+// for a different expiry.
+const DefaultHoldTTL = 7 * 24 * time.Hour
+
+// Hold reserves part of a wallet balance for a later debit. While it is open
+// the amount counts towards Wallet.Held and cannot be spent, but nothing is
+// posted to the ledger until the hold is captured.
+type Hold struct {
+	ID             int64     `bun:",pk,autoincrement" json:"hold_id"`
+	WalletID       int64     `bun:",notnull" json:"wallet_id"`
+	UserID         int64     `bun:",notnull,unique:holds_user_reference" json:"-"`
+	Amount         int64     `bun:",notnull" json:"amount"`                    // in minor units
+	CapturedAmount int64     `bun:",notnull,default:0" json:"captured_amount"` // in minor units
+	Currency       string    `bun:",notnull" json:"currency"`
+	Status         string    `bun:",notnull,default:'open'" json:"status"` // open, captured, released or expired
+	Reference      string    `bun:",notnull,unique:holds_user_reference" json:"reference"`
+	ExpiresAt      time.Time `bun:",notnull" json:"expires_at"`
+	CreatedAt      time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	UpdatedAt      time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"updated_at"`
+}
+
+// CreateHold reserves h.Amount of the user's available balance.
+func (h *Hold) CreateHold(db *postgres.PostgresDB, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if h.Reference == "" {
+		h.Reference = uuid.New().String()
+	}
+	if h.ExpiresAt.IsZero() {
+		h.ExpiresAt = time.Now().Add(DefaultHoldTTL)
+	}
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		exists, err := tx.NewSelect().
+			Model((*Hold)(nil)).
+			Where("user_id = ? AND reference = ?", userId, h.Reference).
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrorDuplicateTransaction
+		}
+		if err := requireVerified(ctx, tx, userId); err != nil {
+			return err
+		}
+		// a hold the limits would not let the user capture is refused
+		// now; checkLimits locks the user row before the wallet
+		if err := checkLimits(ctx, tx, userId, h.Currency, "debit", h.Amount); err != nil {
+			return err
+		}
+
+		wallet, err := lockUserWallet(ctx, tx, userId, h.Currency)
+		if err != nil {
+			return err
+		}
+		// a hold is a debit in waiting, the capture would be refused
+		if err := wallet.allows("debit"); err != nil {
+			return err
+		}
+		if wallet.Available() < h.Amount {
+			return ErrorInsuffcientBalance
+		}
+
+		h.WalletID = wallet.ID
+		h.UserID = userId
+		h.Status = HoldStatusOpen
+		if _, err := tx.NewInsert().Model(h).Returning("*").Exec(ctx); err != nil {
+			return err
+		}
+		return adjustHeld(ctx, tx, wallet, h.Amount)
+	})
+}
+
+// Capture debits amount from the wallet and closes the hold. A partial
+// capture releases whatever was held beyond amount; a zero amount captures
+// the full hold.
+func (h *Hold) Capture(db *postgres.PostgresDB, userId, holdId, amount int64) (*Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t *Transaction
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// the capture is a debit like any other, and checkLimits locks the
+		// user row before lockOpen locks the wallet
+		held, err := findHold(ctx, tx, holdId, userId)
+		if err != nil {
+			return err
+		}
+		if amount == 0 {
+			amount = held.Amount
+		}
+		if amount > held.Amount {
+			return ErrorCaptureExceedsHold
+		}
+		if err := checkLimits(ctx, tx, userId, held.Currency, "debit", amount); err != nil {
+			return err
+		}
+
+		wallet, err := h.lockOpen(ctx, tx, userId, holdId)
+		if err != nil {
+			return err
+		}
+
+		// give the reservation back first so the debit below is checked
+		// against a balance that no longer excludes it
+		if err := adjustHeld(ctx, tx, wallet, -h.Amount); err != nil {
+			return err
+		}
+
+		t = &Transaction{Entry: "debit", Amount: amount, TransID: "hold:" + h.Reference + ":capture"}
+		entry := newJournalEntry(userReference("hold", userId, h.Reference), "hold capture")
+		entry.walletLeg(t, wallet)
+		entry.systemLeg(AccountFundingSource, amount)
+		if err := entry.post(ctx, tx); err != nil {
+			return err
+		}
+
+		h.CapturedAmount = amount
+		if err := h.close(ctx, tx, HoldStatusCaptured); err != nil {
+			return err
+		}
+		return t.enqueueEvent(ctx, tx, userId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Release closes the hold without moving any funds.
+func (h *Hold) Release(db *postgres.PostgresDB, userId, holdId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		wallet, err := h.lockOpen(ctx, tx, userId, holdId)
+		if err != nil {
+			return err
+		}
+		if err := adjustHeld(ctx, tx, wallet, -h.Amount); err != nil {
+			return err
+		}
+		return h.close(ctx, tx, HoldStatusReleased)
+	})
+}
+
+// GetHold loads a hold on a wallet of userId.
+func GetHold(db *postgres.PostgresDB, id, userId int64) (*Hold, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return findHold(ctx, db.DB, id, userId)
+}
+
+func findHold(ctx context.Context, db bun.IDB, id, userId int64) (*Hold, error) {
+	hold := new(Hold)
+	err := db.NewSelect().
+		Model(hold).
+		Join("JOIN wallets AS w ON w.id = hold.wallet_id").
+		Where("hold.id = ? AND w.user_id = ?", id, userId).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrorHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// lockOpen locks the wallet of the hold and then the hold, in that order,
+// and checks the hold can still be captured or released.
+func (h *Hold) lockOpen(ctx context.Context, tx bun.Tx, userId, holdId int64) (*Wallet, error) {
+	var walletID int64
+	err := tx.NewSelect().
+		Model((*Hold)(nil)).
+		Column("hold.wallet_id").
+		Join("JOIN wallets AS w ON w.id = hold.wallet_id").
+		Where("hold.id = ? AND w.user_id = ?", holdId, userId).
+		Scan(ctx, &walletID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrorHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	wallet, err := lockWallet(ctx, tx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.NewSelect().
+		Model(h).
+		Where("id = ? AND wallet_id = ?", holdId, wallet.ID).
+		For("UPDATE").
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrorHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Status != HoldStatusOpen {
+		return nil, ErrorHoldNotOpen
+	}
+	if !h.ExpiresAt.After(time.Now()) {
+		return nil, ErrorHoldExpired
+	}
+	return wallet, nil
+}
+
+func (h *Hold) close(ctx context.Context, tx bun.Tx, status string) error {
+	h.Status = status
+	h.UpdatedAt = time.Now()
+	_, err := tx.NewUpdate().
+		Model(h).
+		Column("status", "captured_amount", "updated_at").
+		WherePK().
+		Exec(ctx)
+	return err
+}
+
+// ExpireHolds closes up to limit open holds whose expiry has passed and gives
+// their amounts back to the wallets. It returns how many holds it expired.
+func ExpireHolds(ctx context.Context, db *postgres.PostgresDB, limit int) (int, error) {
+	var expired int
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var holds []*Hold
+		err := tx.NewSelect().
+			Model(&holds).
+			Where("status = ? AND expires_at <= CURRENT_TIMESTAMP", HoldStatusOpen).
+			Order("id ASC").
+			Limit(limit).
+			Scan(ctx)
+		if err != nil || len(holds) == 0 {
+			return err
+		}
+
+		walletIDs := make([]int64, 0, len(holds))
+		for _, h := range holds {
+			walletIDs = append(walletIDs, h.WalletID)
+		}
+
+		// wallets are locked before holds everywhere else, so do the same
+		// here and then skip holds that were closed while we waited
+		var wallets []*Wallet
+		err = tx.NewSelect().
+			Model(&wallets).
+			Where("id IN (?)", bun.In(walletIDs)).
+			Order("id ASC").
+			For("UPDATE").
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		ids := holdIDs(holds)
+		for _, w := range wallets {
+			var released struct {
+				Count  int
+				Amount int64
+			}
+			err := tx.NewRaw(`
+				WITH expired AS (
+					UPDATE holds SET status = ?, updated_at = CURRENT_TIMESTAMP
+					WHERE wallet_id = ? AND status = ? AND expires_at <= CURRENT_TIMESTAMP AND id IN (?)
+					RETURNING amount
+				)
+				SELECT COUNT(*) AS count, COALESCE(SUM(amount), 0) AS amount FROM expired`,
+				HoldStatusExpired, w.ID, HoldStatusOpen, bun.In(ids)).
+				Scan(ctx, &released)
+			if err != nil {
+				return err
+			}
+			if released.Count == 0 {
+				continue
+			}
+			if err := adjustHeld(ctx, tx, w, -released.Amount); err != nil {
+				return err
+			}
+			expired += released.Count
+		}
+		return nil
+	})
+	return expired, err
+}
+
+func holdIDs(holds []*Hold) []int64 {
+	ids := make([]int64, len(holds))
+	for i, h := range holds {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+// lockUserWallet loads the user's wallet in currency and locks it for the
+// rest of tx.
+func lockUserWallet(ctx context.Context, tx bun.Tx, userId int64, currency string) (*Wallet, error) {
+	wallet := new(Wallet)
+	err := tx.NewSelect().
+		Model(wallet).
+		Where("user_id = ? AND currency = ?", userId, currency).
+		For("UPDATE").
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrorWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// lockWallet loads a wallet by id and locks it for the rest of tx.
+func lockWallet(ctx context.Context, tx bun.Tx, walletID int64) (*Wallet, error) {
+	wallet := new(Wallet)
+	err := tx.NewSelect().
+		Model(wallet).
+		Where("id = ?", walletID).
+		For("UPDATE").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// adjustHeld adds delta to the amount reserved on a locked wallet.
+func adjustHeld(ctx context.Context, tx bun.Tx, wallet *Wallet, delta int64) error {
+	_, err := tx.NewUpdate().
+		Model((*Wallet)(nil)).
+		Set("held = held + ?", delta).
+		Set("updated_at = CURRENT_TIMESTAMP").
+		Where("id = ?", wallet.ID).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	wallet.Held += delta
+	wallet.AvailableBalance = wallet.Available()
+	return nil
+}
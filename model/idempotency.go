@@ -0,0 +1,127 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+var ErrorIdempotencyKeyInUse = errors.New("a request with this idempotency key is still being processed")
+
+// IdempotencyKeyTTL is how long a key and its response are kept for replay.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// idempotencyLockTimeout is how long a key stays claimed by a request that
+// never completed, for example because the server stopped, before a retry
+// may take it over.
+const idempotencyLockTimeout = time.Minute
+
+// IdempotencyKey is an Idempotency-Key a user sent with a mutating request,
+// with a fingerprint of that request and the response it got. StatusCode is
+// 0 while the request is being processed.
+type IdempotencyKey struct {
+	ID          int64     `bun:",pk,autoincrement" json:"id"`
+	UserID      int64     `bun:",notnull,unique:idempotency_keys_user_key" json:"user_id"`
+	Key         string    `bun:",notnull,unique:idempotency_keys_user_key" json:"key"`
+	Fingerprint string    `bun:",notnull" json:"-"` // SHA-256 of the method, path and body
+	StatusCode  int       `bun:",notnull,default:0" json:"status_code"`
+	ContentType string    `bun:",nullzero" json:"-"`
+	Response    []byte    `bun:"type:bytea" json:"-"`
+	CreatedAt   time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	ExpiresAt   time.Time `bun:",notnull" json:"expires_at"`
+}
+
+// ClaimIdempotencyKey claims key for a request of userId. It returns nil when
+// the caller now owns the key and has to run the request, or the stored key
+// to replay when the same request already completed. A key that expired or
+// whose request was abandoned is claimed afresh.
+func ClaimIdempotencyKey(db *postgres.PostgresDB, userId int64, key, fingerprint string) (*IdempotencyKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stored *IdempotencyKey
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		now := time.Now().UTC()
+		claim := &IdempotencyKey{
+			UserID:      userId,
+			Key:         key,
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(IdempotencyKeyTTL),
+		}
+		res, err := tx.NewInsert().
+			Model(claim).
+			On("CONFLICT (user_id, key) DO NOTHING").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, _ := res.RowsAffected(); rows == 1 {
+			return nil
+		}
+
+		existing := new(IdempotencyKey)
+		err = tx.NewSelect().
+			Model(existing).
+			Where("user_id = ? AND key = ?", userId, key).
+			For("UPDATE").
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+		abandoned := existing.StatusCode == 0 && existing.CreatedAt.Before(now.Add(-idempotencyLockTimeout))
+		if existing.ExpiresAt.Before(now) || abandoned {
+			_, err := tx.NewUpdate().
+				Model(claim).
+				Column("fingerprint", "status_code", "content_type", "response", "created_at", "expires_at").
+				Where("id = ?", existing.ID).
+				Exec(ctx)
+			return err
+		}
+
+		if existing.Fingerprint != fingerprint {
+			return ErrorIdempotencyKeyReused
+		}
+		if existing.StatusCode == 0 {
+			return ErrorIdempotencyKeyInUse
+		}
+		stored = existing
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// CompleteIdempotencyKey stores the response of a claimed key for replay.
+func CompleteIdempotencyKey(db *postgres.PostgresDB, userId int64, key string, statusCode int, contentType string, response []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := db.DB.NewUpdate().
+		Model((*IdempotencyKey)(nil)).
+		Set("status_code = ?", statusCode).
+		Set("content_type = ?", contentType).
+		Set("response = ?", response).
+		Where("user_id = ? AND key = ? AND status_code = 0", userId, key).
+		Exec(ctx)
+	return err
+}
+
+// ReleaseIdempotencyKey gives up a claimed key without a response, so the
+// request can be retried with it.
+func ReleaseIdempotencyKey(db *postgres.PostgresDB, userId int64, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := db.DB.NewDelete().
+		Model((*IdempotencyKey)(nil)).
+		Where("user_id = ? AND key = ? AND status_code = 0", userId, key).
+		Exec(ctx)
+	return err
+}
@@ -0,0 +1,239 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+var ErrorUnbalancedEntry = errors.New("journal entry postings do not balance")
+var ErrorAccountNotFound = errors.New("ledger account not found")
+
+// system account codes. Every movement of money into or out of a user wallet
+// is balanced against one of these so the ledger as a whole always sums to zero.
+const (
+	AccountFundingSource = "funding_source"
+	AccountFeesIncome    = "fees_income"
+	AccountSuspense      = "suspense"
+	AccountFXPosition    = "fx_position" // offsets both legs of a currency conversion
+	AccountFXIncome      = "fx_income"   // spread earned on conversions
+	AccountAdjustments   = "adjustments" // offsets manual adjustments made by admins
+)
+
+const (
+	AccountTypeWallet = "wallet"
+	AccountTypeSystem = "system"
+)
+
+var systemAccountNames = map[string]string{
+	AccountFundingSource: "Funding source",
+	AccountFeesIncome:    "Fees income",
+	AccountSuspense:      "Suspense",
+	AccountFXPosition:    "FX position",
+	AccountFXIncome:      "FX income",
+	AccountAdjustments:   "Manual adjustments",
+}
+
+type Account struct {
+	ID        int64     `bun:",pk,autoincrement" json:"account_id"`
+	Code      string    `bun:",unique,notnull" json:"code"`
+	Name      string    `bun:",notnull" json:"name"`
+	Type      string    `bun:",notnull" json:"type"` // wallet or system
+	WalletID  int64     `bun:",unique,nullzero" json:"wallet_id,omitempty"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+}
+
+type JournalEntry struct {
+	ID          int64      `bun:",pk,autoincrement" json:"journal_entry_id"`
+	Reference   string     `bun:",unique,notnull" json:"reference"`
+	Description string     `json:"description"`
+	Currency    string     `bun:",notnull" json:"currency"` // every posting of an entry is in this currency
+	CreatedAt   time.Time  `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	Postings    []*Posting `bun:"rel:has-many,join:id=journal_entry_id" json:"postings,omitempty"`
+
+	legs   []*walletLeg
+	manual bool // admin adjustments skip the wallet status check
+}
+
+// Posting is one side of a journal entry. Amounts are signed: a positive
+// amount increases the account balance and a negative amount decreases it.
+// The postings of a single journal entry always sum to zero.
+type Posting struct {
+	ID             int64     `bun:",pk,autoincrement" json:"posting_id"`
+	JournalEntryID int64     `bun:",notnull" json:"journal_entry_id"`
+	AccountID      int64     `bun:",notnull" json:"account_id"`
+	Amount         int64     `bun:",notnull" json:"amount"` // in minor units of the entry currency
+	CreatedAt      time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+
+	accountCode string
+	walletID    int64
+}
+
+type walletLeg struct {
+	trans  *Transaction
+	wallet *Wallet
+}
+
+func newJournalEntry(reference, description string) *JournalEntry {
+	return &JournalEntry{Reference: reference, Description: description}
+}
+
+// userReference is the journal entry reference for ref, a reference userId
+// chose. Client references are only unique per user and journal entry
+// references across all of them, so the user is part of it.
+func userReference(kind string, userId int64, ref string) string {
+	return fmt.Sprintf("%s:%d:%s", kind, userId, ref)
+}
+
+// walletLeg adds a posting against the wallet's ledger account and records t
+// as the wallet facing view of that posting once the entry is posted. The
+// first wallet leg decides the currency of the entry.
+func (e *JournalEntry) walletLeg(t *Transaction, wallet *Wallet) {
+	if e.Currency == "" {
+		e.Currency = wallet.Currency
+	}
+	e.Postings = append(e.Postings, &Posting{Amount: t.signedAmount(), walletID: wallet.ID})
+	e.legs = append(e.legs, &walletLeg{trans: t, wallet: wallet})
+}
+
+// systemLeg adds a posting against one of the system accounts.
+func (e *JournalEntry) systemLeg(code string, amount int64) {
+	e.Postings = append(e.Postings, &Posting{Amount: amount, accountCode: code})
+}
+
+// post writes the journal entry, its postings and the wallet transactions in
+// tx. Every wallet taking part must already be locked with SELECT ... FOR UPDATE.
+// The cached wallets.balance column is only ever changed here, by the same
+// amount as the postings on the wallet's account.
+func (e *JournalEntry) post(ctx context.Context, tx bun.Tx) error {
+	var sum int64
+	for _, p := range e.Postings {
+		sum += p.Amount
+	}
+	if sum != 0 || len(e.Postings) < 2 {
+		return ErrorUnbalancedEntry
+	}
+	// amounts in different currencies cannot balance each other, money
+	// changes currency through two entries against an FX account instead
+	for _, leg := range e.legs {
+		if leg.wallet.Currency != e.Currency {
+			return ErrorCurrencyMismatch
+		}
+		if !e.manual {
+			if err := leg.wallet.allows(leg.trans.Entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range e.Postings {
+		account, err := ledgerAccount(ctx, tx, p.walletID, p.accountCode)
+		if err != nil {
+			return err
+		}
+		p.AccountID = account.ID
+	}
+
+	if _, err := tx.NewInsert().Model(e).Exec(ctx); err != nil {
+		return err
+	}
+	for _, p := range e.Postings {
+		p.JournalEntryID = e.ID
+	}
+	if _, err := tx.NewInsert().Model(&e.Postings).Exec(ctx); err != nil {
+		return err
+	}
+
+	for _, leg := range e.legs {
+		amount := leg.trans.signedAmount()
+		// the row lock taken here orders the legs of a wallet, so the
+		// balance it returns is exactly the one this transaction leaves
+		var balance int64
+		err := tx.NewRaw(`
+			UPDATE wallets
+			SET balance = balance + ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND balance - held + ? >= 0
+			RETURNING balance`,
+			amount, leg.wallet.ID, amount).Scan(ctx, &balance)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorInsuffcientBalance
+		}
+		if err != nil {
+			return err
+		}
+		leg.wallet.Balance = balance
+		leg.wallet.AvailableBalance = leg.wallet.Available()
+		leg.trans.BalanceAfter = balance
+
+		leg.trans.JournalEntryID = e.ID
+		leg.trans.WalletID = leg.wallet.ID
+		leg.trans.UserID = leg.wallet.UserID
+		leg.trans.Currency = leg.wallet.Currency
+		leg.trans.Wallet = leg.wallet
+
+		// the wallet lock also orders the hash chain; created_at is set
+		// here, to the precision Postgres keeps, because it is hashed
+		if leg.trans.PrevHash, err = chainHead(ctx, tx, leg.wallet.ID); err != nil {
+			return err
+		}
+		leg.trans.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		leg.trans.Hash = leg.trans.ComputeHash()
+		if _, err := tx.NewInsert().Model(leg.trans).Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ledgerAccount(ctx context.Context, tx bun.Tx, walletID int64, code string) (*Account, error) {
+	account := new(Account)
+	query := tx.NewSelect().Model(account)
+	if walletID != 0 {
+		query = query.Where("wallet_id = ?", walletID)
+	} else {
+		query = query.Where("code = ?", code)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorAccountNotFound, err)
+	}
+	return account, nil
+}
+
+func walletAccount(walletID int64) *Account {
+	return &Account{
+		Code:     fmt.Sprintf("wallet:%d", walletID),
+		Name:     fmt.Sprintf("Wallet %d", walletID),
+		Type:     AccountTypeWallet,
+		WalletID: walletID,
+	}
+}
+
+// EnsureSystemAccounts creates the system ledger accounts if they are missing.
+func EnsureSystemAccounts(ctx context.Context, db bun.IDB) error {
+	accounts := make([]*Account, 0, len(systemAccountNames))
+	for code, name := range systemAccountNames {
+		accounts = append(accounts, &Account{Code: code, Name: name, Type: AccountTypeSystem})
+	}
+	_, err := db.NewInsert().
+		Model(&accounts).
+		On("CONFLICT (code) DO NOTHING").
+		Exec(ctx)
+	return err
+}
+
+// LedgerBalance derives the wallet balance from the postings on its ledger
+// account. It always equals Wallet.Balance, which is only a cached copy.
+func (w *Wallet) LedgerBalance(ctx context.Context, db bun.IDB) (int64, error) {
+	var balance int64
+	err := db.NewSelect().
+		TableExpr("postings AS p").
+		ColumnExpr("COALESCE(SUM(p.amount), 0)").
+		Join("JOIN accounts AS a ON a.id = p.account_id").
+		Where("a.wallet_id = ?", w.ID).
+		Scan(ctx, &balance)
+	return balance, err
+}
@@ -0,0 +1,279 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorLimitExceeded = errors.New("limit exceeded")
+var ErrorInvalidLimit = errors.New("a limit needs either a tier or a user_id and no negative values")
+var ErrorInvalidTier = errors.New("tier is required")
+
+// DefaultTier is the tier every user starts in.
+const DefaultTier = "standard"
+
+// Limits a transaction can run into.
+const (
+	LimitSingleDebit           = "single_debit"
+	LimitDailyDebit            = "daily_debit"
+	LimitMonthlyDebit          = "monthly_debit"
+	LimitTransactionsPerMinute = "transactions_per_minute"
+)
+
+// TransactionLimit caps the debits of every user of a tier, or of one user,
+// in one currency. A limit set for a user replaces the one of their tier.
+// Zero means unlimited. Daily and monthly totals reset at midnight UTC.
+type TransactionLimit struct {
+	ID                       int64     `bun:",pk,autoincrement" json:"id"`
+	Tier                     string    `bun:",notnull,default:'',unique:transaction_limits_scope" json:"tier,omitempty"`
+	UserID                   int64     `bun:",notnull,default:0,unique:transaction_limits_scope" json:"user_id,omitempty"`
+	Currency                 string    `bun:",notnull,unique:transaction_limits_scope" json:"currency"`
+	MaxSingleDebit           int64     `bun:",notnull,default:0" json:"max_single_debit"`  // in minor units
+	MaxDailyDebit            int64     `bun:",notnull,default:0" json:"max_daily_debit"`   // in minor units
+	MaxMonthlyDebit          int64     `bun:",notnull,default:0" json:"max_monthly_debit"` // in minor units
+	MaxTransactionsPerMinute int64     `bun:",notnull,default:0" json:"max_transactions_per_minute"`
+	CreatedAt                time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	UpdatedAt                time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"updated_at"`
+}
+
+// LimitExceededError names the limit a transaction ran into and what is left
+// of it. It matches ErrorLimitExceeded with errors.Is.
+type LimitExceededError struct {
+	Limit     string    `json:"limit"`
+	Currency  string    `json:"currency,omitempty"`
+	Max       int64     `json:"max"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at,omitzero"`
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded, %d remaining", e.Limit, e.Max, e.Remaining)
+}
+
+func (e *LimitExceededError) Unwrap() error {
+	return ErrorLimitExceeded
+}
+
+// userLimit returns the limit that applies to the user in currency, or nil
+// when there is none.
+func userLimit(ctx context.Context, db bun.IDB, userId int64, currency string) (*TransactionLimit, error) {
+	limit := new(TransactionLimit)
+	err := db.NewSelect().
+		Model(limit).
+		Where("currency = ?", currency).
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("user_id = ?", userId).
+				WhereOr("user_id = 0 AND tier = (SELECT tier FROM users WHERE id = ?)", userId)
+		}).
+		OrderExpr("user_id DESC").
+		Limit(1).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return limit, nil
+}
+
+// checkLimits refuses a transaction of the user that would go over their
+// limits. It locks the user row for the rest of tx, before any wallet, so
+// the user's transactions are counted one at a time and concurrent ones
+// cannot both fit into the same allowance.
+func checkLimits(ctx context.Context, tx bun.Tx, userId int64, currency, entry string, amount int64) error {
+	limit, err := userLimit(ctx, tx, userId, currency)
+	if err != nil || limit == nil {
+		return err
+	}
+	if _, err := lockUser(ctx, tx, userId); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if limit.MaxTransactionsPerMinute > 0 {
+		// transfers and conversions received are not made by the user, and
+		// fees come with the transaction they are charged on
+		count, err := tx.NewSelect().
+			Model((*Transaction)(nil)).
+			Join("JOIN wallets AS w ON w.id = transaction.wallet_id").
+			Where("w.user_id = ?", userId).
+			Where("transaction.created_at > ?", now.Add(-time.Minute)).
+			Where("NOT (transaction.entry = 'credit' AND transaction.transfer_ref IS NOT NULL)").
+			Where("transaction.fee_for IS NULL").
+			Count(ctx)
+		if err != nil {
+			return err
+		}
+		if int64(count) >= limit.MaxTransactionsPerMinute {
+			return &LimitExceededError{
+				Limit:    LimitTransactionsPerMinute,
+				Max:      limit.MaxTransactionsPerMinute,
+				ResetsAt: now.Add(time.Minute),
+			}
+		}
+	}
+
+	if entry != "debit" {
+		return nil
+	}
+	if limit.MaxSingleDebit > 0 && amount > limit.MaxSingleDebit {
+		return &LimitExceededError{
+			Limit:     LimitSingleDebit,
+			Currency:  currency,
+			Max:       limit.MaxSingleDebit,
+			Remaining: limit.MaxSingleDebit,
+		}
+	}
+
+	debitedSince := func(since time.Time) (int64, error) {
+		var total int64
+		err := tx.NewSelect().
+			Model((*Transaction)(nil)).
+			ColumnExpr("COALESCE(SUM(transaction.amount), 0)").
+			Join("JOIN wallets AS w ON w.id = transaction.wallet_id").
+			Where("w.user_id = ? AND w.currency = ?", userId, currency).
+			Where("transaction.entry = 'debit' AND transaction.created_at >= ?", since).
+			Where("transaction.fee_for IS NULL").
+			Scan(ctx, &total)
+		return total, err
+	}
+	periods := []struct {
+		name  string
+		max   int64
+		start time.Time
+		end   time.Time
+	}{
+		{LimitDailyDebit, limit.MaxDailyDebit, now.Truncate(24 * time.Hour), now.Truncate(24*time.Hour).AddDate(0, 0, 1)},
+		{LimitMonthlyDebit, limit.MaxMonthlyDebit, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, p := range periods {
+		if p.max == 0 {
+			continue
+		}
+		debited, err := debitedSince(p.start)
+		if err != nil {
+			return err
+		}
+		if debited+amount > p.max {
+			return &LimitExceededError{
+				Limit:     p.name,
+				Currency:  currency,
+				Max:       p.max,
+				Remaining: max(p.max-debited, 0),
+				ResetsAt:  p.end,
+			}
+		}
+	}
+	return nil
+}
+
+// ListLimits returns every configured limit, tier limits first.
+func ListLimits(db *postgres.PostgresDB) ([]*TransactionLimit, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	limits := []*TransactionLimit{}
+	err := db.DB.NewSelect().
+		Model(&limits).
+		Order("user_id ASC", "tier ASC", "currency ASC").
+		Scan(ctx)
+	return limits, err
+}
+
+// SaveLimit creates l or replaces the limit with the same tier or user and
+// currency.
+func (l *TransactionLimit) SaveLimit(db *postgres.PostgresDB, actor Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if (l.Tier == "") == (l.UserID == 0) ||
+		l.MaxSingleDebit < 0 || l.MaxDailyDebit < 0 || l.MaxMonthlyDebit < 0 || l.MaxTransactionsPerMinute < 0 {
+		return ErrorInvalidLimit
+	}
+	currency, err := NormalizeCurrency(l.Currency)
+	if err != nil {
+		return err
+	}
+	l.Currency = currency
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if l.UserID != 0 {
+			exists, err := tx.NewSelect().Model((*User)(nil)).Where("id = ?", l.UserID).Exists(ctx)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return ErrorUserNotFound
+			}
+		}
+
+		_, err := tx.NewInsert().
+			Model(l).
+			On("CONFLICT (tier, user_id, currency) DO UPDATE").
+			Set("max_single_debit = EXCLUDED.max_single_debit").
+			Set("max_daily_debit = EXCLUDED.max_daily_debit").
+			Set("max_monthly_debit = EXCLUDED.max_monthly_debit").
+			Set("max_transactions_per_minute = EXCLUDED.max_transactions_per_minute").
+			Set("updated_at = CURRENT_TIMESTAMP").
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return actor.audit(ctx, tx, AuditLimitSave, "transaction_limit", l.ID, map[string]any{
+			"tier":                        l.Tier,
+			"user_id":                     l.UserID,
+			"currency":                    l.Currency,
+			"max_single_debit":            l.MaxSingleDebit,
+			"max_daily_debit":             l.MaxDailyDebit,
+			"max_monthly_debit":           l.MaxMonthlyDebit,
+			"max_transactions_per_minute": l.MaxTransactionsPerMinute,
+		})
+	})
+}
+
+// SetUserTier moves the user to tier, whose limits apply from their next
+// transaction.
+func SetUserTier(db *postgres.PostgresDB, actor Actor, userId int64, tier string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tier = strings.TrimSpace(tier)
+	if tier == "" {
+		return nil, ErrorInvalidTier
+	}
+
+	var user *User
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var err error
+		user, err = lockUser(ctx, tx, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		previous := user.Tier
+		user.Tier = tier
+		if _, err := tx.NewUpdate().Model(user).Column("tier").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+		return actor.audit(ctx, tx, AuditUserTier, "user", user.ID, map[string]any{
+			"from": previous,
+			"to":   tier,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
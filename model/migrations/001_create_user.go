@@ -48,6 +48,9 @@ func RunMigrations(db *bun.DB) error {
 	if err := migrator.Init(ctx); err != nil {
 		return err
 	}
+	if err := padMigrationNames(ctx, db); err != nil {
+		return err
+	}
 	group, err := migrator.Migrate(ctx)
 
 	if err != nil {
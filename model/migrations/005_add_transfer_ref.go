@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if _, err := tx.ExecContext(ctx, `ALTER TABLE transactions ADD COLUMN IF NOT EXISTS transfer_ref VARCHAR`); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS transactions_transfer_ref_idx ON transactions (transfer_ref)`)
+			return err
+		})
+	}, func(ctx context.Context, db *bun.DB) error {
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			_, err := tx.ExecContext(ctx, `ALTER TABLE transactions DROP COLUMN IF EXISTS transfer_ref`)
+			return err
+		})
+	})
+}
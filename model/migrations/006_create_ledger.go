@@ -0,0 +1,109 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewCreateTable().
+					Model((*model.Account)(nil)).
+					IfNotExists().
+					ForeignKey(`(wallet_id) REFERENCES wallets (id)`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				if _, err := tx.NewCreateTable().
+					Model((*model.JournalEntry)(nil)).
+					IfNotExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				if _, err := tx.NewCreateTable().
+					Model((*model.Posting)(nil)).
+					IfNotExists().
+					ForeignKey(`(journal_entry_id) REFERENCES journal_entries (id)`).
+					ForeignKey(`(account_id) REFERENCES accounts (id)`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS postings_account_id_idx ON postings (account_id)`); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE transactions ADD COLUMN IF NOT EXISTS journal_entry_id BIGINT REFERENCES journal_entries (id)`); err != nil {
+					return err
+				}
+
+				// the postings of a journal entry must sum to zero once the
+				// transaction that wrote them commits
+				if _, err := tx.ExecContext(ctx, `
+					CREATE OR REPLACE FUNCTION check_journal_entry_balanced() RETURNS trigger AS $$
+					BEGIN
+						IF (SELECT COALESCE(SUM(amount), 0) FROM postings WHERE journal_entry_id = NEW.journal_entry_id) <> 0 THEN
+							RAISE EXCEPTION 'journal entry % is not balanced', NEW.journal_entry_id;
+						END IF;
+						RETURN NULL;
+					END;
+					$$ LANGUAGE plpgsql`); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `
+					CREATE CONSTRAINT TRIGGER postings_balanced
+					AFTER INSERT ON postings
+					DEFERRABLE INITIALLY DEFERRED
+					FOR EACH ROW EXECUTE FUNCTION check_journal_entry_balanced()`); err != nil {
+					return err
+				}
+
+				if err := model.EnsureSystemAccounts(ctx, tx); err != nil {
+					return err
+				}
+
+				// give existing wallets a ledger account and book their current
+				// balance as an opening entry against the funding source
+				if _, err := tx.ExecContext(ctx, `
+					INSERT INTO accounts (code, name, type, wallet_id)
+					SELECT 'wallet:' || id, 'Wallet ' || id, 'wallet', id FROM wallets
+					ON CONFLICT DO NOTHING`); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `
+					INSERT INTO journal_entries (reference, description, currency)
+					SELECT 'opening:' || id, 'opening balance', currency FROM wallets WHERE balance <> 0`); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `
+					INSERT INTO postings (journal_entry_id, account_id, amount)
+					SELECT je.id, a.id, w.balance
+					FROM wallets w
+					JOIN accounts a ON a.wallet_id = w.id
+					JOIN journal_entries je ON je.reference = 'opening:' || w.id
+					UNION ALL
+					SELECT je.id, f.id, -w.balance
+					FROM wallets w
+					JOIN accounts f ON f.code = 'funding_source'
+					JOIN journal_entries je ON je.reference = 'opening:' || w.id`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE transactions DROP COLUMN IF EXISTS journal_entry_id`); err != nil {
+					return err
+				}
+				for _, m := range []interface{}{(*model.Posting)(nil), (*model.JournalEntry)(nil), (*model.Account)(nil)} {
+					if _, err := tx.NewDropTable().Model(m).IfExists().Exec(ctx); err != nil {
+						return err
+					}
+				}
+				_, err := tx.ExecContext(ctx, `DROP FUNCTION IF EXISTS check_journal_entry_balanced()`)
+				return err
+			})
+		},
+	)
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewCreateTable().
+					Model((*model.OutboxEvent)(nil)).
+					IfNotExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (id) WHERE sent_at IS NULL`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewDropTable().
+					Model((*model.OutboxEvent)(nil)).
+					IfExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				return nil
+			})
+		},
+	)
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewCreateTable().
+					Model((*model.Export)(nil)).
+					IfNotExists().
+					ForeignKey(`(user_id) REFERENCES users (id)`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				return nil
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewDropTable().
+					Model((*model.Export)(nil)).
+					IfExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				return nil
+			})
+		},
+	)
+}
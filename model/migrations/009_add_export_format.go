@@ -0,0 +1,17 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE exports ADD COLUMN IF NOT EXISTS format VARCHAR NOT NULL DEFAULT 'xlsx'`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE exports DROP COLUMN IF EXISTS format`)
+		return err
+	})
+}
@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		// supports keyset pagination over a wallet's history, newest first
+		_, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS transactions_wallet_created_idx ON transactions (wallet_id, created_at DESC, id DESC)`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS transactions_wallet_created_idx`)
+		return err
+	})
+}
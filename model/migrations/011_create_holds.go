@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE wallets ADD COLUMN IF NOT EXISTS held BIGINT NOT NULL DEFAULT 0 CHECK (held >= 0)`); err != nil {
+					return err
+				}
+				if _, err := tx.NewCreateTable().
+					Model((*model.Hold)(nil)).
+					IfNotExists().
+					ForeignKey(`("wallet_id") REFERENCES "wallets" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS holds_open_expiry_idx ON holds (expires_at) WHERE status = 'open'`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewDropTable().
+					Model((*model.Hold)(nil)).
+					IfExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `ALTER TABLE wallets DROP COLUMN IF EXISTS held`)
+				return err
+			})
+		},
+	)
+}
@@ -0,0 +1,56 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if _, err := tx.ExecContext(ctx, `ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reversal_of BIGINT REFERENCES transactions (id)`); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS transactions_reversal_of_idx ON transactions (reversal_of) WHERE reversal_of IS NOT NULL`); err != nil {
+				return err
+			}
+
+			// the ledger is append-only: mistakes are corrected with
+			// compensating entries, never by editing history
+			if _, err := tx.ExecContext(ctx, `
+				CREATE OR REPLACE FUNCTION reject_ledger_change() RETURNS trigger AS $$
+				BEGIN
+					RAISE EXCEPTION '% rows are append-only', TG_TABLE_NAME;
+				END;
+				$$ LANGUAGE plpgsql`); err != nil {
+				return err
+			}
+			for _, table := range []string{"journal_entries", "postings", "transactions"} {
+				if _, err := tx.ExecContext(ctx, `DROP TRIGGER IF EXISTS `+table+`_append_only ON `+table); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `
+					CREATE TRIGGER `+table+`_append_only
+					BEFORE UPDATE OR DELETE ON `+table+`
+					FOR EACH ROW EXECUTE FUNCTION reject_ledger_change()`); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}, func(ctx context.Context, db *bun.DB) error {
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			for _, table := range []string{"journal_entries", "postings", "transactions"} {
+				if _, err := tx.ExecContext(ctx, `DROP TRIGGER IF EXISTS `+table+`_append_only ON `+table); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, `DROP FUNCTION IF EXISTS reject_ledger_change()`); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `ALTER TABLE transactions DROP COLUMN IF EXISTS reversal_of`)
+			return err
+		})
+	})
+}
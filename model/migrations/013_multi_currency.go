@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			// one wallet per user and currency instead of one per user
+			if _, err := tx.ExecContext(ctx, `ALTER TABLE wallets DROP CONSTRAINT IF EXISTS wallets_user_id_key`); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `
+				DO $$
+				BEGIN
+					IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'wallets_user_currency') THEN
+						ALTER TABLE wallets ADD CONSTRAINT wallets_user_currency UNIQUE (user_id, currency);
+					END IF;
+				END
+				$$`); err != nil {
+				return err
+			}
+
+			// every wallet so far is NGN, so the default back-fills existing
+			// rows without touching the append-only triggers
+			for _, table := range []string{"transactions", "journal_entries", "holds"} {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'NGN'`); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE `+table+` ALTER COLUMN currency DROP DEFAULT`); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}, func(ctx context.Context, db *bun.DB) error {
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			for _, table := range []string{"transactions", "journal_entries", "holds"} {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE `+table+` DROP COLUMN IF EXISTS currency`); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, `ALTER TABLE wallets DROP CONSTRAINT IF EXISTS wallets_user_currency`); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `ALTER TABLE wallets ADD CONSTRAINT wallets_user_id_key UNIQUE (user_id)`)
+			return err
+		})
+	})
+}
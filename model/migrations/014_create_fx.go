@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, m := range []interface{}{(*model.ExchangeRate)(nil), (*model.FXQuote)(nil), (*model.Conversion)(nil)} {
+					if _, err := tx.NewCreateTable().
+						Model(m).
+						IfNotExists().
+						Exec(ctx); err != nil {
+						return err
+					}
+				}
+				// adds the fx_position and fx_income accounts
+				return model.EnsureSystemAccounts(ctx, tx)
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, m := range []interface{}{(*model.Conversion)(nil), (*model.FXQuote)(nil), (*model.ExchangeRate)(nil)} {
+					if _, err := tx.NewDropTable().
+						Model(m).
+						IfExists().
+						Exec(ctx); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	)
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewCreateTable().
+					Model((*model.RefreshToken)(nil)).
+					IfNotExists().
+					ForeignKey(`("user_id") REFERENCES "users" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id)`); err != nil {
+					return err
+				}
+				_, err := tx.NewCreateTable().
+					Model((*model.RevokedToken)(nil)).
+					IfNotExists().
+					Exec(ctx)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewDropTable().
+					Model((*model.RevokedToken)(nil)).
+					IfExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.NewDropTable().
+					Model((*model.RefreshToken)(nil)).
+					IfExists().
+					Exec(ctx)
+				return err
+			})
+		},
+	)
+}
@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ`); err != nil {
+					return err
+				}
+				// accounts created before verification existed keep
+				// being able to debit their wallets
+				if _, err := tx.ExecContext(ctx, `UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL`); err != nil {
+					return err
+				}
+				if _, err := tx.NewCreateTable().
+					Model((*model.UserToken)(nil)).
+					IfNotExists().
+					ForeignKey(`("user_id") REFERENCES "users" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS user_tokens_user_purpose_idx ON user_tokens (user_id, purpose)`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewDropTable().
+					Model((*model.UserToken)(nil)).
+					IfExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at`)
+				return err
+			})
+		},
+	)
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR`,
+					`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ`,
+					`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_counter BIGINT NOT NULL DEFAULT 0`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				if _, err := tx.NewCreateTable().
+					Model((*model.RecoveryCode)(nil)).
+					IfNotExists().
+					ForeignKey(`("user_id") REFERENCES "users" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS recovery_codes_user_idx ON recovery_codes (user_id)`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewDropTable().
+					Model((*model.RecoveryCode)(nil)).
+					IfExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `ALTER TABLE users DROP COLUMN IF EXISTS totp_secret, DROP COLUMN IF EXISTS totp_enabled_at, DROP COLUMN IF EXISTS totp_last_counter`)
+				return err
+			})
+		},
+	)
+}
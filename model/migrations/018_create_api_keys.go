@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewCreateTable().
+					Model((*model.APIKey)(nil)).
+					IfNotExists().
+					ForeignKey(`("user_id") REFERENCES "users" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS api_keys_user_idx ON api_keys (user_id)`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewDropTable().
+				Model((*model.APIKey)(nil)).
+				IfExists().
+				Exec(ctx)
+			return err
+		},
+	)
+}
@@ -0,0 +1,61 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR NOT NULL DEFAULT 'user'`,
+					`ALTER TABLE wallets ADD COLUMN IF NOT EXISTS status VARCHAR NOT NULL DEFAULT 'active'`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				if _, err := tx.NewCreateTable().
+					Model((*model.AuditLog)(nil)).
+					IfNotExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				for _, stmt := range []string{
+					`CREATE INDEX IF NOT EXISTS audit_logs_actor_idx ON audit_logs (actor_id)`,
+					`CREATE INDEX IF NOT EXISTS audit_logs_target_idx ON audit_logs (target_type, target_id)`,
+					// the audit log is as append-only as the ledger
+					`DROP TRIGGER IF EXISTS audit_logs_append_only ON audit_logs`,
+					`CREATE TRIGGER audit_logs_append_only
+						BEFORE UPDATE OR DELETE ON audit_logs
+						FOR EACH ROW EXECUTE FUNCTION reject_ledger_change()`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				// books manual adjustments
+				return model.EnsureSystemAccounts(ctx, tx)
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewDropTable().
+					Model((*model.AuditLog)(nil)).
+					IfExists().
+					Exec(ctx); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE wallets DROP COLUMN IF EXISTS status`); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `ALTER TABLE users DROP COLUMN IF EXISTS role`)
+				return err
+			})
+		},
+	)
+}
@@ -0,0 +1,27 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE wallets DROP CONSTRAINT IF EXISTS wallets_status_check`); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `
+					ALTER TABLE wallets ADD CONSTRAINT wallets_status_check
+					CHECK (status IN ('active', 'frozen', 'debit_blocked', 'closed'))`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.ExecContext(ctx, `ALTER TABLE wallets DROP CONSTRAINT IF EXISTS wallets_status_check`)
+			return err
+		},
+	)
+}
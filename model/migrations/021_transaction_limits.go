@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS tier VARCHAR NOT NULL DEFAULT 'standard'`); err != nil {
+					return err
+				}
+				// the unique constraint on (tier, user_id, currency) comes
+				// with the model
+				// the limit checks sum transactions per wallet, which
+				// transactions_wallet_created_idx already covers
+				_, err := tx.NewCreateTable().
+					Model((*model.TransactionLimit)(nil)).
+					IfNotExists().
+					Exec(ctx)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`DROP TABLE IF EXISTS transaction_limits`,
+					`ALTER TABLE users DROP COLUMN IF EXISTS tier`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	)
+}
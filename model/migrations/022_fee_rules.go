@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.ExecContext(ctx, `ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fee_for VARCHAR`); err != nil {
+					return err
+				}
+				_, err := tx.NewCreateTable().
+					Model((*model.FeeRule)(nil)).
+					IfNotExists().
+					Exec(ctx)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`DROP TABLE IF EXISTS fee_rules`,
+					`ALTER TABLE transactions DROP COLUMN IF EXISTS fee_for`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	)
+}
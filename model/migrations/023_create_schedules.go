@@ -0,0 +1,45 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewCreateTable().
+					Model((*model.Schedule)(nil)).
+					IfNotExists().
+					ForeignKey(`("user_id") REFERENCES "users" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				if _, err := tx.NewCreateTable().
+					Model((*model.ScheduleRun)(nil)).
+					IfNotExists().
+					ForeignKey(`("schedule_id") REFERENCES "schedules" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				for _, stmt := range []string{
+					`CREATE INDEX IF NOT EXISTS schedules_due_idx ON schedules (next_run_at) WHERE status = 'active'`,
+					`CREATE INDEX IF NOT EXISTS schedule_runs_due_idx ON schedule_runs (next_attempt_at) WHERE status IN ('pending', 'retrying')`,
+					`CREATE INDEX IF NOT EXISTS schedules_user_idx ON schedules (user_id)`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS schedule_runs, schedules`)
+			return err
+		},
+	)
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				// existing rows get the running sum of their wallet, in the
+				// order the wallet lock applied them; the append-only trigger
+				// is lifted for the backfill alone
+				for _, stmt := range []string{
+					`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS balance_after BIGINT`,
+					`ALTER TABLE transactions DISABLE TRIGGER transactions_append_only`,
+					`UPDATE transactions t
+					SET balance_after = r.balance_after
+					FROM (
+						SELECT id, SUM(CASE WHEN entry = 'credit' THEN amount ELSE -amount END)
+							OVER (PARTITION BY wallet_id ORDER BY id) AS balance_after
+						FROM transactions
+					) r
+					WHERE t.id = r.id`,
+					`ALTER TABLE transactions ENABLE TRIGGER transactions_append_only`,
+					`ALTER TABLE transactions ALTER COLUMN balance_after SET NOT NULL`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				_, err := tx.ExecContext(ctx, `ALTER TABLE transactions DROP COLUMN IF EXISTS balance_after`)
+				return err
+			})
+		},
+	)
+}
@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.NewCreateTable().
+				Model((*model.ReconciliationRun)(nil)).
+				IfNotExists().
+				Exec(ctx)
+			return err
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS reconciliation_runs`)
+			return err
+		},
+	)
+}
@@ -0,0 +1,92 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS prev_hash VARCHAR`,
+					`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS hash VARCHAR`,
+					`CREATE INDEX IF NOT EXISTS transactions_wallet_id_idx ON transactions (wallet_id, id)`,
+					`ALTER TABLE transactions DISABLE TRIGGER transactions_append_only`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+
+				// chain the existing rows of each wallet in id order, which is
+				// the order the wallet lock appended them in
+				heads := map[int64]string{}
+				var last int64
+				for {
+					var batch []*model.Transaction
+					err := tx.NewSelect().
+						Model(&batch).
+						Column("id", "wallet_id", "entry", "amount", "currency", "trans_id", "transfer_ref",
+							"journal_entry_id", "reversal_of", "fee_for", "balance_after", "created_at").
+						Where("id > ?", last).
+						Order("id ASC").
+						Limit(1000).
+						Scan(ctx)
+					if err != nil {
+						return err
+					}
+					for _, t := range batch {
+						t.PrevHash = heads[t.WalletID]
+						t.Hash = t.ComputeHash()
+						heads[t.WalletID] = t.Hash
+						_, err := tx.NewUpdate().
+							Model(t).
+							Column("prev_hash", "hash").
+							WherePK().
+							Exec(ctx)
+						if err != nil {
+							return err
+						}
+						last = t.ID
+					}
+					if len(batch) < 1000 {
+						break
+					}
+				}
+
+				for _, stmt := range []string{
+					`ALTER TABLE transactions ENABLE TRIGGER transactions_append_only`,
+					`ALTER TABLE transactions ALTER COLUMN hash SET NOT NULL`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				_, err := tx.NewCreateTable().
+					Model((*model.LedgerCheckpoint)(nil)).
+					IfNotExists().
+					Exec(ctx)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`DROP TABLE IF EXISTS ledger_checkpoints`,
+					`DROP INDEX IF EXISTS transactions_wallet_id_idx`,
+					`ALTER TABLE transactions DROP COLUMN IF EXISTS hash`,
+					`ALTER TABLE transactions DROP COLUMN IF EXISTS prev_hash`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	)
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				// the unique constraint on (user_id, key) comes with the model
+				if _, err := tx.NewCreateTable().
+					Model((*model.IdempotencyKey)(nil)).
+					IfNotExists().
+					ForeignKey(`("user_id") REFERENCES "users" ("id") ON DELETE CASCADE`).
+					Exec(ctx); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at)`)
+				return err
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			_, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS idempotency_keys`)
+			return err
+		},
+	)
+}
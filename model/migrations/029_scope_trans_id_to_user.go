@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				// trans_id becomes unique per user instead of across all of
+				// them, so one user can no longer take another's id; the
+				// append-only trigger is lifted for the backfill alone
+				for _, stmt := range []string{
+					`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS user_id BIGINT`,
+					`ALTER TABLE transactions DISABLE TRIGGER transactions_append_only`,
+					`UPDATE transactions t SET user_id = w.user_id FROM wallets w WHERE w.id = t.wallet_id`,
+					`ALTER TABLE transactions ENABLE TRIGGER transactions_append_only`,
+					`ALTER TABLE transactions ALTER COLUMN user_id SET NOT NULL`,
+					// a fresh database got the new constraint and never the
+					// old one from 004, which builds the table from the model
+					`
+					DO $$
+					BEGIN
+						IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'transactions_trans_id_key') THEN
+							ALTER TABLE transactions DROP CONSTRAINT transactions_trans_id_key;
+						END IF;
+						IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'transactions_user_trans_id') THEN
+							ALTER TABLE transactions ADD CONSTRAINT transactions_user_trans_id UNIQUE (user_id, trans_id);
+						END IF;
+					END
+					$$`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_user_trans_id`,
+					`ALTER TABLE transactions ADD CONSTRAINT transactions_trans_id_key UNIQUE (trans_id)`,
+					`ALTER TABLE transactions DROP COLUMN IF EXISTS user_id`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	)
+}
@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	migrates.MustRegister(
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				// hold and conversion references become unique per user like
+				// trans_id, so one user can no longer take another's
+				for _, stmt := range []string{
+					`ALTER TABLE holds ADD COLUMN IF NOT EXISTS user_id BIGINT`,
+					`UPDATE holds h SET user_id = w.user_id FROM wallets w WHERE w.id = h.wallet_id AND h.user_id IS NULL`,
+					`ALTER TABLE holds ALTER COLUMN user_id SET NOT NULL`,
+					// tables built from the current models on a fresh database
+					// already have the new constraints and not the old ones
+					`
+					DO $$
+					BEGIN
+						IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'holds_reference_key') THEN
+							ALTER TABLE holds DROP CONSTRAINT holds_reference_key;
+						END IF;
+						IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'holds_user_reference') THEN
+							ALTER TABLE holds ADD CONSTRAINT holds_user_reference UNIQUE (user_id, reference);
+						END IF;
+						IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'conversions_reference_key') THEN
+							ALTER TABLE conversions DROP CONSTRAINT conversions_reference_key;
+						END IF;
+						IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'conversions_user_reference') THEN
+							ALTER TABLE conversions ADD CONSTRAINT conversions_user_reference UNIQUE (user_id, reference);
+						END IF;
+					END
+					$$`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(ctx context.Context, db *bun.DB) error {
+			return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				for _, stmt := range []string{
+					`ALTER TABLE conversions DROP CONSTRAINT IF EXISTS conversions_user_reference`,
+					`ALTER TABLE conversions ADD CONSTRAINT conversions_reference_key UNIQUE (reference)`,
+					`ALTER TABLE holds DROP CONSTRAINT IF EXISTS holds_user_reference`,
+					`ALTER TABLE holds ADD CONSTRAINT holds_reference_key UNIQUE (reference)`,
+					`ALTER TABLE holds DROP COLUMN IF EXISTS user_id`,
+				} {
+					if _, err := tx.ExecContext(ctx, stmt); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	)
+}
@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// padMigrationNames renames the migrations a database recorded before the
+// files were zero padded.
+//
+// bun names a migration after the number its file starts with and orders
+// migrations by comparing those names as strings, so "10" would sort
+// before "2". The files are therefore named 001_, 002_ and so on. A database
+// migrated while they were still named 1_, 2_ has "1", "2" recorded in
+// bun_migrations, and without the rename every migration would look new to
+// it and run again.
+func padMigrationNames(ctx context.Context, db *bun.DB) error {
+	_, err := db.ExecContext(ctx, `UPDATE bun_migrations SET name = lpad(name, 3, '0') WHERE name ~ '^[0-9]{1,2}$'`)
+	return err
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+const (
+	EventTypeTransaction  = "transaction"
+	EventTypeTransfer     = "transfer"
+	EventTypeWalletStatus = "wallet_status"
+
+	EventTypeReconciliationMismatch = "reconciliation_mismatch"
+)
+
+// OutboxEvent is an event waiting to be published to Kafka. It is written in
+// the same database transaction as the change it describes and only marked
+// as sent once the broker has acknowledged it, so events are delivered at
+// least once. Consumers dedupe on EventID.
+type OutboxEvent struct {
+	ID        int64           `bun:",pk,autoincrement" json:"id"`
+	EventID   string          `bun:",unique,notnull" json:"event_id"`
+	EventType string          `bun:",notnull" json:"event_type"`
+	Key       string          `json:"key"`
+	Payload   json.RawMessage `bun:"type:jsonb,notnull" json:"payload"`
+	Attempts  int             `bun:",notnull,default:0" json:"attempts"`
+	LastError string          `bun:",nullzero" json:"last_error,omitempty"`
+	CreatedAt time.Time       `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	SentAt    time.Time       `bun:",nullzero" json:"sent_at"`
+}
+
+// enqueueEvent stores event in the outbox as part of tx.
+func enqueueEvent(ctx context.Context, tx bun.Tx, eventID, eventType, key string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.NewInsert().Model(&OutboxEvent{
+		EventID:   eventID,
+		EventType: eventType,
+		Key:       key,
+		Payload:   payload,
+	}).Exec(ctx)
+	return err
+}
+
+// PublishPendingEvents hands up to limit unsent outbox events to send, oldest
+// first, and marks each one sent once send returns without error. It stops at
+// the first failure, which is returned, so events keep their order. Rows are
+// locked with SKIP LOCKED so concurrent relays never publish the same batch.
+func PublishPendingEvents(ctx context.Context, db *postgres.PostgresDB, limit int, send func(*OutboxEvent) error) (int, error) {
+	sent := 0
+	var sendErr error
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var events []*OutboxEvent
+		err := tx.NewSelect().
+			Model(&events).
+			Where("sent_at IS NULL").
+			Order("id ASC").
+			Limit(limit).
+			For("UPDATE SKIP LOCKED").
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if sendErr = send(event); sendErr != nil {
+				_, err := tx.NewUpdate().
+					Model(event).
+					Set("attempts = attempts + 1").
+					Set("last_error = ?", sendErr.Error()).
+					WherePK().
+					Exec(ctx)
+				return err
+			}
+
+			_, err := tx.NewUpdate().
+				Model(event).
+				Set("sent_at = CURRENT_TIMESTAMP").
+				Set("attempts = attempts + 1").
+				Set("last_error = NULL").
+				WherePK().
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+			sent++
+		}
+		return nil
+	})
+	if err != nil {
+		return sent, err
+	}
+	return sent, sendErr
+}
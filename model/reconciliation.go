@@ -0,0 +1,156 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/uptrace/bun"
+)
+
+// reconciliation run sources
+const (
+	ReconcileSourceJob = "job"
+	ReconcileSourceCLI = "cli"
+)
+
+// ReconciliationRun records one check of every wallet balance against the
+// sum of the wallet's transactions, with the wallets that did not match.
+type ReconciliationRun struct {
+	ID             int64         `bun:",pk,autoincrement" json:"id"`
+	Source         string        `bun:",notnull" json:"source"` // job or cli
+	AutoFreeze     bool          `bun:",notnull,default:false" json:"auto_freeze"`
+	WalletsChecked int           `bun:",notnull" json:"wallets_checked"`
+	Mismatches     int           `bun:",notnull" json:"mismatches"`
+	Drifts         []WalletDrift `bun:",type:jsonb" json:"drifts"`
+	StartedAt      time.Time     `bun:",notnull" json:"started_at"`
+	FinishedAt     time.Time     `bun:",notnull" json:"finished_at"`
+}
+
+// WalletDrift is a wallet whose cached balance differs from the sum of its
+// transactions.
+type WalletDrift struct {
+	WalletID int64  `json:"wallet_id"`
+	UserID   int64  `json:"user_id"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`   // the wallet status when it was checked
+	Balance  int64  `json:"balance"`  // wallets.balance
+	Expected int64  `json:"expected"` // the sum of the wallet's transactions
+	Drift    int64  `json:"drift"`    // balance - expected
+	Frozen   bool   `json:"frozen"`   // frozen by this run
+}
+
+// Reconcile recomputes the balance of every wallet from its transactions and
+// records the wallets whose wallets.balance drifted from it. Each mismatch is
+// published to Kafka, and with autoFreeze the wallet is frozen first unless
+// it is frozen or closed already. The freeze reason names the run.
+func Reconcile(ctx context.Context, db *postgres.PostgresDB, source string, autoFreeze bool) (*ReconciliationRun, error) {
+	run := &ReconciliationRun{
+		Source:     source,
+		AutoFreeze: autoFreeze,
+		Drifts:     []WalletDrift{},
+		StartedAt:  time.Now().UTC(),
+	}
+
+	// a balance and its transaction are always written together, so both
+	// reads share one snapshot and a posting in flight is never a drift
+	opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	err := db.DB.RunInTx(ctx, opts, func(ctx context.Context, tx bun.Tx) error {
+		count, err := tx.NewSelect().Model((*Wallet)(nil)).Count(ctx)
+		if err != nil {
+			return err
+		}
+		run.WalletsChecked = count
+
+		return tx.NewRaw(`
+			SELECT w.id AS wallet_id, w.user_id, w.currency, w.status, w.balance,
+				COALESCE(t.expected, 0) AS expected,
+				w.balance - COALESCE(t.expected, 0) AS drift
+			FROM wallets w
+			LEFT JOIN (
+				SELECT wallet_id, SUM(CASE WHEN entry = 'credit' THEN amount ELSE -amount END) AS expected
+				FROM transactions
+				GROUP BY wallet_id
+			) t ON t.wallet_id = w.id
+			WHERE w.balance <> COALESCE(t.expected, 0)
+			ORDER BY w.id`).Scan(ctx, &run.Drifts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	run.Mismatches = len(run.Drifts)
+
+	// the run is recorded before any wallet is frozen, so every freeze can
+	// name the run that found the drift and no freeze is left without one
+	run.FinishedAt = run.StartedAt
+	if _, err := db.DB.NewInsert().Model(run).Returning("*").Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	if autoFreeze {
+		for i := range run.Drifts {
+			drift := &run.Drifts[i]
+			if drift.Status == WalletStatusFrozen || drift.Status == WalletStatusClosed {
+				continue
+			}
+			reason := fmt.Sprintf("reconciliation run %d: balance is off its transactions by %d", run.ID, drift.Drift)
+			_, err := SetWalletStatus(db, SystemActor, drift.WalletID, WalletStatusFrozen, reason)
+			if err != nil && !errors.Is(err, ErrorWalletStatusUnchanged) && !errors.Is(err, ErrorWalletClosed) {
+				return nil, fmt.Errorf("failed to freeze wallet %d: %w", drift.WalletID, err)
+			}
+			drift.Frozen = err == nil
+		}
+	}
+
+	run.FinishedAt = time.Now().UTC()
+	err = db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewUpdate().Model(run).Column("drifts", "finished_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+		for _, drift := range run.Drifts {
+			event := kafka.ReconciliationMismatchEvent{
+				EventID:   uuid.New().String(),
+				RunID:     run.ID,
+				UserID:    drift.UserID,
+				WalletID:  drift.WalletID,
+				Currency:  drift.Currency,
+				Balance:   drift.Balance,
+				Expected:  drift.Expected,
+				Drift:     drift.Drift,
+				Frozen:    drift.Frozen,
+				Timestamp: run.FinishedAt,
+			}
+			if err := enqueueEvent(ctx, tx, event.EventID, EventTypeReconciliationMismatch, strconv.FormatInt(drift.UserID, 10), event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// ListReconciliationRuns returns a page of reconciliation runs, newest first,
+// and the number of runs.
+func ListReconciliationRuns(db *postgres.PostgresDB, pagination utils.Pagination) ([]*ReconciliationRun, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runs := []*ReconciliationRun{}
+	total, err := db.DB.NewSelect().
+		Model(&runs).
+		Order("id DESC").
+		Limit(pagination.Limit).
+		Offset(pagination.Offset).
+		ScanAndCount(ctx)
+	return runs, total, err
+}
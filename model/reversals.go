@@ -0,0 +1,131 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorTransactionNotFound = errors.New("transaction not found")
+var ErrorAlreadyReversed = errors.New("transaction has already been fully reversed")
+var ErrorReversalExceedsOriginal = errors.New("reversal amount exceeds the amount left to reverse")
+var ErrorNotReversible = errors.New("transaction cannot be reversed")
+
+// Reversal undoes all or part of an earlier transaction by booking a
+// compensating transaction in the opposite direction. The original rows are
+// never changed; the link is kept in Transaction.ReversalOf.
+type Reversal struct {
+	TransactionID int64        `json:"transaction_id"` // the transaction being reversed
+	Amount        int64        `json:"amount"`         // in minor units, defaults to everything not reversed yet
+	Reason        string       `json:"reason,omitempty"`
+	Reference     string       `json:"reference"`
+	Reversal      *Transaction `json:"reversal"`
+	Remaining     int64        `json:"remaining"` // amount of the original still reversible
+}
+
+func (rv *Reversal) Reverse(db *postgres.PostgresDB, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if rv.Reference == "" {
+		rv.Reference = uuid.New().String()
+	}
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		exists, err := tx.NewSelect().
+			Model((*Transaction)(nil)).
+			Where("user_id = ? AND trans_id = ?", userId, "reversal:"+rv.Reference).
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrorDuplicateTransaction
+		}
+
+		original := new(Transaction)
+		err = tx.NewSelect().
+			Model(original).
+			Join("JOIN wallets AS w ON w.id = transaction.wallet_id").
+			Where("transaction.id = ? AND w.user_id = ?", rv.TransactionID, userId).
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorTransactionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// reversing a credit debits the wallet
+		if original.Entry == "credit" {
+			if err := requireVerified(ctx, tx, userId); err != nil {
+				return err
+			}
+		}
+
+		// the wallet lock also serialises concurrent reversals of the same
+		// transaction, so the remaining amount below cannot go stale
+		wallet, err := lockWallet(ctx, tx, original.WalletID)
+		if err != nil {
+			return err
+		}
+
+		// transfer legs move money between two users and reversals are
+		// themselves final, so neither can be undone from one wallet. Fees
+		// are refunded by an admin adjustment
+		if original.TransferRef != "" || original.ReversalOf != 0 || original.FeeFor != "" {
+			return ErrorNotReversible
+		}
+
+		var reversed int64
+		err = tx.NewSelect().
+			Model((*Transaction)(nil)).
+			ColumnExpr("COALESCE(SUM(amount), 0)").
+			Where("reversal_of = ?", original.ID).
+			Scan(ctx, &reversed)
+		if err != nil {
+			return err
+		}
+
+		remaining := original.Amount - reversed
+		if remaining <= 0 {
+			return ErrorAlreadyReversed
+		}
+		if rv.Amount == 0 {
+			rv.Amount = remaining
+		}
+		if rv.Amount > remaining {
+			return ErrorReversalExceedsOriginal
+		}
+
+		entry := "credit"
+		if original.Entry == "credit" {
+			entry = "debit"
+		}
+		rv.Reversal = &Transaction{
+			Entry:      entry,
+			Amount:     rv.Amount,
+			TransID:    "reversal:" + rv.Reference,
+			ReversalOf: original.ID,
+		}
+
+		description := fmt.Sprintf("reversal of transaction %d", original.ID)
+		if rv.Reason != "" {
+			description += ": " + rv.Reason
+		}
+		je := newJournalEntry(userReference("reversal", userId, rv.Reference), description)
+		je.walletLeg(rv.Reversal, wallet)
+		je.systemLeg(AccountFundingSource, -rv.Reversal.signedAmount())
+		if err := je.post(ctx, tx); err != nil {
+			return err
+		}
+
+		rv.Remaining = remaining - rv.Amount
+		return rv.Reversal.enqueueEvent(ctx, tx, userId)
+	})
+}
@@ -0,0 +1,586 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/uptrace/bun"
+)
+
+var ErrorScheduleNotFound = errors.New("schedule not found")
+var ErrorInvalidSchedule = errors.New("invalid schedule")
+var ErrorScheduleStatus = errors.New("schedule cannot be changed from its current status")
+
+const (
+	ScheduleStatusActive    = "active"
+	ScheduleStatusPaused    = "paused"
+	ScheduleStatusCancelled = "cancelled"
+	ScheduleStatusCompleted = "completed" // a one-off schedule that has run
+	ScheduleStatusFailed    = "failed"    // stopped by insufficient funds under the fail policy
+)
+
+const (
+	FrequencyOnce    = "once"
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+	FrequencyCron    = "cron"
+)
+
+// What a scheduled occurrence does when the wallet cannot cover it.
+const (
+	OnInsufficientSkip  = "skip"  // record the occurrence as skipped and wait for the next one
+	OnInsufficientRetry = "retry" // try again every RetryInterval, at most MaxRetries times
+	OnInsufficientFail  = "fail"  // record the occurrence as failed and stop the schedule
+)
+
+const (
+	RunStatusPending   = "pending"
+	RunStatusRetrying  = "retrying"
+	RunStatusSucceeded = "succeeded"
+	RunStatusSkipped   = "skipped"
+	RunStatusFailed    = "failed"
+)
+
+const (
+	maxScheduleRetries           = 10
+	defaultScheduleRetryInterval = 3600 // seconds
+	minScheduleRetryInterval     = 60   // seconds
+)
+
+// Schedule is a standing order of the user: a credit, debit or transfer
+// posted on every occurrence of its frequency, all in UTC. Entry is
+// "transfer" for transfers, which go to RecipientEmail or RecipientWalletID.
+type Schedule struct {
+	ID                  int64      `bun:",pk,autoincrement" json:"schedule_id"`
+	UserID              int64      `bun:",notnull" json:"-"`
+	Entry               string     `bun:",notnull" json:"entry"`  // credit, debit or transfer
+	Amount              int64      `bun:",notnull" json:"amount"` // in minor units of Currency
+	Currency            string     `bun:",notnull" json:"currency"`
+	RecipientEmail      string     `bun:",nullzero" json:"recipient_email,omitempty"`
+	RecipientWalletID   int64      `bun:",nullzero" json:"recipient_wallet_id,omitempty"`
+	Frequency           string     `bun:",notnull" json:"frequency"` // once, daily, weekly, monthly or cron
+	Cron                string     `bun:",nullzero" json:"cron,omitempty"`
+	StartAt             time.Time  `bun:",nullzero" json:"start_at,omitzero"` // first occurrence, anchors the time of day and day of month
+	NextRunAt           *time.Time `bun:",nullzero" json:"next_run_at"`       // nil once the schedule has ended
+	Status              string     `bun:",notnull,default:'active'" json:"status"`
+	OnInsufficientFunds string     `bun:",notnull,default:'skip'" json:"on_insufficient_funds"`
+	MaxRetries          int        `bun:",notnull,default:0" json:"max_retries"`
+	RetryInterval       int64      `bun:",notnull,default:3600" json:"retry_interval"` // seconds between retries
+	CreatedAt           time.Time  `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	UpdatedAt           time.Time  `bun:",nullzero,notnull,default:current_timestamp" json:"updated_at"`
+}
+
+// ScheduleRun is one occurrence of a schedule. Its TransID is derived from
+// the schedule and the occurrence, so posting it again is always detected
+// as a duplicate.
+type ScheduleRun struct {
+	ID            int64     `bun:",pk,autoincrement" json:"run_id"`
+	ScheduleID    int64     `bun:",notnull,unique:schedule_runs_occurrence" json:"schedule_id"`
+	Occurrence    time.Time `bun:",notnull,unique:schedule_runs_occurrence" json:"occurrence"`
+	Status        string    `bun:",notnull,default:'pending'" json:"status"`
+	Attempts      int       `bun:",notnull,default:0" json:"attempts"`
+	TransID       string    `bun:",notnull" json:"trans_id"`
+	Error         string    `bun:",nullzero" json:"error,omitempty"`
+	NextAttemptAt time.Time `bun:",nullzero" json:"next_attempt_at,omitzero"`
+	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"created_at"`
+	UpdatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"updated_at"`
+
+	Schedule *Schedule `bun:"rel:belongs-to,join:schedule_id=id" json:"-"`
+}
+
+// nextRun returns the first occurrence strictly after after, or false when
+// the schedule has none left.
+func (s *Schedule) nextRun(after time.Time) (time.Time, bool) {
+	after = after.UTC()
+	start := s.StartAt.UTC()
+	switch s.Frequency {
+	case FrequencyOnce:
+		return start, start.After(after)
+	case FrequencyDaily, FrequencyWeekly:
+		step := 24 * time.Hour
+		if s.Frequency == FrequencyWeekly {
+			step *= 7
+		}
+		if start.After(after) {
+			return start, true
+		}
+		return start.Add((after.Sub(start)/step + 1) * step), true
+	case FrequencyMonthly:
+		months := (after.Year()-start.Year())*12 + int(after.Month()-start.Month())
+		for i := max(months, 0); ; i++ {
+			if t := addMonths(start, i); t.After(after) {
+				return t, true
+			}
+		}
+	case FrequencyCron:
+		c, err := utils.ParseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		// the start, when there is one, is the earliest time that can match
+		if !start.IsZero() && start.Add(-time.Minute).After(after) {
+			after = start.Add(-time.Minute)
+		}
+		next := c.Next(after)
+		return next, !next.IsZero()
+	}
+	return time.Time{}, false
+}
+
+// addMonths moves t n months on, keeping its day of month where that month
+// has it and using the last day of the month otherwise.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(t.Day(), lastDay)-1)
+}
+
+func (s *Schedule) validate(now time.Time) error {
+	switch s.Entry {
+	case "credit", "debit":
+		if s.RecipientEmail != "" || s.RecipientWalletID != 0 {
+			return fmt.Errorf("%w: only transfers have a recipient", ErrorInvalidSchedule)
+		}
+	case "transfer":
+		if (s.RecipientEmail == "") == (s.RecipientWalletID == 0) {
+			return fmt.Errorf("%w: a transfer needs either a recipient_email or a recipient_wallet_id", ErrorInvalidSchedule)
+		}
+	default:
+		return fmt.Errorf("%w: entry must be credit, debit or transfer", ErrorInvalidSchedule)
+	}
+	if s.Amount <= 0 {
+		return fmt.Errorf("%w: amount must be greater than zero", ErrorInvalidSchedule)
+	}
+
+	switch s.Frequency {
+	case FrequencyOnce, FrequencyDaily, FrequencyWeekly, FrequencyMonthly:
+		if s.StartAt.IsZero() {
+			return fmt.Errorf("%w: start_at is required", ErrorInvalidSchedule)
+		}
+		if s.Cron != "" {
+			return fmt.Errorf("%w: only cron schedules have a cron expression", ErrorInvalidSchedule)
+		}
+	case FrequencyCron:
+		if _, err := utils.ParseCron(s.Cron); err != nil {
+			return fmt.Errorf("%w: %v", ErrorInvalidSchedule, err)
+		}
+	default:
+		return fmt.Errorf("%w: frequency must be once, daily, weekly, monthly or cron", ErrorInvalidSchedule)
+	}
+	if s.Frequency == FrequencyOnce && !s.StartAt.After(now) {
+		return fmt.Errorf("%w: start_at must be in the future", ErrorInvalidSchedule)
+	}
+
+	switch s.OnInsufficientFunds {
+	case "":
+		s.OnInsufficientFunds = OnInsufficientSkip
+	case OnInsufficientSkip, OnInsufficientFail:
+	case OnInsufficientRetry:
+		if s.MaxRetries < 1 || s.MaxRetries > maxScheduleRetries {
+			return fmt.Errorf("%w: max_retries must be between 1 and %d", ErrorInvalidSchedule, maxScheduleRetries)
+		}
+		if s.RetryInterval == 0 {
+			s.RetryInterval = defaultScheduleRetryInterval
+		}
+		if s.RetryInterval < minScheduleRetryInterval {
+			return fmt.Errorf("%w: retry_interval must be at least %d seconds", ErrorInvalidSchedule, minScheduleRetryInterval)
+		}
+	default:
+		return fmt.Errorf("%w: on_insufficient_funds must be skip, retry or fail", ErrorInvalidSchedule)
+	}
+	if s.OnInsufficientFunds != OnInsufficientRetry {
+		s.MaxRetries = 0
+		s.RetryInterval = defaultScheduleRetryInterval
+	}
+	return nil
+}
+
+// CreateSchedule validates s and stores it as an active schedule of the user.
+func (s *Schedule) CreateSchedule(db *postgres.PostgresDB, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	if err := s.validate(now); err != nil {
+		return err
+	}
+	if _, err := GetUserWallet(db, userId, s.Currency); err != nil {
+		return err
+	}
+
+	next, ok := s.nextRun(now)
+	if !ok {
+		return fmt.Errorf("%w: the schedule never runs", ErrorInvalidSchedule)
+	}
+	s.UserID = userId
+	s.Status = ScheduleStatusActive
+	s.NextRunAt = &next
+	_, err := db.DB.NewInsert().Model(s).Returning("*").Exec(ctx)
+	return err
+}
+
+// ListSchedules returns the schedules of the user, newest first.
+func ListSchedules(db *postgres.PostgresDB, userId int64, pagination utils.Pagination) ([]*Schedule, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	schedules := []*Schedule{}
+	total, err := db.DB.NewSelect().
+		Model(&schedules).
+		Where("user_id = ?", userId).
+		Order("id DESC").
+		Limit(pagination.Limit).
+		Offset(pagination.Offset).
+		ScanAndCount(ctx)
+	return schedules, total, err
+}
+
+// GetSchedule loads a schedule owned by userId.
+func GetSchedule(db *postgres.PostgresDB, id, userId int64) (*Schedule, error) {
+	schedule := new(Schedule)
+	if err := db.SelectSingleEntity("id = ? AND user_id = ?", schedule, id, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrorScheduleNotFound
+		}
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// ListScheduleRuns returns the run history of a schedule of the user,
+// newest first.
+func ListScheduleRuns(db *postgres.PostgresDB, id, userId int64, pagination utils.Pagination) ([]*ScheduleRun, int, error) {
+	if _, err := GetSchedule(db, id, userId); err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	runs := []*ScheduleRun{}
+	total, err := db.DB.NewSelect().
+		Model(&runs).
+		Where("schedule_id = ?", id).
+		Order("occurrence DESC").
+		Limit(pagination.Limit).
+		Offset(pagination.Offset).
+		ScanAndCount(ctx)
+	return runs, total, err
+}
+
+// SetScheduleStatus pauses, resumes or cancels a schedule of the user. A
+// resumed schedule continues with its next occurrence after now; the ones
+// missed while it was paused are not run.
+func SetScheduleStatus(db *postgres.PostgresDB, id, userId int64, status string) (*Schedule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	schedule := new(Schedule)
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().
+			Model(schedule).
+			Where("id = ? AND user_id = ?", id, userId).
+			For("UPDATE").
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorScheduleNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case status == ScheduleStatusPaused && schedule.Status == ScheduleStatusActive:
+		case status == ScheduleStatusCancelled && (schedule.Status == ScheduleStatusActive || schedule.Status == ScheduleStatusPaused):
+			schedule.NextRunAt = nil
+		case status == ScheduleStatusActive && schedule.Status == ScheduleStatusPaused:
+			if next, ok := schedule.nextRun(time.Now()); ok {
+				schedule.NextRunAt = &next
+			} else {
+				status, schedule.NextRunAt = ScheduleStatusCompleted, nil
+			}
+		default:
+			return ErrorScheduleStatus
+		}
+
+		schedule.Status = status
+		_, err = tx.NewUpdate().
+			Model(schedule).
+			Column("status", "next_run_at").
+			Set("updated_at = CURRENT_TIMESTAMP").
+			WherePK().
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// RunDueSchedules records a run for every active schedule whose next
+// occurrence is due at now and moves the schedule on to the following one,
+// then executes every run that is due. It returns the number of runs
+// executed. Occurrences missed while the job was not running are not made
+// up for: the one the schedule was waiting on is still run, late, and the
+// schedule then moves on to its first occurrence after now.
+func RunDueSchedules(ctx context.Context, db *postgres.PostgresDB, now time.Time, batchSize int) (int, error) {
+	for {
+		dispatched, err := dispatchSchedules(ctx, db, now, batchSize)
+		if err != nil {
+			return 0, err
+		}
+		if dispatched < batchSize {
+			break
+		}
+	}
+
+	executed := 0
+	for {
+		var runs []*ScheduleRun
+		err := db.DB.NewSelect().
+			Model(&runs).
+			Where("status IN (?)", bun.In([]string{RunStatusPending, RunStatusRetrying})).
+			Where("next_attempt_at <= ?", now).
+			Order("next_attempt_at ASC", "id ASC").
+			Limit(batchSize).
+			Scan(ctx)
+		if err != nil {
+			return executed, err
+		}
+
+		done := 0
+		for _, run := range runs {
+			ran, err := executeRun(ctx, db, run.ID, now)
+			if err != nil {
+				log.Printf("schedule run %d: %v", run.ID, err)
+				continue
+			}
+			if ran {
+				executed++
+				done++
+			}
+		}
+		// runs that errored stay due; leave them for the next tick
+		if len(runs) < batchSize || done == 0 {
+			return executed, nil
+		}
+	}
+}
+
+func dispatchSchedules(ctx context.Context, db *postgres.PostgresDB, now time.Time, batchSize int) (int, error) {
+	dispatched := 0
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var schedules []*Schedule
+		err := tx.NewSelect().
+			Model(&schedules).
+			Where("status = ? AND next_run_at <= ?", ScheduleStatusActive, now).
+			Order("next_run_at ASC").
+			Limit(batchSize).
+			For("UPDATE SKIP LOCKED").
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range schedules {
+			occurrence := s.NextRunAt.UTC()
+			run := &ScheduleRun{
+				ScheduleID:    s.ID,
+				Occurrence:    occurrence,
+				Status:        RunStatusPending,
+				TransID:       fmt.Sprintf("schedule:%d:%d", s.ID, occurrence.Unix()),
+				NextAttemptAt: now,
+			}
+			_, err := tx.NewInsert().
+				Model(run).
+				On("CONFLICT (schedule_id, occurrence) DO NOTHING").
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+
+			if next, ok := s.nextRun(now); ok {
+				s.NextRunAt = &next
+			} else {
+				s.NextRunAt = nil
+				s.Status = ScheduleStatusCompleted
+			}
+			_, err = tx.NewUpdate().
+				Model(s).
+				Column("status", "next_run_at").
+				Set("updated_at = CURRENT_TIMESTAMP").
+				WherePK().
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		dispatched = len(schedules)
+		return nil
+	})
+	return dispatched, err
+}
+
+// executeRun posts the run with runID if it is still due. The run row is
+// locked while the posting is made so two workers cannot attempt it at the
+// same time, and the deterministic TransID stops a repeated attempt after a
+// crash from posting twice.
+func executeRun(ctx context.Context, db *postgres.PostgresDB, runID int64, now time.Time) (bool, error) {
+	ran := false
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		run := new(ScheduleRun)
+		err := tx.NewSelect().
+			Model(run).
+			Relation("Schedule").
+			Where("schedule_run.id = ?", runID).
+			Where("schedule_run.status IN (?)", bun.In([]string{RunStatusPending, RunStatusRetrying})).
+			Where("schedule_run.next_attempt_at <= ?", now).
+			For("UPDATE OF schedule_run SKIP LOCKED").
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ran = true
+
+		s := run.Schedule
+		run.Attempts++
+		run.Error = ""
+		switch s.Status {
+		case ScheduleStatusPaused, ScheduleStatusCancelled:
+			run.Status, run.Error = RunStatusSkipped, "schedule is "+s.Status
+		default:
+			err = s.post(db, run.TransID)
+			switch {
+			case err == nil:
+				run.Status = RunStatusSucceeded
+			case errors.Is(err, ErrorDuplicateTransaction):
+				// an earlier attempt that crashed before the run was updated
+				// posted on the schedule's own wallet; anything else holding
+				// the id is not this run
+				posted, err := s.posted(ctx, tx, run.TransID)
+				if err != nil {
+					return err
+				}
+				if posted {
+					run.Status = RunStatusSucceeded
+				} else {
+					run.Status, run.Error = RunStatusFailed, "trans_id "+run.TransID+" is used by another transaction"
+				}
+			case errors.Is(err, ErrorInsuffcientBalance):
+				run.Error = err.Error()
+				if err := run.insufficientFunds(ctx, tx, s, now); err != nil {
+					return err
+				}
+			case finalScheduleError(err):
+				run.Status, run.Error = RunStatusFailed, err.Error()
+			default:
+				// most likely the database, try again on the next tick
+				return err
+			}
+		}
+
+		_, err = tx.NewUpdate().
+			Model(run).
+			Column("status", "attempts", "error", "next_attempt_at").
+			Set("updated_at = CURRENT_TIMESTAMP").
+			WherePK().
+			Exec(ctx)
+		return err
+	})
+	return ran, err
+}
+
+// post makes the transaction or transfer of one occurrence through the same
+// path as the API, so limits, fees and wallet checks all apply.
+func (s *Schedule) post(db *postgres.PostgresDB, transID string) error {
+	if s.Entry == "transfer" {
+		transfer := &Transfer{
+			Reference:         transID,
+			Amount:            s.Amount,
+			Currency:          s.Currency,
+			RecipientEmail:    s.RecipientEmail,
+			RecipientWalletID: s.RecipientWalletID,
+		}
+		return transfer.CreateTransfer(db, s.UserID)
+	}
+	trx := &Transaction{
+		Entry:    s.Entry,
+		Amount:   s.Amount,
+		Currency: s.Currency,
+		TransID:  transID,
+	}
+	return trx.CreateTransaction(db, s.UserID)
+}
+
+// posted reports whether the transaction of an occurrence with transID is on
+// the schedule's wallet. A transfer is found by its debit leg.
+func (s *Schedule) posted(ctx context.Context, tx bun.Tx, transID string) (bool, error) {
+	if s.Entry == "transfer" {
+		transID += ReferenceSeparator + "debit"
+	}
+	return tx.NewSelect().
+		Model((*Transaction)(nil)).
+		Join("JOIN wallets AS w ON w.id = transaction.wallet_id").
+		Where("transaction.trans_id = ?", transID).
+		Where("w.user_id = ? AND w.currency = ?", s.UserID, s.Currency).
+		Exists(ctx)
+}
+
+// insufficientFunds applies the schedule's policy to a run its wallet could
+// not cover.
+func (run *ScheduleRun) insufficientFunds(ctx context.Context, tx bun.Tx, s *Schedule, now time.Time) error {
+	switch s.OnInsufficientFunds {
+	case OnInsufficientRetry:
+		if run.Attempts <= s.MaxRetries {
+			run.Status = RunStatusRetrying
+			run.NextAttemptAt = now.Add(time.Duration(s.RetryInterval) * time.Second)
+			return nil
+		}
+		run.Status = RunStatusFailed
+	case OnInsufficientFail:
+		run.Status = RunStatusFailed
+		_, err := tx.NewUpdate().
+			Model((*Schedule)(nil)).
+			Set("status = ?", ScheduleStatusFailed).
+			Set("next_run_at = NULL").
+			Set("updated_at = CURRENT_TIMESTAMP").
+			Where("id = ? AND status = ?", s.ID, ScheduleStatusActive).
+			Exec(ctx)
+		return err
+	default:
+		run.Status = RunStatusSkipped
+	}
+	return nil
+}
+
+// finalScheduleError reports whether err will not go away by trying the
+// same occurrence again.
+func finalScheduleError(err error) bool {
+	for _, final := range []error{
+		ErrorWalletNotFound,
+		ErrorEmailNotVerified,
+		ErrorWalletFrozen,
+		ErrorWalletDebitBlocked,
+		ErrorWalletClosed,
+		ErrorLimitExceeded,
+		ErrorRecipientNotFound,
+		ErrorCurrencyMismatch,
+		ErrorSelfTransfer,
+	} {
+		if errors.Is(err, final) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/uptrace/bun"
+)
+
+var ErrorInvalidRefreshToken = errors.New("invalid or expired refresh token")
+var ErrorRefreshTokenReused = errors.New("refresh token has already been used")
+
+// RefreshTokenTTL is how long a refresh token can be exchanged for a new
+// access token.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// RefreshToken is a long lived credential that is exchanged for a new access
+// token. Only a hash of the token is stored. Every exchange revokes the token
+// and issues its successor in the same family; presenting a revoked token
+// again means it was stolen, so the whole family is revoked.
+type RefreshToken struct {
+	ID         int64     `bun:",pk,autoincrement" json:"-"`
+	UserID     int64     `bun:",notnull" json:"-"`
+	TokenHash  string    `bun:",unique,notnull" json:"-"`
+	FamilyID   string    `bun:",notnull" json:"-"` // shared by every rotation of one login
+	ExpiresAt  time.Time `bun:",notnull" json:"expires_at"`
+	RevokedAt  time.Time `bun:",nullzero" json:"-"`
+	ReplacedBy int64     `bun:",nullzero" json:"-"`
+	CreatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"-"`
+
+	Token string `bun:"-" json:"token"` // only set right after issuing
+}
+
+// RevokedToken is an access token revoked before its expiry, by jti. Rows
+// can be removed once ExpiresAt has passed since the token is invalid anyway.
+type RevokedToken struct {
+	JTI       string    `bun:"jti,pk" json:"jti"`
+	ExpiresAt time.Time `bun:",notnull" json:"expires_at"`
+}
+
+// IssueRefreshToken starts a new token family for a login.
+func IssueRefreshToken(db *postgres.PostgresDB, userId int64) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return issueRefreshToken(ctx, db.DB, userId, uuid.New().String())
+}
+
+func issueRefreshToken(ctx context.Context, db bun.IDB, userId int64, familyID string) (*RefreshToken, error) {
+	token, hash, err := utils.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	rt := &RefreshToken{
+		UserID:    userId,
+		TokenHash: hash,
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(RefreshTokenTTL),
+		Token:     token,
+	}
+	if _, err := db.NewInsert().Model(rt).Exec(ctx); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// RotateRefreshToken exchanges token for its successor and returns it.
+func RotateRefreshToken(db *postgres.PostgresDB, token string) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var next *RefreshToken
+	var reused bool
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		current := new(RefreshToken)
+		err := tx.NewSelect().
+			Model(current).
+			Where("token_hash = ?", utils.HashToken(token)).
+			For("UPDATE").
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrorInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		// the revocation has to be committed, so the error is only
+		// returned once the transaction is done
+		if !current.RevokedAt.IsZero() {
+			reused = true
+			return revokeTokenFamily(ctx, tx, current.FamilyID)
+		}
+		if !current.ExpiresAt.After(time.Now()) {
+			return ErrorInvalidRefreshToken
+		}
+
+		if next, err = issueRefreshToken(ctx, tx, current.UserID, current.FamilyID); err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().
+			Model(current).
+			Set("revoked_at = CURRENT_TIMESTAMP").
+			Set("replaced_by = ?", next.ID).
+			WherePK().
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, ErrorRefreshTokenReused
+	}
+	return next, nil
+}
+
+// RevokeRefreshToken ends the login token belongs to. Tokens of other users
+// are ignored.
+func RevokeRefreshToken(db *postgres.PostgresDB, token string, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := db.DB.NewUpdate().
+		Model((*RefreshToken)(nil)).
+		Set("revoked_at = CURRENT_TIMESTAMP").
+		Where("revoked_at IS NULL").
+		Where("family_id IN (?)", db.DB.NewSelect().
+			Model((*RefreshToken)(nil)).
+			Column("family_id").
+			Where("token_hash = ? AND user_id = ?", utils.HashToken(token), userId)).
+		Exec(ctx)
+	return err
+}
+
+func revokeTokenFamily(ctx context.Context, tx bun.Tx, familyID string) error {
+	_, err := tx.NewUpdate().
+		Model((*RefreshToken)(nil)).
+		Set("revoked_at = CURRENT_TIMESTAMP").
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Exec(ctx)
+	return err
+}
+
+// RevokeAccessToken adds an access token to the denylist until it expires.
+func RevokeAccessToken(db *postgres.PostgresDB, jti string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := db.DB.NewInsert().
+		Model(&RevokedToken{JTI: jti, ExpiresAt: expiresAt}).
+		On("CONFLICT (jti) DO NOTHING").
+		Exec(ctx)
+	return err
+}
+
+// IsAccessTokenRevoked reports whether the access token with jti was revoked.
+func IsAccessTokenRevoked(ctx context.Context, db *postgres.PostgresDB, jti string) (bool, error) {
+	return db.DB.NewSelect().
+		Model((*RevokedToken)(nil)).
+		Where("jti = ?", jti).
+		Exists(ctx)
+}
+
+// PurgeExpiredTokens deletes denylist entries, refresh tokens, email tokens
+// and idempotency keys that have expired and returns how many rows it
+// removed.
+func PurgeExpiredTokens(ctx context.Context, db *postgres.PostgresDB) (int64, error) {
+	var purged int64
+	for _, m := range []interface{}{(*RevokedToken)(nil), (*RefreshToken)(nil), (*UserToken)(nil), (*IdempotencyKey)(nil)} {
+		res, err := db.DB.NewDelete().
+			Model(m).
+			Where("expires_at < CURRENT_TIMESTAMP").
+			Exec(ctx)
+		if err != nil {
+			return purged, err
+		}
+		n, _ := res.RowsAffected()
+		purged += n
+	}
+	return purged, nil
+}
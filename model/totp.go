@@ -0,0 +1,358 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/uptrace/bun"
+)
+
+var ErrorTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+var ErrorTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+var ErrorInvalidTOTPCode = errors.New("invalid or already used two-factor code")
+var ErrorTOTPLocked = errors.New("too many invalid two-factor codes, try again later")
+
+const totpIssuer = "StreamLedger"
+
+// RecoveryCodeCount is how many recovery codes are issued when two-factor
+// authentication is enabled.
+const RecoveryCodeCount = 10
+
+// MaxTOTPFailures is how many wrong two-factor codes in a row lock the
+// user's second factor for TOTPLockout. Six digit codes are otherwise cheap
+// to guess from a stolen access token.
+const MaxTOTPFailures = 5
+
+const TOTPLockout = 15 * time.Minute
+
+// RecoveryCode is a single use code that stands in for a TOTP code when the
+// user lost their authenticator. Only a hash of the code is stored.
+type RecoveryCode struct {
+	ID        int64     `bun:",pk,autoincrement" json:"-"`
+	UserID    int64     `bun:",notnull" json:"-"`
+	CodeHash  string    `bun:",notnull" json:"-"`
+	UsedAt    time.Time `bun:",nullzero" json:"-"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"-"`
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// EnrollTOTP stores a new secret for the user. It is not used for sign in
+// until ConfirmTOTP proves the user's authenticator produces its codes.
+func EnrollTOTP(db *postgres.PostgresDB, userId int64) (*TOTPEnrollment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enrollment *TOTPEnrollment
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		user, err := lockUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabledAt != nil {
+			return ErrorTOTPAlreadyEnabled
+		}
+
+		secret, err := utils.NewTOTPSecret()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.NewUpdate().
+			Model(user).
+			Set("totp_secret = ?", secret).
+			Set("totp_last_counter = 0").
+			WherePK().
+			Exec(ctx); err != nil {
+			return err
+		}
+		enrollment = &TOTPEnrollment{
+			Secret: secret,
+			URI:    utils.TOTPURI(totpIssuer, user.Email, secret),
+		}
+		return nil
+	})
+	return enrollment, err
+}
+
+// ConfirmTOTP enables two-factor authentication once code matches the
+// enrolled secret and returns the recovery codes. They are not shown again.
+func ConfirmTOTP(db *postgres.PostgresDB, userId int64, code string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var codes []string
+	var failed error
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		user, err := lockUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabledAt != nil {
+			return ErrorTOTPAlreadyEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrorTOTPNotEnabled
+		}
+		err = guardSecondFactor(ctx, tx, user, func() error { return checkTOTP(ctx, tx, user, code) })
+		if errors.Is(err, ErrorInvalidTOTPCode) {
+			failed = err
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.NewUpdate().
+			Model(user).
+			Set("totp_enabled_at = CURRENT_TIMESTAMP").
+			WherePK().
+			Exec(ctx); err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(ctx, tx, userId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off. It takes a TOTP or a
+// recovery code so a stolen access token alone cannot do it.
+func DisableTOTP(db *postgres.PostgresDB, userId int64, code string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failed error
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		user, err := lockUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabledAt == nil {
+			return ErrorTOTPNotEnabled
+		}
+		err = guardSecondFactor(ctx, tx, user, func() error { return verifySecondFactor(ctx, tx, user, code) })
+		if errors.Is(err, ErrorInvalidTOTPCode) {
+			failed = err
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.NewUpdate().
+			Model(user).
+			Set("totp_secret = NULL").
+			Set("totp_enabled_at = NULL").
+			Set("totp_last_counter = 0").
+			WherePK().
+			Exec(ctx); err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().
+			Model((*RecoveryCode)(nil)).
+			Where("user_id = ?", userId).
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// VerifyTOTP checks a fresh TOTP code for a step-up. Recovery codes are not
+// accepted here.
+func VerifyTOTP(db *postgres.PostgresDB, userId int64, code string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failed error
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		user, err := lockUser(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabledAt == nil {
+			return ErrorTOTPNotEnabled
+		}
+		err = guardSecondFactor(ctx, tx, user, func() error { return checkTOTP(ctx, tx, user, code) })
+		if errors.Is(err, ErrorInvalidTOTPCode) {
+			failed = err
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// CompleteMFAChallenge finishes a sign in that SignIn answered with a
+// challenge. The challenge is used up even when code is wrong, so every
+// guess costs the caller a password sign in.
+func CompleteMFAChallenge(db *postgres.PostgresDB, challenge, code string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user *User
+	var failed error
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		userId, err := consumeUserToken(ctx, tx, challenge, TokenPurposeMFAChallenge)
+		if err != nil {
+			return err
+		}
+		if user, err = lockUser(ctx, tx, userId); err != nil {
+			return err
+		}
+		if user.TOTPEnabledAt == nil {
+			return ErrorTOTPNotEnabled
+		}
+		// the used challenge has to be committed, so a wrong code is
+		// only returned once the transaction is done
+		err = guardSecondFactor(ctx, tx, user, func() error { return verifySecondFactor(ctx, tx, user, code) })
+		if errors.Is(err, ErrorInvalidTOTPCode) {
+			failed = err
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return user, nil
+}
+
+func lockUser(ctx context.Context, tx bun.Tx, userId int64) (*User, error) {
+	user := new(User)
+	err := tx.NewSelect().
+		Model(user).
+		Where("id = ?", userId).
+		For("UPDATE").
+		Scan(ctx)
+	return user, err
+}
+
+// guardSecondFactor runs check, which tests a code of the locked user,
+// unless the user is locked out. Wrong codes are counted and MaxTOTPFailures
+// of them in a row start the lockout; a right one resets the count. The
+// count is written in tx, so callers commit it before they return
+// ErrorInvalidTOTPCode.
+func guardSecondFactor(ctx context.Context, tx bun.Tx, user *User, check func() error) error {
+	now := time.Now()
+	if user.TOTPLockedUntil != nil && user.TOTPLockedUntil.After(now) {
+		return ErrorTOTPLocked
+	}
+
+	err := check()
+	failures, lockedUntil := 0, (*time.Time)(nil)
+	switch {
+	case errors.Is(err, ErrorInvalidTOTPCode):
+		failures = user.TOTPFailures + 1
+		if failures >= MaxTOTPFailures {
+			until := now.Add(TOTPLockout)
+			failures, lockedUntil = 0, &until
+		}
+	case err != nil:
+		return err
+	case user.TOTPFailures == 0 && user.TOTPLockedUntil == nil:
+		return nil
+	}
+
+	user.TOTPFailures, user.TOTPLockedUntil = failures, lockedUntil
+	if _, uerr := tx.NewUpdate().
+		Model(user).
+		Set("totp_failures = ?", failures).
+		Set("totp_locked_until = ?", lockedUntil).
+		WherePK().
+		Exec(ctx); uerr != nil {
+		return uerr
+	}
+	return err
+}
+
+// checkTOTP accepts code when it matches a step later than the last one the
+// user used, so an observed code cannot be replayed.
+func checkTOTP(ctx context.Context, tx bun.Tx, user *User, code string) error {
+	counter, ok := utils.ValidateTOTP(user.TOTPSecret, strings.TrimSpace(code), time.Now())
+	if !ok || counter <= user.TOTPLastCounter {
+		return ErrorInvalidTOTPCode
+	}
+	user.TOTPLastCounter = counter
+	_, err := tx.NewUpdate().
+		Model(user).
+		Set("totp_last_counter = ?", counter).
+		WherePK().
+		Exec(ctx)
+	return err
+}
+
+// verifySecondFactor accepts a TOTP code or an unused recovery code.
+func verifySecondFactor(ctx context.Context, tx bun.Tx, user *User, code string) error {
+	err := checkTOTP(ctx, tx, user, code)
+	if !errors.Is(err, ErrorInvalidTOTPCode) {
+		return err
+	}
+
+	res, err := tx.NewUpdate().
+		Model((*RecoveryCode)(nil)).
+		Set("used_at = CURRENT_TIMESTAMP").
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, utils.HashToken(normalizeRecoveryCode(code))).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrorInvalidTOTPCode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes drops the user's recovery codes and issues new ones.
+func replaceRecoveryCodes(ctx context.Context, tx bun.Tx, userId int64) ([]string, error) {
+	if _, err := tx.NewDelete().
+		Model((*RecoveryCode)(nil)).
+		Where("user_id = ?", userId).
+		Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	rows := make([]*RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b)) // 16 characters
+		codes[i] = raw[:8] + "-" + raw[8:]
+		rows[i] = &RecoveryCode{UserID: userId, CodeHash: utils.HashToken(raw)}
+	}
+	if _, err := tx.NewInsert().Model(&rows).Exec(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
@@ -5,9 +5,14 @@ import (
 	"database/sql"
 	"errors"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
 	"github.com/lupppig/stream-ledger-api/repository/postgres"
 	"github.com/lupppig/stream-ledger-api/utils"
 	"github.com/uptrace/bun"
@@ -15,17 +20,51 @@ import (
 
 var ErrorInsuffcientBalance = errors.New("insufficient balance")
 var ErrorDuplicateTransaction = errors.New("duplicate transaction")
+var ErrorReservedReference = errors.New("references cannot contain ':'")
+
+// ReferenceSeparator joins the parts of the trans_ids the ledger makes
+// itself, like adjustment:<ref>, hold:<ref>:capture or <trans_id>:fee.
+// Client references may not contain it, so they can never take one of
+// those ids first.
+const ReferenceSeparator = ":"
+
+// ValidateReference checks a trans_id or reference a client chose.
+func ValidateReference(ref string) error {
+	if strings.Contains(ref, ReferenceSeparator) {
+		return ErrorReservedReference
+	}
+	return nil
+}
 
 type Transaction struct {
-	ID        int64     `bun:",pk,autoincrement" json:"transaction_id"`
-	WalletID  int64     `bun:"column:wallet_id,notnull" json:"wallet_id"`
-	Entry     string    `bun:"type:transaction_entry,notnull" json:"entry"` // credit or debit
-	Amount    int64     `bun:",notnull" json:"amount"`                      // in kobo
-	TransID   string    `bun:",unique" json:"trans_id"`
-	CreatedAt time.Time `bun:",nullzero,default:current_timestamp" json:"created_at"`
-	Wallet    *Wallet   `bun:"rel:belongs-to,join:wallet_id=id" json:"-"`
+	ID             int64     `bun:",pk,autoincrement" json:"transaction_id"`
+	WalletID       int64     `bun:"column:wallet_id,notnull" json:"wallet_id"`
+	UserID         int64     `bun:",notnull,unique:transactions_user_trans_id" json:"-"`
+	Entry          string    `bun:"type:transaction_entry,notnull" json:"entry"` // credit or debit
+	Amount         int64     `bun:",notnull" json:"amount"`                      // in minor units of Currency
+	Currency       string    `bun:",notnull" json:"currency"`                    // always the wallet currency
+	TransID        string    `bun:",unique:transactions_user_trans_id" json:"trans_id"`
+	TransferRef    string    `bun:",nullzero" json:"transfer_ref,omitempty"` // shared by both legs of a transfer
+	JournalEntryID int64     `bun:",nullzero" json:"journal_entry_id,omitempty"`
+	ReversalOf     int64     `bun:",nullzero" json:"reversal_of,omitempty"` // id of the transaction this one reverses
+	FeeFor         string    `bun:",nullzero" json:"fee_for,omitempty"`     // trans_id of the transaction this fee was charged on
+	BalanceAfter   int64     `bun:",notnull" json:"balance_after"`          // wallet balance once this transaction was applied
+	PrevHash       string    `bun:",nullzero" json:"prev_hash,omitempty"`   // hash of the wallet's previous transaction
+	Hash           string    `bun:",notnull" json:"hash"`                   // see ComputeHash
+	CreatedAt      time.Time `bun:",nullzero,default:current_timestamp" json:"created_at"`
+	Wallet         *Wallet   `bun:"rel:belongs-to,join:wallet_id=id" json:"-"`
+
+	// Fee is set when a fee was charged on the transaction at creation.
+	Fee *kafka.FeeBreakdown `bun:"-" json:"fee,omitempty"`
+	// Replayed is set when CreateTransaction found the transaction already
+	// recorded under its TransID and returned it instead.
+	Replayed bool `bun:"-" json:"-"`
 }
 
+// CreateTransaction posts t to the user's wallet in t.Currency. A trans_id
+// the user already used is a retry: when it asks for the same entry, amount
+// and currency t becomes the recorded transaction, with Replayed set, and
+// anything else is ErrorDuplicateTransaction.
 func (t *Transaction) CreateTransaction(db *postgres.PostgresDB, userId int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -35,67 +74,122 @@ func (t *Transaction) CreateTransaction(db *postgres.PostgresDB, userId int64) e
 		t.TransID = uuid.New().String()
 	}
 
-	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
-		if t.TransID != "" {
-			existing := new(Transaction)
-			err := tx.NewSelect().
-				Model(existing).
-				Where("trans_id = ?", t.TransID).
-				Scan(ctx)
-
-			if err == nil {
-				return ErrorDuplicateTransaction
-			} else if !errors.Is(err, sql.ErrNoRows) {
+	err := db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if replayed, err := t.replay(ctx, tx, userId); err != nil || replayed {
+			return err
+		}
+
+		if t.Entry == "debit" {
+			if err := requireVerified(ctx, tx, userId); err != nil {
 				return err
 			}
 		}
+		if err := checkLimits(ctx, tx, userId, t.Currency, t.Entry, t.Amount); err != nil {
+			return err
+		}
 
-		wallet := new(Wallet)
-		err := tx.NewSelect().
-			Model(wallet).
-			Where("user_id = ?", userId).
-			For("UPDATE").
-			Scan(ctx)
+		wallet, err := lockUserWallet(ctx, tx, userId, t.Currency)
 		if err != nil {
 			return err
 		}
+		// checked under the lock so a freeze takes effect for every posting
+		// that has not locked the wallet yet
+		if err := wallet.allows(t.Entry); err != nil {
+			return err
+		}
 
-		if t.Entry == "debit" && wallet.Balance < t.Amount {
-			return ErrorInsuffcientBalance
+		entry := newJournalEntry(userReference("transaction", userId, t.TransID), "wallet "+t.Entry)
+		entry.walletLeg(t, wallet)
+		entry.systemLeg(AccountFundingSource, -t.signedAmount())
+		fee, err := chargeFee(ctx, tx, entry, t.Entry, t, wallet)
+		if err != nil {
+			return err
 		}
 
-		if t.Entry == "credit" {
-			_, err := tx.NewRaw(`
-				UPDATE wallets
-				SET balance = balance + ?, updated_at = CURRENT_TIMESTAMP
-				WHERE id = ?`,
-				t.Amount, wallet.ID).Exec(ctx)
-			if err != nil {
-				return err
-			}
-		} else {
-			res, err := tx.NewRaw(`
-				UPDATE wallets
-				SET balance = balance - ?, updated_at = CURRENT_TIMESTAMP
-				WHERE id = ? AND balance >= ?`,
-				t.Amount, wallet.ID, t.Amount).Exec(ctx)
-			if err != nil {
-				return err
-			}
-			if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-				return ErrorInsuffcientBalance
-			}
+		// funds reserved by open holds cannot be debited, and a debit has
+		// to cover its fee as well
+		if t.Entry == "debit" && wallet.Available() < t.Amount+fee.amount() {
+			return ErrorInsuffcientBalance
 		}
 
-		t.WalletID = wallet.ID
-		t.Wallet = wallet
-		_, err = tx.NewInsert().Model(t).Exec(ctx)
-		if err != nil {
+		if err := entry.post(ctx, tx); err != nil {
 			return err
 		}
 
-		return nil
+		return t.enqueueEvent(ctx, tx, userId)
 	})
+
+	// a request with the same trans_id posted it between the check and the
+	// insert, so this one is a retry of it after all
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		replayed, err := t.replay(ctx, db.DB, userId)
+		if err == nil && !replayed {
+			return ErrorDuplicateTransaction
+		}
+		return err
+	}
+	return err
+}
+
+// replay looks for a transaction the user already posted under t.TransID.
+// If it asks for the same entry, amount and currency t becomes it, fee
+// included, and replay reports true; anything else under the trans_id is
+// ErrorDuplicateTransaction.
+func (t *Transaction) replay(ctx context.Context, db bun.IDB, userId int64) (bool, error) {
+	existing := new(Transaction)
+	err := db.NewSelect().
+		Model(existing).
+		Where("user_id = ? AND trans_id = ?", userId, t.TransID).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if existing.Entry != t.Entry || existing.Amount != t.Amount || existing.Currency != t.Currency {
+		return false, ErrorDuplicateTransaction
+	}
+
+	existing.Fee, err = postedFee(ctx, db, existing.Entry, existing)
+	if err != nil {
+		return false, err
+	}
+	*t = *existing
+	t.Replayed = true
+	return true, nil
+}
+
+// enqueueEvent adds the Kafka event for a posted transaction to the outbox.
+func (t *Transaction) enqueueEvent(ctx context.Context, tx bun.Tx, userId int64) error {
+	event := kafka.TransactionEvent{
+		EventID:   uuid.New().String(),
+		UserID:    userId,
+		Entry:     t.Entry,
+		Amount:    t.Amount,
+		Currency:  t.Currency,
+		Balance:   t.Wallet.Balance,
+		Fee:       t.Fee,
+		Timestamp: time.Now().UTC(),
+	}
+	return enqueueEvent(ctx, tx, event.EventID, EventTypeTransaction, strconv.FormatInt(userId, 10), event)
+}
+
+// amount is the amount of t, or zero for a missing transaction such as no fee.
+func (t *Transaction) amount() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Amount
+}
+
+// signedAmount is the effect of the transaction on its wallet balance.
+func (t *Transaction) signedAmount() int64 {
+	if t.Entry == "debit" {
+		return -t.Amount
+	}
+	return t.Amount
 }
 
 func (t *Transaction) GetUserTransaction(db *postgres.PostgresDB, userId int64, pagination utils.Pagination) ([]*Transaction, int, error) {
@@ -132,15 +226,55 @@ func (t *Transaction) GetUserTransaction(db *postgres.PostgresDB, userId int64,
 	return transactions, total, nil
 }
 
-func FetchUserTransactions(ctx context.Context, db *postgres.PostgresDB, userId int64) ([]Transaction, error) {
-	var transactions []Transaction
+// EachUserTransaction calls fn for every transaction of the user matching
+// filter, newest first. Rows are read in keyset batches of batchSize so memory
+// use does not grow with the length of the history.
+func EachUserTransaction(ctx context.Context, db *postgres.PostgresDB, userId int64, filter TransactionFilter, batchSize int, fn func(Transaction) error) error {
+	var last *Transaction
+	for {
+		var batch []Transaction
+		query := db.DB.NewSelect().
+			Model(&batch).
+			Join(`JOIN wallets AS w ON w.id = transaction.wallet_id`).
+			Where("w.user_id = ?", userId)
+		if last != nil {
+			query = query.Where("(transaction.created_at, transaction.id) < (?, ?)", last.CreatedAt, last.ID)
+		}
 
-	err := db.DB.NewSelect().
-		Model(&transactions).
-		Relation("Wallet"). // Eager load wallet
-		Where("wallet.user_id = ?", userId).
-		Order("transaction.created_at DESC").
-		Scan(ctx)
+		err := filter.apply(query).
+			Order("transaction.created_at DESC", "transaction.id DESC").
+			Limit(batchSize).
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			if err := fn(batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		last = &batch[len(batch)-1]
+	}
+}
+
+// SummarizeUserTransactions counts the transactions matching filter and
+// returns the time of the earliest one.
+func SummarizeUserTransactions(ctx context.Context, db *postgres.PostgresDB, userId int64, filter TransactionFilter) (int, time.Time, error) {
+	var summary struct {
+		Count    int
+		Earliest time.Time
+	}
+	query := db.DB.NewSelect().
+		Model((*Transaction)(nil)).
+		ColumnExpr("COUNT(*) AS count").
+		ColumnExpr("COALESCE(MIN(transaction.created_at), CURRENT_TIMESTAMP) AS earliest").
+		Join(`JOIN wallets AS w ON w.id = transaction.wallet_id`).
+		Where("w.user_id = ?", userId)
 
-	return transactions, err
+	err := filter.apply(query).Scan(ctx, &summary)
+	return summary.Count, summary.Earliest, err
 }
@@ -0,0 +1,178 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/uptrace/bun"
+)
+
+var ErrorRecipientNotFound = errors.New("recipient wallet not found")
+var ErrorSelfTransfer = errors.New("cannot transfer to own wallet")
+
+// Transfer moves funds from the sender's wallet to a recipient wallet. It is
+// recorded as a debit and a credit Transaction sharing the same TransferRef.
+type Transfer struct {
+	Reference         string       `json:"transfer_ref"`
+	Amount            int64        `json:"amount"` // in minor units of Currency
+	Currency          string       `json:"currency"`
+	RecipientEmail    string       `json:"recipient_email,omitempty"`
+	RecipientWalletID int64        `json:"recipient_wallet_id,omitempty"`
+	Debit             *Transaction `json:"debit"`
+	Credit            *Transaction `json:"credit"`
+}
+
+func (tr *Transfer) CreateTransfer(db *postgres.PostgresDB, userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the client may provide its own reference so retries can be detected
+	if tr.Reference == "" {
+		tr.Reference = uuid.New().String()
+	}
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// references are per sender, whose leg is the debit; the credit
+		// leg shares the reference but sits with the recipient
+		exists, err := tx.NewSelect().
+			Model((*Transaction)(nil)).
+			Where("user_id = ? AND trans_id = ?", userId, tr.Reference+ReferenceSeparator+"debit").
+			Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrorDuplicateTransaction
+		}
+		if err := requireVerified(ctx, tx, userId); err != nil {
+			return err
+		}
+
+		sender := new(Wallet)
+		if err := sender.getWallet(tx, userId, tr.Currency); err != nil {
+			return err
+		}
+		// checkLimits locks the sender's user row, which has to come
+		// before either wallet is locked
+		if err := checkLimits(ctx, tx, userId, sender.Currency, "debit", tr.Amount); err != nil {
+			return err
+		}
+
+		recipientID, err := tr.recipientWalletID(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if recipientID == sender.ID {
+			return ErrorSelfTransfer
+		}
+
+		// lock both wallets in id order so two opposite transfers
+		// between the same pair of wallets cannot deadlock
+		var wallets []*Wallet
+		err = tx.NewSelect().
+			Model(&wallets).
+			Where("id IN (?)", bun.In([]int64{sender.ID, recipientID})).
+			Order("id ASC").
+			For("UPDATE").
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+		if len(wallets) != 2 {
+			return ErrorRecipientNotFound
+		}
+		for _, w := range wallets {
+			if w.ID == sender.ID {
+				sender = w
+			}
+		}
+		recipient := wallets[0]
+		if recipient.ID == sender.ID {
+			recipient = wallets[1]
+		}
+
+		if err := sender.allows("debit"); err != nil {
+			return err
+		}
+		if err := recipient.allows("credit"); err != nil {
+			return err
+		}
+		tr.Debit = &Transaction{
+			Entry:       "debit",
+			Amount:      tr.Amount,
+			TransID:     tr.Reference + ":debit",
+			TransferRef: tr.Reference,
+		}
+		// two senders may use the same reference with one recipient, so
+		// the credit names the sender
+		tr.Credit = &Transaction{
+			Entry:       "credit",
+			Amount:      tr.Amount,
+			TransID:     fmt.Sprintf("%s:credit:%d", tr.Reference, userId),
+			TransferRef: tr.Reference,
+		}
+
+		entry := newJournalEntry(userReference("transfer", userId, tr.Reference), "wallet transfer")
+		entry.walletLeg(tr.Debit, sender)
+		entry.walletLeg(tr.Credit, recipient)
+		fee, err := chargeFee(ctx, tx, entry, FeeOnTransfer, tr.Debit, sender)
+		if err != nil {
+			return err
+		}
+		if sender.Available() < tr.Amount+fee.amount() {
+			return ErrorInsuffcientBalance
+		}
+		if err := entry.post(ctx, tx); err != nil {
+			return err
+		}
+
+		tr.RecipientWalletID = recipient.ID
+
+		event := kafka.TransferEvent{
+			EventID:           uuid.New().String(),
+			Reference:         tr.Reference,
+			SenderID:          userId,
+			SenderWalletID:    sender.ID,
+			RecipientWalletID: recipient.ID,
+			Amount:            tr.Amount,
+			Currency:          tr.Currency,
+			SenderBalance:     sender.Balance,
+			Fee:               tr.Debit.Fee,
+			Timestamp:         time.Now().UTC(),
+		}
+		return enqueueEvent(ctx, tx, event.EventID, EventTypeTransfer, strconv.FormatInt(userId, 10), event)
+	})
+}
+
+// recipientWalletID finds the recipient wallet. A recipient named by email
+// must hold a wallet in the transfer currency; a wallet named by id must be
+// in that currency.
+func (tr *Transfer) recipientWalletID(ctx context.Context, tx bun.Tx) (int64, error) {
+	wallet := new(Wallet)
+	query := tx.NewSelect().Model(wallet).Column("wallet.id", "wallet.currency")
+	if tr.RecipientWalletID != 0 {
+		query = query.Where("wallet.id = ?", tr.RecipientWalletID)
+	} else {
+		query = query.
+			Join(`JOIN users AS u ON u.id = wallet.user_id`).
+			Where("lower(u.email) = lower(?) AND wallet.currency = ?", tr.RecipientEmail, tr.Currency)
+	}
+
+	if err := query.Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrorRecipientNotFound
+		}
+		return 0, err
+	}
+	if wallet.Currency != tr.Currency {
+		return 0, ErrorCurrencyMismatch
+	}
+	return wallet.ID, nil
+}
@@ -0,0 +1,150 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/utils"
+	"github.com/uptrace/bun"
+)
+
+var ErrorInvalidUserToken = errors.New("invalid or expired token")
+var ErrorEmailNotVerified = errors.New("email address has not been verified")
+
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposeMFAChallenge      = "mfa_challenge"
+)
+
+var userTokenTTL = map[string]time.Duration{
+	TokenPurposePasswordReset:     time.Hour,
+	TokenPurposeEmailVerification: 48 * time.Hour,
+	TokenPurposeMFAChallenge:      5 * time.Minute,
+}
+
+// UserToken is a single use token sent to the user's email address. Only a
+// hash of the token is stored.
+type UserToken struct {
+	ID        int64     `bun:",pk,autoincrement" json:"-"`
+	UserID    int64     `bun:",notnull" json:"-"`
+	Purpose   string    `bun:",notnull" json:"-"` // password_reset, email_verification or mfa_challenge
+	TokenHash string    `bun:",unique,notnull" json:"-"`
+	ExpiresAt time.Time `bun:",notnull" json:"expires_at"`
+	UsedAt    time.Time `bun:",nullzero" json:"-"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"-"`
+
+	Token string `bun:"-" json:"-"` // only set right after issuing
+}
+
+// IssueUserToken creates a token for purpose. Earlier tokens of the same
+// purpose stay valid until they are used or expire.
+func IssueUserToken(db *postgres.PostgresDB, userId int64, purpose string) (*UserToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token, hash, err := utils.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	ut := &UserToken{
+		UserID:    userId,
+		Purpose:   purpose,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(userTokenTTL[purpose]),
+		Token:     token,
+	}
+	if _, err := db.DB.NewInsert().Model(ut).Exec(ctx); err != nil {
+		return nil, err
+	}
+	return ut, nil
+}
+
+// ResetPassword sets a new password with a password reset token. Every
+// other reset token and refresh token of the user is revoked with it.
+func ResetPassword(db *postgres.PostgresDB, token, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		userId, err := consumeUserToken(ctx, tx, token, TokenPurposePasswordReset)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.NewUpdate().
+			Model((*User)(nil)).
+			Set("password = ?", utils.HashPassword(password)).
+			Where("id = ?", userId).
+			Exec(ctx); err != nil {
+			return err
+		}
+		if _, err := tx.NewUpdate().
+			Model((*UserToken)(nil)).
+			Set("used_at = CURRENT_TIMESTAMP").
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userId, TokenPurposePasswordReset).
+			Exec(ctx); err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().
+			Model((*RefreshToken)(nil)).
+			Set("revoked_at = CURRENT_TIMESTAMP").
+			Where("user_id = ? AND revoked_at IS NULL", userId).
+			Exec(ctx)
+		return err
+	})
+}
+
+// VerifyEmail marks the email address of the token's user as verified.
+func VerifyEmail(db *postgres.PostgresDB, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return db.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		userId, err := consumeUserToken(ctx, tx, token, TokenPurposeEmailVerification)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().
+			Model((*User)(nil)).
+			Set("email_verified_at = CURRENT_TIMESTAMP").
+			Where("id = ? AND email_verified_at IS NULL", userId).
+			Exec(ctx)
+		return err
+	})
+}
+
+// consumeUserToken marks an unused, unexpired token as used and returns the
+// id of its user.
+func consumeUserToken(ctx context.Context, tx bun.Tx, token, purpose string) (int64, error) {
+	var userId int64
+	err := tx.NewUpdate().
+		Model((*UserToken)(nil)).
+		Set("used_at = CURRENT_TIMESTAMP").
+		Where("token_hash = ? AND purpose = ?", utils.HashToken(token), purpose).
+		Where("used_at IS NULL AND expires_at > CURRENT_TIMESTAMP").
+		Returning("user_id").
+		Scan(ctx, &userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrorInvalidUserToken
+	}
+	return userId, err
+}
+
+// requireVerified fails with ErrorEmailNotVerified unless the user has
+// verified their email address. Debits call it before moving any money.
+func requireVerified(ctx context.Context, tx bun.Tx, userId int64) error {
+	verified, err := tx.NewSelect().
+		Model((*User)(nil)).
+		Where("id = ? AND email_verified_at IS NOT NULL", userId).
+		Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrorEmailNotVerified
+	}
+	return nil
+}
@@ -1,7 +1,7 @@
 package kafka
 
 import (
-	"encoding/json"
+	"context"
 	"log"
 	"time"
 
@@ -14,10 +14,66 @@ type Producer struct {
 }
 
 type TransactionEvent struct {
+	EventID   string        `json:"event_id"`
+	UserID    int64         `json:"user_id"`
+	Entry     string        `json:"entry"`
+	Amount    int64         `json:"amount"`
+	Currency  string        `json:"currency"`
+	Balance   int64         `json:"balance"`
+	Fee       *FeeBreakdown `json:"fee,omitempty"` // charged on top of Amount, already taken from Balance
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+type TransferEvent struct {
+	EventID           string        `json:"event_id"`
+	Reference         string        `json:"transfer_ref"`
+	SenderID          int64         `json:"sender_id"`
+	SenderWalletID    int64         `json:"sender_wallet_id"`
+	RecipientWalletID int64         `json:"recipient_wallet_id"`
+	Amount            int64         `json:"amount"`
+	Currency          string        `json:"currency"`
+	SenderBalance     int64         `json:"sender_balance"`
+	Fee               *FeeBreakdown `json:"fee,omitempty"` // charged to the sender on top of Amount
+	Timestamp         time.Time     `json:"timestamp"`
+}
+
+// FeeBreakdown shows how the fee charged on a transaction or transfer was
+// worked out. The fee is booked as its own debit transaction, TransID.
+type FeeBreakdown struct {
+	TransID     string `json:"trans_id"`
+	Type        string `json:"type"` // flat, percentage or tiered
+	Flat        int64  `json:"flat"`
+	BasisPoints int64  `json:"basis_points"`
+	Percentage  int64  `json:"percentage"`       // basis_points of the amount, rounded half up
+	Capped      string `json:"capped,omitempty"` // min, max or amount when a cap replaced flat + percentage
+	Amount      int64  `json:"amount"`           // the fee charged, in minor units
+}
+
+// WalletStatusEvent announces that a wallet was frozen, blocked for debits,
+// made active again or closed.
+type WalletStatusEvent struct {
+	EventID        string    `json:"event_id"`
+	UserID         int64     `json:"user_id"`
+	WalletID       int64     `json:"wallet_id"`
+	Currency       string    `json:"currency"`
+	Status         string    `json:"status"`
+	PreviousStatus string    `json:"previous_status"`
+	Reason         string    `json:"reason"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// ReconciliationMismatchEvent reports a wallet whose cached balance no longer
+// matches the sum of its transactions.
+type ReconciliationMismatchEvent struct {
+	EventID   string    `json:"event_id"`
+	RunID     int64     `json:"run_id"`
 	UserID    int64     `json:"user_id"`
-	Entry     string    `json:"entry"`
-	Amount    int64     `json:"amount"`
-	Balance   int64     `json:"balance"`
+	WalletID  int64     `json:"wallet_id"`
+	Currency  string    `json:"currency"`
+	Balance   int64     `json:"balance"`  // wallets.balance
+	Expected  int64     `json:"expected"` // the sum of the wallet's transactions
+	Drift     int64     `json:"drift"`    // balance - expected
+	Frozen    bool      `json:"frozen"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
@@ -44,24 +100,47 @@ func ConnectKafka(brokersUrl ...string) (*Producer, error) {
 			select {
 			case success := <-prod.Prod.Successes():
 				log.Printf("Kafka message sent to partition %d at offset %d\n", success.Partition, success.Offset)
+				if ack, ok := success.Metadata.(chan error); ok {
+					ack <- nil
+				}
 			case err := <-prod.Prod.Errors():
 				log.Printf("Kafka producer error: %v\n", err.Err)
+				if ack, ok := err.Msg.Metadata.(chan error); ok {
+					ack <- err.Err
+				}
 			}
 		}
 	}()
 	return prod, nil
 }
 
-func (kp *Producer) PublishTransaction(event TransactionEvent) {
-	bytes, err := json.Marshal(event)
-	if err != nil {
-		log.Printf("Failed to marshal transaction event: %v\n", err)
-		return
+// Send publishes an already encoded event and blocks until the broker has
+// acknowledged it. The event id and type travel as record headers so
+// consumers can dedupe without decoding the payload.
+func (kp *Producer) Send(ctx context.Context, key, eventID, eventType string, payload []byte) error {
+	ack := make(chan error, 1)
+	msg := &sarama.ProducerMessage{
+		Topic: kp.Topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(payload),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("event_id"), Value: []byte(eventID)},
+			{Key: []byte("event_type"), Value: []byte(eventType)},
+		},
+		Metadata: ack,
 	}
 
-	kp.Prod.Input() <- &sarama.ProducerMessage{
-		Topic: kp.Topic,
-		Value: sarama.ByteEncoder(bytes),
+	select {
+	case kp.Prod.Input() <- msg:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional emails such as password resets.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv returns an SMTP mailer when SMTP_HOST is set and a LogMailer
+// writing to MAIL_DIR otherwise.
+func FromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return &LogMailer{Dir: os.Getenv("MAIL_DIR")}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &SMTPMailer{
+		Addr:     net.JoinHostPort(host, port),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("MAIL_FROM"),
+	}
+}
+
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// net/smtp has no context support, so the send is abandoned rather
+	// than cancelled when ctx is done
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			return fmt.Errorf("failed to send mail to %s: %w", msg.To, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LogMailer is a stand-in for local development and tests. It writes each
+// message to its own file in Dir, or to the log when Dir is empty.
+type LogMailer struct {
+	Dir string
+
+	seq atomic.Int64
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	if m.Dir == "" {
+		log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+	name := fmt.Sprintf("%d-%03d.eml", time.Now().UnixNano(), m.seq.Add(1))
+	return os.WriteFile(filepath.Join(m.Dir, name), format("noreply@localhost", msg), 0o600)
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
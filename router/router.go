@@ -6,25 +6,107 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/lupppig/stream-ledger-api/controller"
 	"github.com/lupppig/stream-ledger-api/controller/middleware"
+	"github.com/lupppig/stream-ledger-api/model"
 	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/mailer"
 	"github.com/lupppig/stream-ledger-api/repository/postgres"
 )
 
-func Router(db *postgres.PostgresDB, prod *kafka.Producer) *mux.Router {
+func Router(db *postgres.PostgresDB, prod *kafka.Producer, mail mailer.Mailer) *mux.Router {
 	router := mux.NewRouter()
 	subr := router.PathPrefix("/api/v1").Subrouter()
 	subr.Use(middleware.LoggingMiddleware)
 
-	c := controller.Router{DB: db, Prod: prod}
+	c := controller.Router{DB: db, Prod: prod, Mailer: mail}
+	auth := middleware.AuthMiddleware(db)
+	// mutating routes of signed in users honour the Idempotency-Key header
+	idempotent := middleware.Idempotency(db)
+	// scoped routes take an access token or an API key granted scope
+	scoped := func(scope string, h http.HandlerFunc) http.Handler {
+		return auth(middleware.RequireScope(scope)(idempotent(h)))
+	}
+	// session routes manage the account and take access tokens only
+	session := func(h http.HandlerFunc) http.Handler {
+		return auth(middleware.RequireSession(idempotent(h)))
+	}
+
 	// authentication routes
 	subr.HandleFunc("/auth/signup", c.RegisterUser).Methods("POST")
 	subr.HandleFunc("/auth/login", c.SignIn).Methods("POST")
+	subr.HandleFunc("/auth/refresh", c.RefreshToken).Methods("POST")
+	subr.Handle("/auth/logout", session(c.Logout)).Methods("POST")
+	subr.HandleFunc("/auth/password/forgot", c.ForgotPassword).Methods("POST")
+	subr.HandleFunc("/auth/password/reset", c.ResetPassword).Methods("POST")
+	subr.HandleFunc("/auth/verify-email", c.VerifyEmail).Methods("POST")
+	subr.Handle("/auth/verify-email/resend", session(c.ResendVerification)).Methods("POST")
+	subr.HandleFunc("/auth/2fa/verify", c.VerifyTwoFactor).Methods("POST")
+	subr.Handle("/auth/2fa/enroll", session(c.EnrollTOTP)).Methods("POST")
+	subr.Handle("/auth/2fa/confirm", session(c.ConfirmTOTP)).Methods("POST")
+	subr.Handle("/auth/2fa/disable", session(c.DisableTOTP)).Methods("POST")
+
+	// api key routes
+	subr.Handle("/api-keys", session(c.CreateAPIKey)).Methods("POST")
+	subr.Handle("/api-keys", session(c.ListAPIKeys)).Methods("GET")
+	subr.Handle("/api-keys/{id}", session(c.RevokeAPIKey)).Methods("DELETE")
 
 	// transaction routes & wallet routes
-	subr.Handle("/wallet", middleware.AuthMiddleware(http.HandlerFunc(c.GetWallet))).Methods("GET")
-	subr.Handle("/transactions", middleware.AuthMiddleware(http.HandlerFunc(c.CreateTransactions))).Methods("POST")
-	subr.Handle("/transactions", middleware.AuthMiddleware(http.HandlerFunc(c.ListUserTransactions))).Methods("GET")
-	subr.Handle("/transactions/export", middleware.AuthMiddleware(http.HandlerFunc(c.ExportTransaction))).Methods("POST")
+	subr.Handle("/wallet", scoped(model.ScopeWalletRead, c.GetWallet)).Methods("GET")
+	subr.Handle("/wallet/balance", scoped(model.ScopeWalletRead, c.GetWalletBalance)).Methods("GET")
+	subr.Handle("/wallet/balance-history", scoped(model.ScopeWalletRead, c.GetWalletBalanceHistory)).Methods("GET")
+	subr.Handle("/wallets", scoped(model.ScopeWalletWrite, c.CreateWallet)).Methods("POST")
+	subr.Handle("/transactions", scoped(model.ScopeTransactionsWrite, c.CreateTransactions)).Methods("POST")
+	subr.Handle("/transactions", scoped(model.ScopeTransactionsRead, c.ListUserTransactions)).Methods("GET")
+	subr.Handle("/transactions/{id}/reverse", scoped(model.ScopeTransactionsWrite, c.ReverseTransaction)).Methods("POST")
+	subr.Handle("/transactions/export", scoped(model.ScopeExportsCreate, c.ExportTransaction)).Methods("POST")
+	subr.Handle("/exports/{id}", scoped(model.ScopeExportsRead, c.GetExport)).Methods("GET")
+	subr.Handle("/exports/{id}/download", scoped(model.ScopeExportsRead, c.DownloadExport)).Methods("GET")
+	subr.Handle("/transfers", scoped(model.ScopeTransfersWrite, c.CreateTransfer)).Methods("POST")
+	subr.Handle("/schedules", scoped(model.ScopeSchedulesWrite, c.CreateSchedule)).Methods("POST")
+	subr.Handle("/schedules", scoped(model.ScopeSchedulesRead, c.ListSchedules)).Methods("GET")
+	subr.Handle("/schedules/{id}", scoped(model.ScopeSchedulesRead, c.GetSchedule)).Methods("GET")
+	subr.Handle("/schedules/{id}/runs", scoped(model.ScopeSchedulesRead, c.ListScheduleRuns)).Methods("GET")
+	subr.Handle("/schedules/{id}/pause", scoped(model.ScopeSchedulesWrite, c.PauseSchedule)).Methods("POST")
+	subr.Handle("/schedules/{id}/resume", scoped(model.ScopeSchedulesWrite, c.ResumeSchedule)).Methods("POST")
+	subr.Handle("/schedules/{id}/cancel", scoped(model.ScopeSchedulesWrite, c.CancelSchedule)).Methods("POST")
+	// exchange rates are the same for everyone, any API key may read them
+	subr.Handle("/exchange-rates", auth(http.HandlerFunc(c.ListExchangeRates))).Methods("GET")
+	subr.Handle("/conversions/quote", scoped(model.ScopeConversionsWrite, c.CreateQuote)).Methods("POST")
+	subr.Handle("/conversions", scoped(model.ScopeConversionsWrite, c.CreateConversion)).Methods("POST")
+	subr.Handle("/holds", scoped(model.ScopeHoldsWrite, c.CreateHold)).Methods("POST")
+	subr.Handle("/holds/{id}/capture", scoped(model.ScopeHoldsWrite, c.CaptureHold)).Methods("POST")
+	subr.Handle("/holds/{id}/release", scoped(model.ScopeHoldsWrite, c.ReleaseHold)).Methods("POST")
+
+	// public keys for verifying access tokens, served outside of /api/v1
+	// where other services expect them
+	router.HandleFunc("/.well-known/jwks.json", c.JWKS).Methods("GET")
+	router.HandleFunc("/.well-known/checkpoint-keys.json", c.CheckpointKeys).Methods("GET")
+
+	// admin routes, open to signed in staff according to their role
+	admin := subr.PathPrefix("/admin").Subrouter()
+	admin.Use(auth, middleware.RequireSession, idempotent)
+	staff := func(h http.HandlerFunc, roles ...string) http.Handler {
+		return middleware.RequireRole(roles...)(h)
+	}
+	admin.Handle("/users", staff(c.AdminListUsers, model.RoleSupport, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/users/{id}", staff(c.AdminGetUser, model.RoleSupport, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/users/{id}/role", staff(c.AdminSetUserRole, model.RoleAdmin)).Methods("PUT")
+	admin.Handle("/users/{id}/tier", staff(c.AdminSetUserTier, model.RoleAdmin)).Methods("PUT")
+	admin.Handle("/wallets/{id}", staff(c.AdminGetWallet, model.RoleSupport, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/wallets/{id}/transactions", staff(c.AdminListWalletTransactions, model.RoleSupport, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/wallets/{id}/freeze", staff(c.AdminFreezeWallet, model.RoleSupport, model.RoleAdmin)).Methods("POST")
+	admin.Handle("/wallets/{id}/unfreeze", staff(c.AdminUnfreezeWallet, model.RoleSupport, model.RoleAdmin)).Methods("POST")
+	admin.Handle("/wallets/{id}/status", staff(c.AdminSetWalletStatus, model.RoleSupport, model.RoleAdmin)).Methods("PUT")
+	admin.Handle("/wallets/{id}/adjustments", staff(c.AdminAdjustWallet, model.RoleAdmin)).Methods("POST")
+	admin.Handle("/wallets/{id}/chain", staff(c.AdminVerifyWalletChain, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/limits", staff(c.AdminListLimits, model.RoleSupport, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/limits", staff(c.AdminSaveLimit, model.RoleAdmin)).Methods("PUT")
+	admin.Handle("/fees", staff(c.AdminListFeeRules, model.RoleSupport, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/fees", staff(c.AdminSaveFeeRule, model.RoleAdmin)).Methods("PUT")
+	admin.Handle("/fees/{id}", staff(c.AdminDeleteFeeRule, model.RoleAdmin)).Methods("DELETE")
+	admin.Handle("/exchange-rates", staff(c.ImportExchangeRates, model.RoleAdmin)).Methods("PUT")
+	admin.Handle("/audit-logs", staff(c.AdminListAuditLogs, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/reconciliation-runs", staff(c.AdminListReconciliationRuns, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
+	admin.Handle("/ledger-checkpoints", staff(c.AdminListCheckpoints, model.RoleAdmin, model.RoleAuditor)).Methods("GET")
 
-	return subr
+	return router
 }
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/lupppig/stream-ledger-api/model"
+)
+
+const camtNamespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+
+// CAMTExporter renders an ISO 20022 camt.053 bank to customer statement for
+// accounting systems.
+type CAMTExporter struct{}
+
+func (CAMTExporter) Extension() string {
+	return "xml"
+}
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtHeader struct {
+	MsgID   string `xml:"MsgId"`
+	Created string `xml:"CreDtTm"`
+}
+
+type camtPeriod struct {
+	From string `xml:"FrDtTm"`
+	To   string `xml:"ToDtTm"`
+}
+
+type camtAccount struct {
+	ID       string `xml:"Id>Othr>Id"`
+	Currency string `xml:"Ccy"`
+}
+
+type camtBalance struct {
+	Code   string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount camtAmount `xml:"Amt"`
+	CdtDbt string     `xml:"CdtDbtInd"`
+	Date   string     `xml:"Dt>Dt"`
+}
+
+type camtEntry struct {
+	Reference   string     `xml:"NtryRef"`
+	Amount      camtAmount `xml:"Amt"`
+	CdtDbt      string     `xml:"CdtDbtInd"`
+	Status      string     `xml:"Sts"`
+	BookingDate string     `xml:"BookgDt>DtTm"`
+	ValueDate   string     `xml:"ValDt>DtTm"`
+	BankTxCode  string     `xml:"BkTxCd>Prtry>Cd"`
+	BankTxIssr  string     `xml:"BkTxCd>Prtry>Issr"`
+	EndToEndID  string     `xml:"NtryDtls>TxDtls>Refs>EndToEndId"`
+}
+
+func (CAMTExporter) Export(w io.Writer, stmt Statement, rows Rows) error {
+	const timeFormat = "2006-01-02T15:04:05"
+	created := stmt.GeneratedAt.UTC().Format(timeFormat)
+	id := fmt.Sprintf("STMT-%d-%s", stmt.WalletID, stmt.GeneratedAt.UTC().Format("20060102150405"))
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	s := newXMLStream(xml.NewEncoder(w))
+	s.start("Document", xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: camtNamespace})
+	s.start("BkToCstmrStmt")
+	s.element("GrpHdr", camtHeader{MsgID: id, Created: created})
+	s.start("Stmt")
+	s.element("Id", id)
+	s.element("CreDtTm", created)
+	s.element("FrToDt", camtPeriod{From: stmt.From.UTC().Format(timeFormat), To: stmt.To.UTC().Format(timeFormat)})
+	s.element("Acct", camtAccount{ID: formatID(stmt.WalletID), Currency: stmt.Currency})
+	s.element("Bal", camtBalanceOf("OPBD", stmt.Currency, stmt.OpeningBalance, stmt.From.UTC().Format("2006-01-02")))
+	s.element("Bal", camtBalanceOf("CLBD", stmt.Currency, stmt.ClosingBalance, stmt.To.UTC().Format("2006-01-02")))
+
+	err := rows(func(t model.Transaction) error {
+		booked := t.CreatedAt.UTC().Format(timeFormat)
+		s.element("Ntry", camtEntry{
+			Reference:   formatID(t.ID),
+			Amount:      camtAmount{Currency: stmt.Currency, Value: formatAmount(t.Amount, stmt.Currency)},
+			CdtDbt:      camtIndicator(signedAmount(t)),
+			Status:      "BOOK",
+			BookingDate: booked,
+			ValueDate:   booked,
+			BankTxCode:  t.Entry,
+			BankTxIssr:  "STREAMLEDGER",
+			EndToEndID:  t.TransID,
+		})
+		return s.err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.element("AddtlStmtInf", "Filters: "+stmt.Filter.String())
+	return s.close()
+}
+
+func camtBalanceOf(code, currency string, amount int64, date string) camtBalance {
+	indicator := camtIndicator(amount)
+	if amount < 0 {
+		amount = -amount
+	}
+	return camtBalance{
+		Code:   code,
+		Amount: camtAmount{Currency: currency, Value: formatAmount(amount, currency)},
+		CdtDbt: indicator,
+		Date:   date,
+	}
+}
+
+// camtIndicator maps the sign of an amount to CRDT or DBIT.
+func camtIndicator(amount int64) string {
+	if amount < 0 {
+		return "DBIT"
+	}
+	return "CRDT"
+}
+
+func formatID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+)
+
+type CSVExporter struct{}
+
+func (CSVExporter) Extension() string {
+	return "csv"
+}
+
+func (CSVExporter) Export(w io.Writer, stmt Statement, rows Rows) error {
+	cw := csv.NewWriter(w)
+
+	// the statement header is written as comment lines so it can be skipped
+	// by readers that treat '#' as a comment
+	header := fmt.Sprintf("# wallet %d (%s), generated %s\n# filters: %s\n",
+		stmt.WalletID, stmt.Currency, stmt.GeneratedAt.UTC().Format(time.RFC3339), stmt.Filter)
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	if err := cw.Write([]string{"id", "trans_id", "entry", "amount", "currency", "created_at"}); err != nil {
+		return err
+	}
+	err := rows(func(t model.Transaction) error {
+		return cw.Write([]string{
+			strconv.FormatInt(t.ID, 10),
+			t.TransID,
+			t.Entry,
+			formatAmount(t.Amount, stmt.Currency),
+			stmt.Currency,
+			t.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -2,61 +2,80 @@ package services
 
 import (
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"time"
+	"io"
 
 	"github.com/lupppig/stream-ledger-api/model"
 	"github.com/xuri/excelize/v2"
 )
 
-func GenerateExcel(transactions []model.Transaction, userId int64) (string, error) {
+type ExcelExporter struct{}
+
+func (ExcelExporter) Extension() string {
+	return "xlsx"
+}
+
+// Export writes the sheet through excelize's StreamWriter, which spills rows
+// to a temporary file instead of keeping the whole workbook in memory.
+func (ExcelExporter) Export(w io.Writer, stmt Statement, rows Rows) error {
 	f := excelize.NewFile()
 	defer f.Close()
 
 	sheet := "user_transaction_report"
 	f.SetSheetName(f.GetSheetName(0), sheet)
 
-	headers := []string{"ID", "Entry", "Amount", "CreatedAt"}
-	for i, h := range headers {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		f.SetCellValue(sheet, cell, h)
-
-		style, _ := f.NewStyle(&excelize.Style{
-			Font: &excelize.Font{Bold: true},
-		})
-		f.SetCellStyle(sheet, cell, cell, style)
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return fmt.Errorf("failed to create Excel stream writer: %w", err)
 	}
-
-	for row, t := range transactions {
-		rowNum := row + 2
-
-		f.SetCellValue(sheet, fmt.Sprintf("A%d", rowNum), t.ID)
-		f.SetCellValue(sheet, fmt.Sprintf("B%d", rowNum), t.Entry)
-		f.SetCellValue(sheet, fmt.Sprintf("C%d", rowNum), t.Amount)
-		f.SetCellValue(sheet, fmt.Sprintf("D%d", rowNum), t.CreatedAt.Format("2006-01-02 15:04:05"))
+	if err := sw.SetColWidth(1, 4, 15); err != nil {
+		return err
 	}
 
-	cols := []string{"A", "B", "C", "D"}
-	for _, col := range cols {
-		if err := f.SetColWidth(sheet, col, col, 15); err != nil {
-			// Log but don't fail on width setting
-			log.Printf("Warning: failed to set column width for %s: %v", col, err)
-		}
+	bold, err := f.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true},
+	})
+	if err != nil {
+		return err
 	}
 
-	exportDir := "tmp"
-	if err := os.MkdirAll(exportDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create exports directory: %w", err)
+	if err := sw.SetRow("A1", []interface{}{fmt.Sprintf("Wallet %d (%s)", stmt.WalletID, stmt.Currency)}); err != nil {
+		return err
+	}
+	if err := sw.SetRow("A2", []interface{}{"Filters: " + stmt.Filter.String()}); err != nil {
+		return err
 	}
 
-	timestamp := time.Now().Format("20060102_150405")
-	filePath := filepath.Join(exportDir, fmt.Sprintf("transactions_user_%d_%s.xlsx", userId, timestamp))
+	// the table starts below the statement header
+	const headerRow = 4
+	headers := []interface{}{}
+	for _, h := range []string{"ID", "Entry", "Amount", "CreatedAt"} {
+		headers = append(headers, excelize.Cell{StyleID: bold, Value: h})
+	}
+	cell, _ := excelize.CoordinatesToCellName(1, headerRow)
+	if err := sw.SetRow(cell, headers); err != nil {
+		return err
+	}
 
-	if err := f.SaveAs(filePath); err != nil {
-		return "", fmt.Errorf("failed to save Excel file: %w", err)
+	rowNum := headerRow
+	err = rows(func(t model.Transaction) error {
+		rowNum++
+		cell, _ := excelize.CoordinatesToCellName(1, rowNum)
+		return sw.SetRow(cell, []interface{}{
+			t.ID,
+			t.Entry,
+			t.Amount,
+			t.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	})
+	if err != nil {
+		return err
 	}
 
-	return filePath, nil
+	if err := sw.Flush(); err != nil {
+		return fmt.Errorf("failed to flush Excel stream: %w", err)
+	}
+	if _, err := f.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write Excel file: %w", err)
+	}
+	return nil
 }
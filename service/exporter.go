@@ -0,0 +1,153 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+)
+
+const (
+	FormatExcel = "xlsx"
+	FormatCSV   = "csv"
+	FormatPDF   = "pdf"
+	FormatOFX   = "ofx"
+	FormatCAMT  = "camt053"
+)
+
+// Statement describes the wallet a set of exported transactions belongs to
+// and the filters that selected them. It is known before the first row is
+// written so exporters can put it in the file header.
+type Statement struct {
+	UserID         int64
+	Email          string
+	WalletID       int64
+	Currency       string
+	From           time.Time
+	To             time.Time
+	Count          int   // number of exported transactions
+	OpeningBalance int64 // in minor units, at From
+	ClosingBalance int64 // in minor units, at To
+	Filter         model.TransactionFilter
+	GeneratedAt    time.Time
+}
+
+// Rows calls fn for every exported transaction in order and stops at the
+// first error fn returns.
+type Rows func(fn func(model.Transaction) error) error
+
+// SliceRows iterates over transactions that are already in memory.
+func SliceRows(transactions []model.Transaction) Rows {
+	return func(fn func(model.Transaction) error) error {
+		for _, t := range transactions {
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Exporter renders transactions into one file format. Implementations write
+// rows to w as they are produced and must not hold the whole history in memory.
+type Exporter interface {
+	Extension() string
+	Export(w io.Writer, stmt Statement, rows Rows) error
+}
+
+var exporters = map[string]Exporter{
+	FormatExcel: ExcelExporter{},
+	FormatCSV:   CSVExporter{},
+	FormatPDF:   PDFExporter{},
+	FormatOFX:   OFXExporter{},
+	FormatCAMT:  CAMTExporter{},
+}
+
+// ExporterFor returns the exporter for format. An empty format means Excel.
+func ExporterFor(format string) (Exporter, error) {
+	if format == "" {
+		format = FormatExcel
+	}
+	exp, ok := exporters[strings.ToLower(format)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported export format %q, expected one of %s", format, strings.Join(Formats(), ", "))
+	}
+	return exp, nil
+}
+
+// Formats lists the supported export formats.
+func Formats() []string {
+	formats := make([]string, 0, len(exporters))
+	for f := range exporters {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// GenerateExport writes the transactions in the requested format to a new
+// file in the exports directory and returns its path.
+func GenerateExport(format string, stmt Statement, rows Rows) (string, error) {
+	exp, err := ExporterFor(format)
+	if err != nil {
+		return "", err
+	}
+
+	exportDir := "tmp"
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create exports directory: %w", err)
+	}
+
+	timestamp := time.Now().Format("20060102_150405")
+	filePath := filepath.Join(exportDir, fmt.Sprintf("transactions_user_%d_%s.%s", stmt.UserID, timestamp, exp.Extension()))
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create export file: %w", err)
+	}
+
+	buf := bufio.NewWriter(f)
+	err = exp.Export(buf, stmt, rows)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(filePath)
+		return "", err
+	}
+	return filePath, f.Close()
+}
+
+// formatAmount renders an amount in minor units as a decimal in the major
+// unit, using as many decimal places as the currency has.
+func formatAmount(amount int64, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	exp := model.CurrencyExponent(currency)
+	if exp == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+	unit := int64(1)
+	for i := 0; i < exp; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exp, amount%unit)
+}
+
+// signedAmount is the effect of t on the wallet balance.
+func signedAmount(t model.Transaction) int64 {
+	if t.Entry == "debit" {
+		return -t.Amount
+	}
+	return t.Amount
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+)
+
+const ofxTimeFormat = "20060102150405"
+
+// OFXExporter renders an OFX 2.2 bank statement that personal finance tools
+// can import.
+type OFXExporter struct{}
+
+func (OFXExporter) Extension() string {
+	return "ofx"
+}
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxSignOn struct {
+	Status   ofxStatus `xml:"STATUS"`
+	Server   string    `xml:"DTSERVER"`
+	Language string    `xml:"LANGUAGE"`
+}
+
+type ofxAccount struct {
+	BankID    string `xml:"BANKID"`
+	AccountID string `xml:"ACCTID"`
+	AcctType  string `xml:"ACCTTYPE"`
+}
+
+type ofxBalance struct {
+	Amount string `xml:"BALAMT"`
+	AsOf   string `xml:"DTASOF"`
+}
+
+type ofxTransaction struct {
+	Type   string `xml:"TRNTYPE"`
+	Posted string `xml:"DTPOSTED"`
+	Amount string `xml:"TRNAMT"`
+	FITID  string `xml:"FITID"`
+	Name   string `xml:"NAME"`
+}
+
+func (OFXExporter) Export(w io.Writer, stmt Statement, rows Rows) error {
+	header := `<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n" +
+		`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n"
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	ok := ofxStatus{Code: 0, Severity: "INFO"}
+	s := newXMLStream(xml.NewEncoder(w))
+	s.start("OFX")
+	s.start("SIGNONMSGSRSV1")
+	s.element("SONRS", ofxSignOn{Status: ok, Server: ofxTime(stmt.GeneratedAt), Language: "ENG"})
+	s.end()
+
+	s.start("BANKMSGSRSV1")
+	s.start("STMTTRNRS")
+	s.element("TRNUID", "0")
+	s.element("STATUS", ok)
+	s.start("STMTRS")
+	s.element("CURDEF", stmt.Currency)
+	s.element("BANKACCTFROM", ofxAccount{BankID: "STREAMLEDGER", AccountID: formatID(stmt.WalletID), AcctType: "CHECKING"})
+	s.start("BANKTRANLIST")
+	s.element("DTSTART", ofxTime(stmt.From))
+	s.element("DTEND", ofxTime(stmt.To))
+
+	err := rows(func(t model.Transaction) error {
+		s.element("STMTTRN", ofxTransaction{
+			Type:   strings.ToUpper(t.Entry),
+			Posted: ofxTime(t.CreatedAt),
+			Amount: formatAmount(signedAmount(t), stmt.Currency),
+			FITID:  t.TransID,
+			Name:   "Wallet " + t.Entry,
+		})
+		return s.err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.end()
+	s.element("LEDGERBAL", ofxBalance{Amount: formatAmount(stmt.ClosingBalance, stmt.Currency), AsOf: ofxTime(stmt.To)})
+	return s.close()
+}
+
+func ofxTime(t time.Time) string {
+	return t.UTC().Format(ofxTimeFormat) + "[0:GMT]"
+}
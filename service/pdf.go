@@ -0,0 +1,187 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lupppig/stream-ledger-api/model"
+)
+
+const (
+	pdfPageWidth   = 595 // A4 in points
+	pdfPageHeight  = 842
+	pdfMargin      = 50
+	pdfLeading     = 14
+	pdfRowsPerPage = 40
+)
+
+// PDFExporter renders a paginated account statement. It writes the PDF by
+// hand using the built-in Helvetica and Courier fonts so no font files or
+// third party libraries are needed.
+type PDFExporter struct{}
+
+func (PDFExporter) Extension() string {
+	return "pdf"
+}
+
+func (PDFExporter) Export(w io.Writer, stmt Statement, rows Rows) error {
+	pages := (stmt.Count + pdfRowsPerPage - 1) / pdfRowsPerPage
+	if pages == 0 {
+		pages = 1
+	}
+
+	summary := []string{
+		fmt.Sprintf("Account holder: %s", stmt.Email),
+		fmt.Sprintf("Wallet: %d    Currency: %s", stmt.WalletID, stmt.Currency),
+		fmt.Sprintf("Period: %s to %s", stmt.From.Format("2006-01-02"), stmt.To.Format("2006-01-02")),
+		fmt.Sprintf("Opening balance: %s    Closing balance: %s",
+			formatAmount(stmt.OpeningBalance, stmt.Currency), formatAmount(stmt.ClosingBalance, stmt.Currency)),
+		fmt.Sprintf("Filters: %s", stmt.Filter),
+		fmt.Sprintf("Generated: %s", stmt.GeneratedAt.UTC().Format("2006-01-02 15:04:05 MST")),
+	}
+
+	doc := newPDFWriter(w)
+	var c *pdfContent
+	written := 0
+
+	startPage := func() {
+		c = &pdfContent{y: pdfPageHeight - pdfMargin}
+		c.text("F2", 16, "Account Statement")
+		c.y -= 6
+		for _, line := range summary {
+			c.text("F1", 10, line)
+		}
+		c.y -= 10
+		c.text("F3", 9, fmt.Sprintf("%-8s %-36s %-7s %16s  %-19s", "ID", "Reference", "Entry", "Amount", "Date"))
+	}
+	endPage := func() error {
+		c.y = pdfMargin
+		c.text("F1", 8, fmt.Sprintf("Page %d of %d", doc.page+1, pages))
+		return doc.writePage(c.buf.Bytes())
+	}
+
+	startPage()
+	err := rows(func(t model.Transaction) error {
+		if written > 0 && written%pdfRowsPerPage == 0 {
+			if err := endPage(); err != nil {
+				return err
+			}
+			startPage()
+		}
+		c.text("F3", 9, fmt.Sprintf("%-8d %-36s %-7s %16s  %-19s",
+			t.ID, truncate(t.TransID, 36), t.Entry, formatAmount(signedAmount(t), stmt.Currency),
+			t.CreatedAt.UTC().Format("2006-01-02 15:04:05")))
+		written++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if written == 0 {
+		c.text("F1", 10, "No transactions in this period.")
+	}
+	if err := endPage(); err != nil {
+		return err
+	}
+	return doc.close()
+}
+
+type pdfContent struct {
+	buf bytes.Buffer
+	y   int
+}
+
+func (c *pdfContent) text(font string, size int, s string) {
+	fmt.Fprintf(&c.buf, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, size, pdfMargin, c.y, pdfEscape(s))
+	c.y -= pdfLeading
+}
+
+// pdfWriter writes PDF objects straight to the output and only remembers
+// their byte offsets for the cross reference table. Objects are numbered
+// 1 catalog, 2 page tree, 3-5 fonts, then a page object and its content
+// stream for every page. The page tree is written last, once every page is out.
+type pdfWriter struct {
+	w       io.Writer
+	n       int
+	err     error
+	offsets map[int]int
+	page    int
+}
+
+func newPDFWriter(w io.Writer) *pdfWriter {
+	d := &pdfWriter{w: w, offsets: map[int]int{}}
+	d.write("%PDF-1.4\n")
+	d.object(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	d.object(3, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+	d.object(4, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold >>")
+	d.object(5, "<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+	return d
+}
+
+func (d *pdfWriter) write(s string) {
+	if d.err != nil {
+		return
+	}
+	var n int
+	n, d.err = io.WriteString(d.w, s)
+	d.n += n
+}
+
+func (d *pdfWriter) object(num int, body string) {
+	d.offsets[num] = d.n
+	d.write(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", num, body))
+}
+
+func (d *pdfWriter) writePage(content []byte) error {
+	num := 6 + 2*d.page
+	d.object(num, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+		"/Resources << /Font << /F1 3 0 R /F2 4 0 R /F3 5 0 R >> >> /Contents %d 0 R >>",
+		pdfPageWidth, pdfPageHeight, num+1))
+	d.object(num+1, fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	d.page++
+	return d.err
+}
+
+func (d *pdfWriter) close() error {
+	kids := make([]string, d.page)
+	for i := range kids {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	d.object(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), d.page))
+
+	size := 6 + 2*d.page
+	xref := d.n
+	d.write(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", size))
+	for num := 1; num < size; num++ {
+		d.write(fmt.Sprintf("%010d 00000 n \n", d.offsets[num]))
+	}
+	d.write(fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", size, xref))
+	return d.err
+}
+
+// pdfEscape escapes a string for use in a PDF literal string. The standard
+// fonts only cover Latin-1 so anything outside printable ASCII is replaced.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
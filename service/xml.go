@@ -0,0 +1,53 @@
+package services
+
+import "encoding/xml"
+
+// xmlStream writes an XML document element by element so large statements
+// can be produced without building the whole tree in memory. The first error
+// is kept and every later call becomes a no-op.
+type xmlStream struct {
+	enc  *xml.Encoder
+	open []xml.StartElement
+	err  error
+}
+
+func newXMLStream(enc *xml.Encoder) *xmlStream {
+	enc.Indent("", "  ")
+	return &xmlStream{enc: enc}
+}
+
+func (s *xmlStream) start(name string, attrs ...xml.Attr) {
+	if s.err != nil {
+		return
+	}
+	el := xml.StartElement{Name: xml.Name{Local: name}, Attr: attrs}
+	s.err = s.enc.EncodeToken(el)
+	s.open = append(s.open, el)
+}
+
+func (s *xmlStream) end() {
+	if s.err != nil {
+		return
+	}
+	el := s.open[len(s.open)-1]
+	s.open = s.open[:len(s.open)-1]
+	s.err = s.enc.EncodeToken(el.End())
+}
+
+// element encodes v as a complete element called name.
+func (s *xmlStream) element(name string, v interface{}) {
+	if s.err != nil {
+		return
+	}
+	s.err = s.enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+func (s *xmlStream) close() error {
+	for s.err == nil && len(s.open) > 0 {
+		s.end()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	return s.enc.Flush()
+}
@@ -0,0 +1,333 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+func TestAdminRoles(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	support := createAndLoginStaff(r, pdb, "support@example.com", model.RoleSupport, t)
+	auditor := createAndLoginStaff(r, pdb, "auditor@example.com", model.RoleAuditor, t)
+
+	if rr := getWithToken(r, "/api/v1/admin/users", user); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a user without a staff role, got %d", rr.Code)
+	}
+
+	rr := getWithToken(r, "/api/v1/admin/users?q=customer", support)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for support listing users, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var users struct {
+		Data []struct {
+			ID    int64  `json:"user_id"`
+			Email string `json:"email"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &users); err != nil {
+		t.Fatalf("failed to decode users: %v", err)
+	}
+	if len(users.Data) != 1 || users.Data[0].Email != "customer@example.com" {
+		t.Fatalf("expected only the matching user, got %+v", users.Data)
+	}
+
+	rr = getWithToken(r, fmt.Sprintf("/api/v1/admin/users/%d", users.Data[0].ID), auditor)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for auditor viewing a user, got %d", rr.Code)
+	}
+	var detail struct {
+		Data struct {
+			Wallets []struct {
+				WalletID int64 `json:"wallet_id"`
+			} `json:"wallets"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &detail); err != nil || len(detail.Data.Wallets) != 1 {
+		t.Fatalf("expected the user's wallet, got %s", rr.Body.String())
+	}
+	walletPath := fmt.Sprintf("/api/v1/admin/wallets/%d", detail.Data.Wallets[0].WalletID)
+
+	if rr := postJSON(r, walletPath+"/freeze", auditor, `{"reason":"fraud report"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for auditor freezing a wallet, got %d", rr.Code)
+	}
+	if rr := postJSON(r, walletPath+"/freeze", support, `{"reason":"fraud report"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for support freezing a wallet, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(r, walletPath+"/freeze", support, `{"reason":"fraud report"}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for freezing a frozen wallet, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"credit","amount":500}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a credit to a frozen wallet, got %d", rr.Code)
+	}
+
+	adjustment := `{"entry":"credit","amount":500,"reason":"refund","reference":"adj-1"}`
+	if rr := postJSON(r, walletPath+"/adjustments", support, adjustment); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for support adjusting a wallet, got %d", rr.Code)
+	}
+	admin := createAndLoginStaff(r, pdb, "admin@example.com", model.RoleAdmin, t)
+	if rr := postJSON(r, walletPath+"/adjustments", admin, adjustment); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for an admin adjustment on a frozen wallet, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(r, walletPath+"/adjustments", admin, adjustment); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a repeated adjustment reference, got %d", rr.Code)
+	}
+
+	if rr := postJSON(r, walletPath+"/unfreeze", support, `{"reason":"cleared"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for unfreezing, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"credit","amount":500}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for a credit after unfreezing, got %d", rr.Code)
+	}
+	if balance := getWalletBalance(r, user, t); balance != 1000 {
+		t.Errorf("expected balance 1000, got %d", balance)
+	}
+
+	if rr := getWithToken(r, "/api/v1/admin/audit-logs", support); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for support reading the audit log, got %d", rr.Code)
+	}
+	rr = getWithToken(r, "/api/v1/admin/audit-logs?target_type=wallet", auditor)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for auditor reading the audit log, got %d", rr.Code)
+	}
+	var logs struct {
+		Data []struct {
+			Action string `json:"action"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &logs); err != nil {
+		t.Fatalf("failed to decode audit logs: %v", err)
+	}
+	// newest first, the refused attempts are not logged
+	var actions []string
+	for _, l := range logs.Data {
+		actions = append(actions, l.Action)
+	}
+	want := []string{model.AuditWalletUnfreeze, model.AuditWalletAdjust, model.AuditWalletFreeze}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("expected audited actions %v, got %v", want, actions)
+	}
+}
+
+func TestAdminSetUserRole(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	createAndLoginUserWithEmail(r, "agent@example.com", t)
+	admin := createAndLoginStaff(r, pdb, "admin@example.com", model.RoleAdmin, t)
+	agentID := userIDByEmail(pdb, "agent@example.com", t)
+	adminID := userIDByEmail(pdb, "admin@example.com", t)
+
+	put := func(id int64, role string) int {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/v1/admin/users/%d/role", id), strings.NewReader(`{"role":"`+role+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+admin)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := put(agentID, "superuser"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown role, got %d", code)
+	}
+	if code := put(adminID, model.RoleUser); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for changing your own role, got %d", code)
+	}
+	if code := put(agentID, model.RoleSupport); code != http.StatusOK {
+		t.Fatalf("expected 200 for a role change, got %d", code)
+	}
+
+	// the role comes with the next token
+	rr := postJSON(r, "/api/v1/auth/login", "", `{"email":"agent@example.com","password":"secret"}`)
+	agent := decodeTokens(rr, t).Data.AccessToken.Token
+	if rr := getWithToken(r, "/api/v1/admin/users", agent); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 after promotion to support, got %d", rr.Code)
+	}
+}
+
+func TestWalletStatusLifecycle(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	support := createAndLoginStaff(r, pdb, "support@example.com", model.RoleSupport, t)
+
+	wallet, err := model.GetUserWallet(pdb, userIDByEmail(pdb, "customer@example.com", t), "NGN")
+	if err != nil {
+		t.Fatalf("failed to load wallet: %v", err)
+	}
+	setStatus := func(status string) int {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/v1/admin/wallets/%d/status", wallet.ID),
+			strings.NewReader(`{"status":"`+status+`","reason":"compliance review"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+support)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	transact := func(entry string, amount int) int {
+		payload := fmt.Sprintf(`{"currency":"NGN","entry":"%s","amount":%d}`, entry, amount)
+		return postJSON(r, "/api/v1/transactions", user, payload).Code
+	}
+
+	if code := transact("credit", 500); code != http.StatusOK {
+		t.Fatalf("failed to fund wallet, got %d", code)
+	}
+	if code := setStatus("suspended"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown status, got %d", code)
+	}
+
+	if code := setStatus(model.WalletStatusDebitBlocked); code != http.StatusOK {
+		t.Fatalf("expected 200 for blocking debits, got %d", code)
+	}
+	if code := transact("debit", 100); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a debit from a debit blocked wallet, got %d", code)
+	}
+	if code := transact("credit", 200); code != http.StatusOK {
+		t.Errorf("expected 200 for a credit to a debit blocked wallet, got %d", code)
+	}
+
+	if code := setStatus(model.WalletStatusClosed); code != http.StatusConflict {
+		t.Errorf("expected 409 for closing a wallet with funds, got %d", code)
+	}
+	if code := setStatus(model.WalletStatusActive); code != http.StatusOK {
+		t.Fatalf("expected 200 for reactivating, got %d", code)
+	}
+	if code := transact("debit", 700); code != http.StatusOK {
+		t.Fatalf("expected 200 for emptying the wallet, got %d", code)
+	}
+	if code := setStatus(model.WalletStatusClosed); code != http.StatusOK {
+		t.Fatalf("expected 200 for closing an empty wallet, got %d", code)
+	}
+	if code := transact("credit", 100); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a credit to a closed wallet, got %d", code)
+	}
+	if code := setStatus(model.WalletStatusActive); code != http.StatusConflict {
+		t.Errorf("expected 409 for reopening a closed wallet, got %d", code)
+	}
+
+	var events []model.OutboxEvent
+	err = pdb.DB.NewSelect().
+		Model(&events).
+		Where("event_type = ?", model.EventTypeWalletStatus).
+		Order("id ASC").
+		Scan(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load outbox events: %v", err)
+	}
+	var statuses []string
+	for _, e := range events {
+		var event kafka.WalletStatusEvent
+		if err := json.Unmarshal(e.Payload, &event); err != nil {
+			t.Fatalf("failed to decode wallet status event: %v", err)
+		}
+		statuses = append(statuses, event.Status)
+	}
+	want := []string{model.WalletStatusDebitBlocked, model.WalletStatusActive, model.WalletStatusClosed}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("expected status events %v, got %v", want, statuses)
+	}
+}
+
+func TestTransactionLimits(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	admin := createAndLoginStaff(r, pdb, "admin@example.com", model.RoleAdmin, t)
+	userID := userIDByEmail(pdb, "customer@example.com", t)
+
+	put := func(path, body string) int {
+		req, _ := http.NewRequest("PUT", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+admin)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	transact := func(entry string, amount int) *httptest.ResponseRecorder {
+		payload := fmt.Sprintf(`{"currency":"NGN","entry":"%s","amount":%d}`, entry, amount)
+		return postJSON(r, "/api/v1/transactions", user, payload)
+	}
+
+	if code := put("/api/v1/admin/limits", `{"currency":"NGN","max_single_debit":100}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a limit without a tier or user, got %d", code)
+	}
+	if code := put("/api/v1/admin/limits", `{"tier":"standard","currency":"NGN","max_single_debit":400,"max_daily_debit":600}`); code != http.StatusOK {
+		t.Fatalf("expected 200 for a tier limit, got %d", code)
+	}
+	if rr := transact("credit", 2000); rr.Code != http.StatusOK {
+		t.Fatalf("failed to fund wallet, got %d", rr.Code)
+	}
+
+	rr := transact("debit", 500)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a debit over the single debit limit, got %d", rr.Code)
+	}
+	// a hold is a debit in waiting and the same limits apply to it
+	if rr := postJSON(r, "/api/v1/holds", user, `{"currency":"NGN","amount":500}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a hold over the single debit limit, got %d", rr.Code)
+	}
+	if rr := transact("debit", 0); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a zero amount, got %d", rr.Code)
+	}
+	if rr := transact("refund", 100); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown entry, got %d", rr.Code)
+	}
+	if rr := transact("debit", 400); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a debit within the limits, got %d", rr.Code)
+	}
+	rr = transact("debit", 300)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a debit over the daily limit, got %d", rr.Code)
+	}
+	var body struct {
+		Error model.LimitExceededError `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode limit error: %v", err)
+	}
+	if body.Error.Limit != model.LimitDailyDebit || body.Error.Remaining != 200 {
+		t.Errorf("expected 200 left of the daily limit, got %+v", body.Error)
+	}
+
+	// a user limit replaces the one of their tier
+	limit := fmt.Sprintf(`{"user_id":%d,"currency":"NGN","max_transactions_per_minute":4}`, userID)
+	if code := put("/api/v1/admin/limits", limit); code != http.StatusOK {
+		t.Fatalf("expected 200 for a user limit, got %d", code)
+	}
+	if rr := transact("debit", 300); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 once the user limit applies, got %d", rr.Code)
+	}
+	if rr := transact("credit", 100); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for the fourth transaction in a minute, got %d", rr.Code)
+	}
+	rr = transact("credit", 100)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for the fifth transaction in a minute, got %d", rr.Code)
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error.Limit != model.LimitTransactionsPerMinute {
+		t.Errorf("expected the per minute limit, got %s", rr.Body.String())
+	}
+
+	if code := put(fmt.Sprintf("/api/v1/admin/users/%d/tier", userID), `{"tier":"premium"}`); code != http.StatusOK {
+		t.Errorf("expected 200 for a tier change, got %d", code)
+	}
+	if balance := getWalletBalance(r, user, t); balance != 1400 {
+		t.Errorf("expected balance 1400, got %d", balance)
+	}
+}
@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func TestAPIKeys(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(r, t)
+
+	if rr := postJSON(r, "/api/v1/api-keys", token, `{"name":"shop","scopes":["wallet:admin"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown scope, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/api-keys", token, `{"name":"shop","scopes":["wallet:read"],"expires_at":"2001-01-01"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a past expiry, got %d", rr.Code)
+	}
+
+	rr := postJSON(r, "/api/v1/api-keys", token, `{"name":"shop","scopes":["wallet:read","transactions:write"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created struct {
+		Data struct {
+			ID  int64  `json:"id"`
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("failed to decode api key: %v", err)
+	}
+	key := created.Data.Key
+
+	get := func(path string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := get("/api/v1/wallet"); code != http.StatusOK {
+		t.Errorf("expected 200 with wallet:read, got %d", code)
+	}
+	if code := get("/api/v1/transactions"); code != http.StatusForbidden {
+		t.Errorf("expected 403 without transactions:read, got %d", code)
+	}
+	// the key is also accepted as the bearer token
+	if rr := postJSON(r, "/api/v1/transactions", key, `{"currency":"NGN","entry":"credit","amount":100}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 with transactions:write, got %d", rr.Code)
+	}
+	// the key was created without a second factor, so it cannot stand in
+	// for the step-up
+	if rr := postJSON(r, "/api/v1/transactions", key, `{"currency":"NGN","entry":"credit","amount":5000000}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a large credit, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", key, `{"currency":"NGN","entry":"debit","amount":2000000}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a large debit by the key of a user without two-factor, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/api-keys", key, `{"name":"child","scopes":["wallet:read"]}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected api keys to be unable to manage api keys, got %d", rr.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	var list struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("failed to decode api key list: %v", err)
+	}
+	if len(list.Data) != 1 || list.Data[0]["key"] != nil {
+		t.Errorf("expected one listed key without its secret, got %v", list.Data)
+	}
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/v1/api-keys/%d", created.Data.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on revoke, got %d", rr.Code)
+	}
+	if code := get("/api/v1/wallet"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a revoked key, got %d", code)
+	}
+}
+
+func TestAPIKeyNeedsSecondFactor(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUserWithEmail(r, "apikey-totp@example.com", t)
+	secret := enableTwoFactor(r, token, t)
+
+	// a key skips the step-up, so with two-factor authentication on it
+	// cannot be created from an access token alone
+	if rr := postJSON(r, "/api/v1/api-keys", token, `{"name":"shop","scopes":["transactions:write"]}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a totp_code, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/api-keys", token, `{"name":"shop","scopes":["transactions:write"],"totp_code":"000000"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a wrong totp_code, got %d", rr.Code)
+	}
+	next, _ := utils.TOTPCode(secret, time.Now().Add(30*time.Second))
+	body := fmt.Sprintf(`{"name":"shop","scopes":["transactions:write"],"totp_code":"%s"}`, next)
+	if rr := postJSON(r, "/api/v1/api-keys", token, body); rr.Code != http.StatusCreated {
+		t.Errorf("expected 201 with a fresh totp_code, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
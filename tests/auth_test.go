@@ -17,7 +17,7 @@ func TestSignup(t *testing.T) {
 
 	pdb, mockProducer := SetupTestDB(t)
 	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
-	r := router.Router(pdb, prod)
+	r := router.Router(pdb, prod, testMailer)
 
 	numUsers := 5
 	for i := 0; i < numUsers; i++ {
@@ -42,7 +42,7 @@ func TestCreateUser_DuplicateEmail(t *testing.T) {
 	// Initialize router
 	pdb, mockProducer := SetupTestDB(t)
 	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
-	router := router.Router(pdb, prod)
+	router := router.Router(pdb, prod, testMailer)
 
 	user := map[string]string{
 		"email":      "duplicate@example.com",
@@ -90,7 +90,7 @@ func TestLogin(t *testing.T) {
 	pdb, mockProducer := SetupTestDB(t)
 
 	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
-	r := router.Router(pdb, prod)
+	r := router.Router(pdb, prod, testMailer)
 
 	numUsers := 5
 	// create users first
@@ -141,3 +141,170 @@ func TestLogin(t *testing.T) {
 		t.Errorf("expected login failure for wrong password, but got %d", rrBad.Code)
 	}
 }
+
+type tokensResponse struct {
+	Data struct {
+		AccessToken struct {
+			Token string `json:"token"`
+		} `json:"access_token"`
+		RefreshToken struct {
+			Token string `json:"token"`
+		} `json:"refresh_token"`
+	} `json:"data"`
+}
+
+func decodeTokens(rr *httptest.ResponseRecorder, t *testing.T) tokensResponse {
+	var tr tokensResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tr); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+	if tr.Data.AccessToken.Token == "" || tr.Data.RefreshToken.Token == "" {
+		t.Fatalf("expected access and refresh tokens, got %s", rr.Body.String())
+	}
+	return tr
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	if rr := postJSON(r, "/api/v1/auth/signup", "", `{"first_name":"Rita","last_name":"Fresh","email":"refresh@example.com","password":"secret"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("failed to create test user, got %d", rr.Code)
+	}
+	rr := postJSON(r, "/api/v1/auth/login", "", `{"email":"refresh@example.com","password":"secret"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to login test user, got %d", rr.Code)
+	}
+	first := decodeTokens(rr, t)
+
+	rr = postJSON(r, "/api/v1/auth/refresh", "", fmt.Sprintf(`{"refresh_token":"%s"}`, first.Data.RefreshToken.Token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on refresh, got %d: %s", rr.Code, rr.Body.String())
+	}
+	second := decodeTokens(rr, t)
+	if second.Data.RefreshToken.Token == first.Data.RefreshToken.Token {
+		t.Fatal("expected the refresh token to rotate")
+	}
+
+	// presenting the rotated token again revokes the whole family
+	rr = postJSON(r, "/api/v1/auth/refresh", "", fmt.Sprintf(`{"refresh_token":"%s"}`, first.Data.RefreshToken.Token))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 when reusing a refresh token, got %d", rr.Code)
+	}
+	rr = postJSON(r, "/api/v1/auth/refresh", "", fmt.Sprintf(`{"refresh_token":"%s"}`, second.Data.RefreshToken.Token))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a token of a revoked family, got %d", rr.Code)
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	if rr := postJSON(r, "/api/v1/auth/signup", "", `{"first_name":"Lou","last_name":"Gout","email":"logout@example.com","password":"secret"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("failed to create test user, got %d", rr.Code)
+	}
+	rr := postJSON(r, "/api/v1/auth/login", "", `{"email":"logout@example.com","password":"secret"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to login test user, got %d", rr.Code)
+	}
+	tokens := decodeTokens(rr, t)
+	access := tokens.Data.AccessToken.Token
+
+	rr = postJSON(r, "/api/v1/auth/logout", access, fmt.Sprintf(`{"refresh_token":"%s"}`, tokens.Data.RefreshToken.Token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on logout, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/wallet", nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a revoked access token, got %d", rr.Code)
+	}
+
+	rr = postJSON(r, "/api/v1/auth/refresh", "", fmt.Sprintf(`{"refresh_token":"%s"}`, tokens.Data.RefreshToken.Token))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a refresh token revoked on logout, got %d", rr.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	if rr := postJSON(r, "/api/v1/auth/signup", "", `{"first_name":"Reese","last_name":"Set","email":"reset@example.com","password":"secret"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("failed to create test user, got %d", rr.Code)
+	}
+	rr := postJSON(r, "/api/v1/auth/login", "", `{"email":"reset@example.com","password":"secret"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to login test user, got %d", rr.Code)
+	}
+	session := decodeTokens(rr, t)
+
+	// unknown emails get the same answer so accounts cannot be probed
+	if rr := postJSON(r, "/api/v1/auth/password/forgot", "", `{"email":"nobody@example.com"}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for an unknown email, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/auth/password/forgot", "", `{"email":"reset@example.com"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on forgot password, got %d", rr.Code)
+	}
+	token := lastMailToken("reset@example.com", t)
+
+	reset := fmt.Sprintf(`{"token":"%s","password":"n3w-secret"}`, token)
+	if rr := postJSON(r, "/api/v1/auth/password/reset", "", reset); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on reset, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(r, "/api/v1/auth/password/reset", "", reset); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when reusing a reset token, got %d", rr.Code)
+	}
+
+	if rr := postJSON(r, "/api/v1/auth/login", "", `{"email":"reset@example.com","password":"secret"}`); rr.Code == http.StatusOK {
+		t.Error("expected the old password to be rejected")
+	}
+	if rr := postJSON(r, "/api/v1/auth/login", "", `{"email":"reset@example.com","password":"n3w-secret"}`); rr.Code != http.StatusOK {
+		t.Errorf("expected login with the new password, got %d", rr.Code)
+	}
+	rr = postJSON(r, "/api/v1/auth/refresh", "", fmt.Sprintf(`{"refresh_token":"%s"}`, session.Data.RefreshToken.Token))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected refresh tokens to be revoked by the reset, got %d", rr.Code)
+	}
+}
+
+func TestUnverifiedUserCannotDebit(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	rr := postJSON(r, "/api/v1/auth/signup", "", `{"first_name":"Una","last_name":"Verified","email":"unverified@example.com","password":"secret"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("failed to create test user, got %d", rr.Code)
+	}
+	access := decodeTokens(rr, t).Data.AccessToken.Token
+
+	if rr := postJSON(r, "/api/v1/transactions", access, `{"currency":"NGN","entry":"credit","amount":1000}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected unverified users to receive credits, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", access, `{"currency":"NGN","entry":"debit","amount":100}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a debit before verification, got %d", rr.Code)
+	}
+
+	if rr := postJSON(r, "/api/v1/auth/verify-email", "", `{"token":"not-a-token"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad verification token, got %d", rr.Code)
+	}
+	verify := fmt.Sprintf(`{"token":"%s"}`, lastMailToken("unverified@example.com", t))
+	if rr := postJSON(r, "/api/v1/auth/verify-email", "", verify); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on verification, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/auth/verify-email/resend", access, ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 when resending to a verified email, got %d", rr.Code)
+	}
+
+	if rr := postJSON(r, "/api/v1/transactions", access, `{"currency":"NGN","entry":"debit","amount":100}`); rr.Code != http.StatusOK {
+		t.Errorf("expected debit to succeed after verification, got %d", rr.Code)
+	}
+}
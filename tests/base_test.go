@@ -3,15 +3,23 @@ package tests
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/IBM/sarama/mocks"
 	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/mailer"
 	"github.com/lupppig/stream-ledger-api/repository/postgres"
 	"github.com/uptrace/bun"
 )
 
+// testMailer collects the emails sent by the router of the running test.
+var testMailer *mailer.LogMailer
+
 func SetupTestDB(t *testing.T) (*postgres.PostgresDB, *mocks.AsyncProducer) {
 	dsn := os.Getenv("DB_TEST_URL")
 	if dsn == "" {
@@ -28,7 +36,29 @@ func SetupTestDB(t *testing.T) (*postgres.PostgresDB, *mocks.AsyncProducer) {
 	TestDB = pdb.DB
 	ctx := context.Background()
 	// Drop & recreate tables before running tests
+	_, _ = TestDB.NewDropTable().Model((*model.OutboxEvent)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.AuditLog)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.TransactionLimit)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.FeeRule)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.ReconciliationRun)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.LedgerCheckpoint)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.IdempotencyKey)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.ScheduleRun)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.Schedule)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.Export)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.Hold)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.RefreshToken)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.RevokedToken)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.UserToken)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.RecoveryCode)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.APIKey)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.Conversion)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.FXQuote)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.ExchangeRate)(nil)).IfExists().Cascade().Exec(ctx)
 	_, _ = TestDB.NewDropTable().Model((*model.Transaction)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.Posting)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.JournalEntry)(nil)).IfExists().Cascade().Exec(ctx)
+	_, _ = TestDB.NewDropTable().Model((*model.Account)(nil)).IfExists().Cascade().Exec(ctx)
 	_, _ = TestDB.NewDropTable().Model((*model.Wallet)(nil)).IfExists().Cascade().Exec(ctx)
 	_, _ = TestDB.NewDropTable().Model((*model.User)(nil)).IfExists().Cascade().Exec(ctx)
 	_, _ = TestDB.ExecContext(ctx, `DROP TYPE IF EXISTS transaction_entry CASCADE;`)
@@ -40,6 +70,31 @@ func SetupTestDB(t *testing.T) (*postgres.PostgresDB, *mocks.AsyncProducer) {
 	if err != nil {
 		log.Println(err.Error())
 	}
+	_, _ = TestDB.NewCreateTable().Model((*model.Account)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.JournalEntry)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.Posting)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.OutboxEvent)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.Export)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.Hold)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.ExchangeRate)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.FXQuote)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.Conversion)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.RefreshToken)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.RevokedToken)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.UserToken)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.RecoveryCode)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.APIKey)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.AuditLog)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.TransactionLimit)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.FeeRule)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.Schedule)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.ScheduleRun)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.ReconciliationRun)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.LedgerCheckpoint)(nil)).IfNotExists().Exec(ctx)
+	_, _ = TestDB.NewCreateTable().Model((*model.IdempotencyKey)(nil)).IfNotExists().Exec(ctx)
+	if err := model.EnsureSystemAccounts(ctx, TestDB); err != nil {
+		log.Println(err.Error())
+	}
 	mockProducer := mocks.NewAsyncProducer(t, nil)
 	// defer mockProducer.Close()
 
@@ -47,7 +102,54 @@ func SetupTestDB(t *testing.T) (*postgres.PostgresDB, *mocks.AsyncProducer) {
 		mockProducer.ExpectInputAndSucceed()
 	}
 
+	testMailer = &mailer.LogMailer{Dir: t.TempDir()}
+
 	log.Println("Test DB setup complete")
 
 	return pdb, mockProducer
 }
+
+// createAndLoginStaff signs up a user, gives them role and signs them in
+// again so the access token carries the role.
+func createAndLoginStaff(router http.Handler, pdb *postgres.PostgresDB, email, role string, t *testing.T) string {
+	createAndLoginUserWithEmail(router, email, t)
+	_, err := pdb.DB.NewUpdate().
+		Model((*model.User)(nil)).
+		Set("role = ?", role).
+		Where("email = ?", email).
+		Exec(context.Background())
+	if err != nil {
+		t.Fatalf("failed to set role of %s: %v", email, err)
+	}
+
+	rr := postJSON(router, "/api/v1/auth/login", "", `{"email":"`+email+`","password":"secret"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to login %s, got %d", email, rr.Code)
+	}
+	return decodeTokens(rr, t).Data.AccessToken.Token
+}
+
+var mailTokenPattern = regexp.MustCompile(`(?m)^([A-Za-z0-9_-]{43})\r?$`)
+
+// lastMailToken returns the token in the newest email sent to `to`.
+func lastMailToken(to string, t *testing.T) string {
+	entries, err := os.ReadDir(testMailer.Dir)
+	if err != nil {
+		t.Fatalf("failed to read mail dir: %v", err)
+	}
+	// file names start with the send time, so the newest sorts last
+	for i := len(entries) - 1; i >= 0; i-- {
+		msg, err := os.ReadFile(filepath.Join(testMailer.Dir, entries[i].Name()))
+		if err != nil {
+			t.Fatalf("failed to read mail: %v", err)
+		}
+		if !strings.Contains(string(msg), "To: "+to+"\r\n") {
+			continue
+		}
+		if m := mailTokenPattern.FindSubmatch(msg); m != nil {
+			return string(m[1])
+		}
+	}
+	t.Fatalf("no email with a token was sent to %s", to)
+	return ""
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func TestTransactionHash(t *testing.T) {
+	base := model.Transaction{
+		WalletID:     1,
+		Entry:        "credit",
+		Amount:       500,
+		Currency:     "NGN",
+		TransID:      "abc",
+		BalanceAfter: 500,
+		CreatedAt:    time.Date(2026, time.March, 1, 12, 0, 0, 123456000, time.UTC),
+	}
+	hash := base.ComputeHash()
+	if len(hash) != 64 {
+		t.Fatalf("expected a hex SHA-256, got %q", hash)
+	}
+	same := base
+	same.CreatedAt = base.CreatedAt.In(time.FixedZone("WAT", 3600))
+	if same.ComputeHash() != hash {
+		t.Error("expected the hash not to depend on the time zone")
+	}
+
+	edits := map[string]func(*model.Transaction){
+		"amount":        func(t *model.Transaction) { t.Amount = 501 },
+		"entry":         func(t *model.Transaction) { t.Entry = "debit" },
+		"balance_after": func(t *model.Transaction) { t.BalanceAfter = 0 },
+		"created_at":    func(t *model.Transaction) { t.CreatedAt = t.CreatedAt.Add(time.Microsecond) },
+		"prev_hash":     func(t *model.Transaction) { t.PrevHash = hash },
+		"trans_id":      func(t *model.Transaction) { t.TransID = "abd" },
+	}
+	for field, edit := range edits {
+		edited := base
+		edit(&edited)
+		if edited.ComputeHash() == hash {
+			t.Errorf("expected an edit of %s to change the hash", field)
+		}
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+	ctx := context.Background()
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	seedTransactions(r, user, t)
+	wallet, err := model.GetUserWallet(pdb, userIDByEmail(pdb, "customer@example.com", t), "NGN")
+	if err != nil {
+		t.Fatalf("failed to load wallet: %v", err)
+	}
+
+	var rows []model.Transaction
+	if err := pdb.DB.NewSelect().Model(&rows).Where("wallet_id = ?", wallet.ID).Order("id ASC").Scan(ctx); err != nil {
+		t.Fatalf("failed to load transactions: %v", err)
+	}
+	if len(rows) != 3 || rows[0].PrevHash != "" || rows[1].PrevHash != rows[0].Hash || rows[2].PrevHash != rows[1].Hash {
+		t.Fatalf("expected three linked transactions, got %+v", rows)
+	}
+
+	result, err := model.VerifyChain(ctx, pdb, wallet.ID)
+	if err != nil || !result.Valid || result.Checked != 3 || result.Head != rows[2].Hash {
+		t.Fatalf("expected a valid chain of 3, got %+v (%v)", result, err)
+	}
+
+	t.Cleanup(func() { utils.UseCheckpointKeySet(nil) })
+	checkpointKeys := t.TempDir()
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, checkpointKeys, "checkpoint-2025-01", oldKey, false)
+	useCheckpointKeysFrom(t, checkpointKeys)
+
+	cp, err := model.CreateCheckpoint(ctx, pdb, time.Now())
+	if err != nil {
+		t.Fatalf("failed to create checkpoint: %v", err)
+	}
+	if len(cp.Heads) != 1 || cp.Heads[0].TransactionID != rows[2].ID || cp.Verify() != nil {
+		t.Errorf("expected a signed checkpoint of the wallet head, got %+v", cp)
+	}
+	if _, err := model.CreateCheckpoint(ctx, pdb, time.Now()); err != model.ErrorCheckpointExists {
+		t.Errorf("expected a day to be checkpointed once, got %v", err)
+	}
+	if result, _ := model.VerifyChain(ctx, pdb, wallet.ID); !result.Valid || result.CheckpointsChecked != 1 {
+		t.Errorf("expected the chain to match the checkpoint, got %+v", result)
+	}
+
+	// rotating the token keys and the checkpoint key leaves the old
+	// checkpoint verifiable
+	tokenKeys, err := utils.GenerateKeySet()
+	if err != nil {
+		t.Fatalf("failed to generate token keys: %v", err)
+	}
+	utils.UseKeySet(tokenKeys)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, checkpointKeys, "checkpoint-2025-02", newKey, false)
+	writeKey(t, checkpointKeys, "checkpoint-2025-01", oldKey.Public(), true)
+	useCheckpointKeysFrom(t, checkpointKeys)
+	if result, _ := model.VerifyChain(ctx, pdb, wallet.ID); !result.Valid || result.CheckpointsChecked != 1 {
+		t.Errorf("expected the old checkpoint to verify after a key rotation, got %+v", result)
+	}
+
+	// an edit made straight in the database
+	if _, err := pdb.DB.ExecContext(ctx, `UPDATE transactions SET amount = 250 WHERE id = ?`, rows[1].ID); err != nil {
+		t.Fatalf("failed to tamper: %v", err)
+	}
+	auditor := createAndLoginStaff(r, pdb, "auditor@example.com", model.RoleAuditor, t)
+	rr := getWithToken(r, fmt.Sprintf("/api/v1/admin/wallets/%d/chain", wallet.ID), auditor)
+	var body struct {
+		Data model.ChainVerification `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode verification: %v", err)
+	}
+	if b := body.Data.Break; body.Data.Valid || b == nil || b.TransactionID != rows[1].ID || !strings.Contains(b.Reason, "hash") {
+		t.Errorf("expected the edited row to break the chain, got %s", rr.Body.String())
+	}
+
+	// the edit undone, but the first row deleted
+	_, _ = pdb.DB.ExecContext(ctx, `UPDATE transactions SET amount = 300 WHERE id = ?`, rows[1].ID)
+	_, _ = pdb.DB.ExecContext(ctx, `DELETE FROM transactions WHERE id = ?`, rows[0].ID)
+	result, _ = model.VerifyChain(ctx, pdb, wallet.ID)
+	if result.Valid || result.Break.TransactionID != rows[1].ID || !strings.Contains(result.Break.Reason, "prev_hash") {
+		t.Errorf("expected a deleted row to break the next link, got %+v", result.Break)
+	}
+
+	// a forged checkpoint is caught before the chain is trusted
+	_, _ = pdb.DB.ExecContext(ctx, `UPDATE ledger_checkpoints SET root = 'forged'`)
+	result, _ = model.VerifyChain(ctx, pdb, wallet.ID)
+	if result.Valid || !strings.Contains(result.Break.Reason, "not authentic") {
+		t.Errorf("expected a forged checkpoint to be reported, got %+v", result.Break)
+	}
+}
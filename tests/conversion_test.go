@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+func TestParseExchangeRatesCSV(t *testing.T) {
+	rates, err := model.ParseExchangeRatesCSV(strings.NewReader("base,quote,rate,spread_bps\nUSD,NGN,1500.5,50\neur, ngn, 1600\n"))
+	if err != nil {
+		t.Fatalf("failed to parse rates: %v", err)
+	}
+	if len(rates) != 2 {
+		t.Fatalf("expected 2 rates, got %d", len(rates))
+	}
+	if rates[0].Rate != "1500.5" || rates[0].SpreadBps != 50 {
+		t.Errorf("unexpected first rate %+v", rates[0])
+	}
+	if rates[1].BaseCurrency != "eur" || rates[1].SpreadBps != 0 {
+		t.Errorf("unexpected second rate %+v", rates[1])
+	}
+
+	if _, err := model.ParseExchangeRatesCSV(strings.NewReader("USD,NGN\n")); err == nil {
+		t.Error("expected an error for a row without a rate")
+	}
+}
+
+func TestConversion(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+	admin := createAndLoginStaff(router, pdb, "admin@example.com", model.RoleAdmin, t)
+
+	req, _ := http.NewRequest("PUT", "/api/v1/admin/exchange-rates", strings.NewReader("USD,NGN,1500,100\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Authorization", "Bearer "+admin)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for rate import, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	token := createAndLoginUser(router, t)
+	if rr := postJSON(router, "/api/v1/wallets", token, `{"currency":"USD"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("failed to open USD wallet, got %d", rr.Code)
+	}
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":150000}`); rr.Code != http.StatusOK {
+		t.Fatalf("failed to fund NGN wallet, got %d", rr.Code)
+	}
+
+	// 1500 NGN at 1 USD = 1500 NGN is 1 USD, less a 1% spread
+	rr = postJSON(router, "/api/v1/conversions/quote", token, `{"from_currency":"NGN","to_currency":"USD","amount":150000}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for quote, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var qr struct {
+		Data struct {
+			QuoteID      string `json:"quote_id"`
+			TargetAmount int64  `json:"target_amount"`
+			SpreadAmount int64  `json:"spread_amount"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &qr); err != nil {
+		t.Fatalf("failed to decode quote: %v", err)
+	}
+	if qr.Data.TargetAmount != 99 || qr.Data.SpreadAmount != 1 {
+		t.Errorf("expected 99 cents and 1 cent spread, got %d and %d", qr.Data.TargetAmount, qr.Data.SpreadAmount)
+	}
+
+	payload := `{"quote_id":"` + qr.Data.QuoteID + `"}`
+	if rr := postJSON(router, "/api/v1/conversions", token, payload); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for conversion, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(router, "/api/v1/conversions", token, payload); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a reused quote, got %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/wallet", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var wr walletResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &wr); err != nil {
+		t.Fatalf("failed to decode wallet response: %v", err)
+	}
+	balances := map[string]int64{}
+	for _, w := range wr.Data.Wallets {
+		balances[w.Currency] = w.Balance
+	}
+	if balances["NGN"] != 0 || balances["USD"] != 99 {
+		t.Errorf("expected NGN 0 and USD 99 after conversion, got %v", balances)
+	}
+}
@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/repository/postgres"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+func getWithToken(router http.Handler, path, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func userIDByEmail(pdb *postgres.PostgresDB, email string, t *testing.T) int64 {
+	user := &model.User{}
+	if err := pdb.SelectSingleEntity("email = ?", user, email); err != nil {
+		t.Fatalf("failed to load user %s: %v", email, err)
+	}
+	return user.ID
+}
+
+func TestExportStatusAndDownload(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	ctx := context.Background()
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	owner := createAndLoginUserWithEmail(router, "owner@example.com", t)
+	other := createAndLoginUserWithEmail(router, "other@example.com", t)
+	ownerID := userIDByEmail(pdb, "owner@example.com", t)
+
+	filePath := filepath.Join(t.TempDir(), "report.xlsx")
+	if err := os.WriteFile(filePath, []byte("report"), 0644); err != nil {
+		t.Fatalf("failed to write export file: %v", err)
+	}
+
+	queued := &model.Export{UserID: ownerID, Status: model.ExportStatusQueued}
+	completed := &model.Export{UserID: ownerID, Status: model.ExportStatusCompleted, FilePath: filePath, FileName: "report.xlsx"}
+	for _, e := range []*model.Export{queued, completed} {
+		if _, err := pdb.DB.NewInsert().Model(e).Exec(ctx); err != nil {
+			t.Fatalf("failed to insert export: %v", err)
+		}
+	}
+
+	if rr := getWithToken(router, fmt.Sprintf("/api/v1/exports/%d", queued.ID), owner); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for export status, got %d", rr.Code)
+	}
+	if rr := getWithToken(router, fmt.Sprintf("/api/v1/exports/%d/download", queued.ID), owner); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for queued export download, got %d", rr.Code)
+	}
+
+	rr := getWithToken(router, fmt.Sprintf("/api/v1/exports/%d/download", completed.ID), owner)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for download, got %d", rr.Code)
+	}
+	if rr.Body.String() != "report" {
+		t.Errorf("unexpected download body %q", rr.Body.String())
+	}
+
+	if rr := getWithToken(router, fmt.Sprintf("/api/v1/exports/%d/download", completed.ID), other); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when downloading another user's export, got %d", rr.Code)
+	}
+}
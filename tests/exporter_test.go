@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	services "github.com/lupppig/stream-ledger-api/service"
+	"github.com/xuri/excelize/v2"
+)
+
+func sampleStatement() (services.Statement, []model.Transaction) {
+	now := time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)
+	stmt := services.Statement{
+		UserID:         1,
+		Email:          "statement@example.com",
+		WalletID:       7,
+		Currency:       "NGN",
+		From:           now.Add(-48 * time.Hour),
+		To:             now,
+		Count:          45,
+		ClosingBalance: 40000,
+		GeneratedAt:    now,
+		Filter:         model.TransactionFilter{Entry: "credit", MinAmount: 100},
+	}
+	var transactions []model.Transaction
+	for i := 0; i < 45; i++ {
+		entry, amount := "credit", int64(1000)
+		if i%3 == 0 {
+			entry, amount = "debit", 500
+		}
+		transactions = append(transactions, model.Transaction{
+			ID:        int64(i + 1),
+			Entry:     entry,
+			Amount:    amount,
+			TransID:   "trans-" + string(rune('a'+i%26)),
+			CreatedAt: now.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	return stmt, transactions
+}
+
+func TestExporterFor(t *testing.T) {
+	if _, err := services.ExporterFor(""); err != nil {
+		t.Errorf("expected empty format to default to Excel, got %v", err)
+	}
+	if _, err := services.ExporterFor("docx"); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	stmt, transactions := sampleStatement()
+	var buf bytes.Buffer
+	if err := (services.CSVExporter{}).Export(&buf, stmt, services.SliceRows(transactions)); err != nil {
+		t.Fatalf("csv export failed: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "# filters: entry credit, amount >= 100") {
+		t.Error("expected the applied filters in the csv header")
+	}
+
+	reader := csv.NewReader(&buf)
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read csv: %v", err)
+	}
+	if len(records) != len(transactions)+1 {
+		t.Fatalf("expected %d rows, got %d", len(transactions)+1, len(records))
+	}
+	if records[1][3] != "5.00" {
+		t.Errorf("expected amount in major units, got %s", records[1][3])
+	}
+}
+
+func TestCSVExportUsesCurrencyExponent(t *testing.T) {
+	stmt, transactions := sampleStatement()
+	transactions = transactions[:1]
+	stmt.Count = 1
+
+	for currency, want := range map[string]string{"JPY": "500", "KWD": "0.500", "USD": "5.00"} {
+		stmt.Currency = currency
+		var buf bytes.Buffer
+		if err := (services.CSVExporter{}).Export(&buf, stmt, services.SliceRows(transactions)); err != nil {
+			t.Fatalf("csv export failed: %v", err)
+		}
+
+		reader := csv.NewReader(&buf)
+		reader.Comment = '#'
+		records, err := reader.ReadAll()
+		if err != nil {
+			t.Fatalf("failed to read csv: %v", err)
+		}
+		if records[1][3] != want {
+			t.Errorf("expected %s amount %s, got %s", currency, want, records[1][3])
+		}
+	}
+}
+
+func TestPDFExportIsPaginated(t *testing.T) {
+	stmt, transactions := sampleStatement()
+	var buf bytes.Buffer
+	if err := (services.PDFExporter{}).Export(&buf, stmt, services.SliceRows(transactions)); err != nil {
+		t.Fatalf("pdf export failed: %v", err)
+	}
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "%PDF-1.4") || !strings.HasSuffix(out, "%%EOF\n") {
+		t.Fatal("output is not a complete PDF document")
+	}
+	if !strings.Contains(out, "/Count 2") {
+		t.Error("expected 45 transactions to span 2 pages")
+	}
+}
+
+func TestOFXExport(t *testing.T) {
+	stmt, transactions := sampleStatement()
+	var buf bytes.Buffer
+	if err := (services.OFXExporter{}).Export(&buf, stmt, services.SliceRows(transactions)); err != nil {
+		t.Fatalf("ofx export failed: %v", err)
+	}
+
+	var doc struct {
+		Entries []struct {
+			Type   string `xml:"TRNTYPE"`
+			Amount string `xml:"TRNAMT"`
+		} `xml:"BANKMSGSRSV1>STMTTRNRS>STMTRS>BANKTRANLIST>STMTTRN"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to parse ofx: %v", err)
+	}
+	if len(doc.Entries) != len(transactions) {
+		t.Fatalf("expected %d entries, got %d", len(transactions), len(doc.Entries))
+	}
+	if doc.Entries[0].Type != "DEBIT" || doc.Entries[0].Amount != "-5.00" {
+		t.Errorf("unexpected first entry %+v", doc.Entries[0])
+	}
+}
+
+func TestCAMTExport(t *testing.T) {
+	stmt, transactions := sampleStatement()
+	var buf bytes.Buffer
+	if err := (services.CAMTExporter{}).Export(&buf, stmt, services.SliceRows(transactions)); err != nil {
+		t.Fatalf("camt export failed: %v", err)
+	}
+
+	var doc struct {
+		XMLName  xml.Name
+		Balances []struct {
+			Code   string `xml:"Tp>CdOrPrtry>Cd"`
+			Amount string `xml:"Amt"`
+		} `xml:"BkToCstmrStmt>Stmt>Bal"`
+		Entries []struct {
+			CdtDbt string `xml:"CdtDbtInd"`
+		} `xml:"BkToCstmrStmt>Stmt>Ntry"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to parse camt.053: %v", err)
+	}
+	if doc.XMLName.Space != "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02" {
+		t.Errorf("unexpected namespace %q", doc.XMLName.Space)
+	}
+	if len(doc.Entries) != len(transactions) {
+		t.Fatalf("expected %d entries, got %d", len(transactions), len(doc.Entries))
+	}
+	if len(doc.Balances) != 2 || doc.Balances[1].Code != "CLBD" || doc.Balances[1].Amount != "400.00" {
+		t.Errorf("unexpected balances %+v", doc.Balances)
+	}
+}
+
+func TestExcelExportStreamsRows(t *testing.T) {
+	stmt, transactions := sampleStatement()
+	var buf bytes.Buffer
+	if err := (services.ExcelExporter{}).Export(&buf, stmt, services.SliceRows(transactions)); err != nil {
+		t.Fatalf("excel export failed: %v", err)
+	}
+
+	f, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to open workbook: %v", err)
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows("user_transaction_report")
+	if err != nil {
+		t.Fatalf("failed to read rows: %v", err)
+	}
+	// two statement header rows, a blank row, the column headers, then data
+	if len(rows) != len(transactions)+4 {
+		t.Fatalf("expected %d rows, got %d", len(transactions)+4, len(rows))
+	}
+	if rows[3][0] != "ID" {
+		t.Errorf("expected column headers on row 4, got %v", rows[3])
+	}
+}
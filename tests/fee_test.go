@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+func TestFeeRuleCharge(t *testing.T) {
+	tiered := &model.FeeRule{
+		Type: model.FeeTypeTiered,
+		Tiers: []model.FeeTier{
+			{UpTo: 10000, Flat: 50},
+			{UpTo: 0, Flat: 100, BasisPoints: 150},
+		},
+		MaxFee: 2000,
+	}
+	tests := []struct {
+		name   string
+		rule   *model.FeeRule
+		amount int64
+		fee    int64
+		capped string
+	}{
+		{"flat", &model.FeeRule{Type: model.FeeTypeFlat, Flat: 25}, 999999, 25, ""},
+		{"percentage rounds half up", &model.FeeRule{Type: model.FeeTypePercentage, BasisPoints: 150}, 1033, 15, ""},
+		{"percentage below the minimum", &model.FeeRule{Type: model.FeeTypePercentage, BasisPoints: 150, MinFee: 100}, 1000, 100, "min"},
+		{"first tier", tiered, 10000, 50, ""},
+		{"last tier", tiered, 20000, 400, ""},
+		{"last tier above the maximum", tiered, 1000000, 2000, "max"},
+		{"credit below its fee", &model.FeeRule{AppliesTo: model.FeeOnCredit, Type: model.FeeTypeFlat, Flat: 500}, 300, 300, "amount"},
+		{"debit below its fee", &model.FeeRule{AppliesTo: model.FeeOnDebit, Type: model.FeeTypeFlat, Flat: 500}, 300, 500, ""},
+	}
+	for _, tt := range tests {
+		fee := tt.rule.Charge(tt.amount)
+		if fee.Amount != tt.fee || fee.Capped != tt.capped {
+			t.Errorf("%s: expected fee %d capped %q, got %+v", tt.name, tt.fee, tt.capped, fee)
+		}
+	}
+}
+
+func TestTransactionFees(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	createAndLoginUserWithEmail(r, "recipient@example.com", t)
+	admin := createAndLoginStaff(r, pdb, "admin@example.com", model.RoleAdmin, t)
+
+	put := func(body string) int {
+		req, _ := http.NewRequest("PUT", "/api/v1/admin/fees", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+admin)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := put(`{"applies_to":"debit","currency":"NGN","type":"tiered","tiers":[{"up_to":100}]}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for tiers without an open ended last tier, got %d", code)
+	}
+	if code := put(`{"applies_to":"debit","currency":"NGN","type":"percentage","basis_points":100,"min_fee":20}`); code != http.StatusOK {
+		t.Fatalf("expected 200 for a debit fee rule, got %d", code)
+	}
+	if code := put(`{"applies_to":"transfer","currency":"NGN","type":"flat","flat":30}`); code != http.StatusOK {
+		t.Fatalf("expected 200 for a transfer fee rule, got %d", code)
+	}
+
+	if rr := postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"credit","amount":10000}`); rr.Code != http.StatusOK {
+		t.Fatalf("failed to fund wallet, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"debit","amount":9950}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a debit that cannot cover its fee, got %d", rr.Code)
+	}
+
+	rr := postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"debit","amount":5000,"trans_id":"debit-1"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a debit with a fee, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var body struct {
+		Data struct {
+			Fee *kafka.FeeBreakdown `json:"fee"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode transaction: %v", err)
+	}
+	if body.Data.Fee == nil || body.Data.Fee.Amount != 50 || body.Data.Fee.TransID != "debit-1:fee" {
+		t.Fatalf("expected a fee of 50 booked as debit-1:fee, got %+v", body.Data.Fee)
+	}
+	first := *body.Data.Fee
+
+	// a retry of debit-1 is not charged again but shows the same fee
+	rr = postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"debit","amount":5000,"trans_id":"debit-1"}`)
+	body.Data.Fee = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a retry of debit-1, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if body.Data.Fee == nil || *body.Data.Fee != first {
+		t.Errorf("expected the retry to show fee %+v, got %+v", first, body.Data.Fee)
+	}
+
+	transfer := `{"currency":"NGN","recipient_email":"recipient@example.com","amount":1000}`
+	if rr := postJSON(r, "/api/v1/transfers", user, transfer); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a transfer with a fee, got %d: %s", rr.Code, rr.Body.String())
+	}
+	// 10000 - 5000 - 50 - 1000 - 30
+	if balance := getWalletBalance(r, user, t); balance != 3920 {
+		t.Errorf("expected balance 3920, got %d", balance)
+	}
+
+	var fees int64
+	err := pdb.DB.NewSelect().
+		TableExpr("postings AS p").
+		ColumnExpr("COALESCE(SUM(p.amount), 0)").
+		Join("JOIN accounts AS a ON a.id = p.account_id").
+		Where("a.code = ?", model.AccountFeesIncome).
+		Scan(context.Background(), &fees)
+	if err != nil {
+		t.Fatalf("failed to sum fees income: %v", err)
+	}
+	if fees != 80 {
+		t.Errorf("expected 80 booked as fees income, got %d", fees)
+	}
+
+	var feeTx model.Transaction
+	err = pdb.DB.NewSelect().Model(&feeTx).Where("trans_id = ?", "debit-1:fee").Scan(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load the fee transaction: %v", err)
+	}
+	rr = postJSON(r, fmt.Sprintf("/api/v1/transactions/%d/reverse", feeTx.ID), user, `{}`)
+	if rr.Code == http.StatusOK {
+		t.Errorf("expected a fee transaction not to be reversible, got %d", rr.Code)
+	}
+
+	var events []model.OutboxEvent
+	err = pdb.DB.NewSelect().
+		Model(&events).
+		Where("event_type = ?", model.EventTypeTransaction).
+		Order("id DESC").
+		Limit(1).
+		Scan(context.Background())
+	if err != nil || len(events) != 1 {
+		t.Fatalf("failed to load the transaction event: %v", err)
+	}
+	var event kafka.TransactionEvent
+	if err := json.Unmarshal(events[0].Payload, &event); err != nil {
+		t.Fatalf("failed to decode transaction event: %v", err)
+	}
+	if event.Fee == nil || event.Fee.Amount != 50 || event.Balance != 4950 {
+		t.Errorf("expected the debit event to carry the fee and the balance after it, got %+v", event)
+	}
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+type holdResponse struct {
+	Data struct {
+		HoldID int64  `json:"hold_id"`
+		Status string `json:"status"`
+	} `json:"data"`
+}
+
+func getAvailableBalance(router http.Handler, token string, t *testing.T) int64 {
+	req, _ := http.NewRequest("GET", "/api/v1/wallet", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var wr walletResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &wr); err != nil || len(wr.Data.Wallets) == 0 {
+		t.Fatalf("failed to decode wallet response: %v", err)
+	}
+	return wr.Data.Wallets[0].AvailableBalance
+}
+
+func TestHoldCaptureAndRelease(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUserWithEmail(router, "holds@example.com", t)
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":500}`); rr.Code != http.StatusOK {
+		t.Fatalf("failed to fund wallet, got %d", rr.Code)
+	}
+
+	rr := postJSON(router, "/api/v1/holds", token, `{"currency":"NGN","amount":300,"reference":"auth-1"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for hold, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var hr holdResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &hr); err != nil {
+		t.Fatalf("failed to decode hold response: %v", err)
+	}
+
+	if balance := getWalletBalance(router, token, t); balance != 500 {
+		t.Errorf("expected ledger balance 500 while held, got %d", balance)
+	}
+	if available := getAvailableBalance(router, token, t); available != 200 {
+		t.Errorf("expected available balance 200 while held, got %d", available)
+	}
+
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"debit","amount":300}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when debiting held funds, got %d", rr.Code)
+	}
+
+	capture := fmt.Sprintf("/api/v1/holds/%d/capture", hr.Data.HoldID)
+	if rr := postJSON(router, capture, token, `{"amount":400}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when capturing more than held, got %d", rr.Code)
+	}
+	if rr := postJSON(router, capture, token, `{"amount":100}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for partial capture, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if balance := getWalletBalance(router, token, t); balance != 400 {
+		t.Errorf("expected balance 400 after capture, got %d", balance)
+	}
+	if available := getAvailableBalance(router, token, t); available != 400 {
+		t.Errorf("expected the uncaptured remainder to be released, got available %d", available)
+	}
+
+	release := fmt.Sprintf("/api/v1/holds/%d/release", hr.Data.HoldID)
+	if rr := postJSON(router, release, token, ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 when releasing a captured hold, got %d", rr.Code)
+	}
+}
+
+func TestHoldRelease(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUserWithEmail(router, "release@example.com", t)
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":500}`); rr.Code != http.StatusOK {
+		t.Fatalf("failed to fund wallet, got %d", rr.Code)
+	}
+
+	if rr := postJSON(router, "/api/v1/holds", token, `{"currency":"NGN","amount":600}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for hold above available balance, got %d", rr.Code)
+	}
+
+	rr := postJSON(router, "/api/v1/holds", token, `{"currency":"NGN","amount":500}`)
+	var hr holdResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &hr); err != nil {
+		t.Fatalf("failed to decode hold response: %v", err)
+	}
+
+	release := fmt.Sprintf("/api/v1/holds/%d/release", hr.Data.HoldID)
+	if rr := postJSON(router, release, token, ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for release, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if available := getAvailableBalance(router, token, t); available != 500 {
+		t.Errorf("expected available balance 500 after release, got %d", available)
+	}
+}
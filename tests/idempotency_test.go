@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+func postIdempotent(router http.Handler, path, token, key, payload string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+	ctx := context.Background()
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	other := createAndLoginUserWithEmail(r, "other@example.com", t)
+	credit := `{"currency":"NGN","entry":"credit","amount":100}`
+
+	first := postIdempotent(r, "/api/v1/transactions", user, "key-1", credit)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+	retry := postIdempotent(r, "/api/v1/transactions", user, "key-1", credit)
+	if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the first response replayed, got %d %q: %s", retry.Code, retry.Header().Get("Idempotent-Replayed"), retry.Body.String())
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("expected the first response not to be marked replayed")
+	}
+	if balance := getWalletBalance(r, user, t); balance != 100 {
+		t.Errorf("expected the credit to be posted once, balance %d", balance)
+	}
+
+	if rr := postIdempotent(r, "/api/v1/transactions", user, "key-1", `{"currency":"NGN","entry":"credit","amount":200}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a key reused with another body, got %d", rr.Code)
+	}
+	if rr := postIdempotent(r, "/api/v1/wallets", user, "key-1", credit); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a key reused on another route, got %d", rr.Code)
+	}
+	// keys are per user
+	if rr := postIdempotent(r, "/api/v1/transactions", other, "key-1", credit); rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected another user's key to run, got %d", rr.Code)
+	}
+
+	// client errors are kept and replayed too
+	overdraft := `{"currency":"NGN","entry":"debit","amount":500}`
+	if rr := postIdempotent(r, "/api/v1/transactions", user, "key-2", overdraft); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an overdraft, got %d", rr.Code)
+	}
+	if rr := postIdempotent(r, "/api/v1/transactions", user, "key-2", overdraft); rr.Code != http.StatusBadRequest || rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the 400 replayed, got %d", rr.Code)
+	}
+
+	// once expired, a key runs a new request and is purged
+	if _, err := pdb.DB.ExecContext(ctx, `UPDATE idempotency_keys SET expires_at = CURRENT_TIMESTAMP - INTERVAL '1 hour' WHERE key = 'key-2'`); err != nil {
+		t.Fatalf("failed to expire key: %v", err)
+	}
+	if rr := postIdempotent(r, "/api/v1/transactions", user, "key-2", credit); rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected an expired key to run again, got %d", rr.Code)
+	}
+	_, _ = pdb.DB.ExecContext(ctx, `UPDATE idempotency_keys SET expires_at = CURRENT_TIMESTAMP - INTERVAL '1 hour'`)
+	if _, err := model.PurgeExpiredTokens(ctx, pdb); err != nil {
+		t.Fatalf("failed to purge: %v", err)
+	}
+	if left, _ := pdb.DB.NewSelect().Model((*model.IdempotencyKey)(nil)).Count(ctx); left != 0 {
+		t.Errorf("expected expired keys to be purged, %d left", left)
+	}
+
+	if rr := postIdempotent(r, "/api/v1/transactions", user, strings.Repeat("k", 256), credit); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an overlong key, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,233 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lupppig/stream-ledger-api/router"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func writeKey(t *testing.T, dir, kid string, key any, public bool) {
+	var block *pem.Block
+	if public {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatalf("failed to marshal public key: %v", err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("failed to marshal private key: %v", err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+}
+
+func useKeysFrom(t *testing.T, dir string) *utils.KeySet {
+	ks, err := utils.LoadKeySet(dir, "")
+	if err != nil {
+		t.Fatalf("failed to load keys: %v", err)
+	}
+	utils.UseKeySet(ks)
+	return ks
+}
+
+func useCheckpointKeysFrom(t *testing.T, dir string) {
+	ks, err := utils.LoadKeySet(dir, "")
+	if err != nil {
+		t.Fatalf("failed to load checkpoint keys: %v", err)
+	}
+	utils.UseCheckpointKeySet(ks)
+}
+
+func tokenKID(t *testing.T, token string) string {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &utils.Claims{})
+	if err != nil {
+		t.Fatalf("failed to decode token: %v", err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, dir, "2025-01", edKey, false)
+	useKeysFrom(t, dir)
+
+	oldToken, err := utils.CreateToken(1, "user", time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+	if kid := tokenKID(t, oldToken); kid != "2025-01" {
+		t.Errorf("expected kid 2025-01, got %q", kid)
+	}
+
+	// a newer key takes over signing while the old one keeps verifying
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	writeKey(t, dir, "2025-02", rsaKey, false)
+	writeKey(t, dir, "2025-01", edKey.Public(), true)
+	if ks := useKeysFrom(t, dir); ks.SigningKID != "2025-02" {
+		t.Fatalf("expected 2025-02 to sign, got %q", ks.SigningKID)
+	}
+
+	newToken, _ := utils.CreateToken(2, "user", time.Minute)
+	if kid := tokenKID(t, newToken); kid != "2025-02" {
+		t.Errorf("expected kid 2025-02, got %q", kid)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := utils.ParseToken(token); err != nil {
+			t.Errorf("expected token to verify after rotation: %v", err)
+		}
+	}
+
+	// once the old key is removed its tokens are rejected
+	os.Remove(filepath.Join(dir, "2025-01.pem"))
+	useKeysFrom(t, dir)
+	if _, err := utils.ParseToken(oldToken); err == nil {
+		t.Error("expected a token of a removed key to be rejected")
+	}
+
+	hs, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, utils.Claims{UserID: 1}).SignedString([]byte("secret"))
+	if _, err := utils.ParseToken(hs); err == nil {
+		t.Error("expected HS256 tokens to be rejected")
+	}
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writeKey(t, dir, "a-ed25519", edKey, false)
+	writeKey(t, dir, "b-rsa", rsaKey.Public(), true)
+	useKeysFrom(t, dir)
+
+	r := router.Router(nil, nil, nil)
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	var set struct {
+		Keys []utils.JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &set); err != nil {
+		t.Fatalf("failed to decode jwks: %v", err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(set.Keys))
+	}
+	if k := set.Keys[0]; k.KeyID != "a-ed25519" || k.KeyType != "OKP" || k.Algorithm != "EdDSA" || k.X == "" {
+		t.Errorf("unexpected Ed25519 key %+v", k)
+	}
+	if k := set.Keys[1]; k.KeyID != "b-rsa" || k.KeyType != "RSA" || k.Algorithm != "RS256" || k.N == "" || k.E != "AQAB" {
+		t.Errorf("unexpected RSA key %+v", k)
+	}
+}
+
+func TestSignatureRotation(t *testing.T) {
+	t.Cleanup(func() { utils.UseCheckpointKeySet(nil) })
+
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, dir, "2025-01", edKey, false)
+	useCheckpointKeysFrom(t, dir)
+
+	message := []byte("stream-ledger-checkpoint\n2025-01-31\nroot")
+	oldKID, oldSig, err := utils.SignCheckpoint(message)
+	if err != nil || oldKID != "2025-01" {
+		t.Fatalf("failed to sign with 2025-01: %q %v", oldKID, err)
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writeKey(t, dir, "2025-02", rsaKey, false)
+	writeKey(t, dir, "2025-01", edKey.Public(), true)
+	useCheckpointKeysFrom(t, dir)
+	newKID, newSig, err := utils.SignCheckpoint(message)
+	if err != nil || newKID != "2025-02" {
+		t.Fatalf("failed to sign with 2025-02: %q %v", newKID, err)
+	}
+
+	// both signatures verify after the rotation, and only for their message
+	for kid, sig := range map[string][]byte{oldKID: oldSig, newKID: newSig} {
+		if err := utils.VerifyCheckpointSignature(kid, message, sig); err != nil {
+			t.Errorf("expected the %s signature to verify: %v", kid, err)
+		}
+		if err := utils.VerifyCheckpointSignature(kid, append(message, '!'), sig); err == nil {
+			t.Errorf("expected the %s signature to fail on another message", kid)
+		}
+	}
+	if err := utils.VerifyCheckpointSignature(newKID, message, oldSig); err == nil {
+		t.Error("expected a signature to fail under another key")
+	}
+}
+
+func TestCheckpointKeyRotation(t *testing.T) {
+	t.Cleanup(func() { utils.UseCheckpointKeySet(nil) })
+
+	tokens := t.TempDir()
+	_, tokenKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, tokens, "token-2025-01", tokenKey, false)
+	useKeysFrom(t, tokens)
+
+	// the token keys never sign checkpoints
+	utils.UseCheckpointKeySet(nil)
+	if _, _, err := utils.SignCheckpoint([]byte("checkpoint")); !errors.Is(err, utils.ErrorNoCheckpointKeys) {
+		t.Errorf("expected no checkpoint without checkpoint keys, got %v", err)
+	}
+
+	checkpoints := t.TempDir()
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, checkpoints, "checkpoint-2025-01", oldKey, false)
+	useCheckpointKeysFrom(t, checkpoints)
+
+	message := []byte("stream-ledger-checkpoint\n2025-01-31\nroot")
+	kid, sig, err := utils.SignCheckpoint(message)
+	if err != nil || kid != "checkpoint-2025-01" {
+		t.Fatalf("expected the checkpoint key to sign, got %q %v", kid, err)
+	}
+
+	// the token key is rotated out completely and the checkpoint key is
+	// replaced, keeping only its public half
+	_, newTokenKey, _ := ed25519.GenerateKey(rand.Reader)
+	os.Remove(filepath.Join(tokens, "token-2025-01.pem"))
+	writeKey(t, tokens, "token-2025-02", newTokenKey, false)
+	useKeysFrom(t, tokens)
+
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, checkpoints, "checkpoint-2025-02", newKey, false)
+	writeKey(t, checkpoints, "checkpoint-2025-01", oldKey.Public(), true)
+	useCheckpointKeysFrom(t, checkpoints)
+
+	if err := utils.VerifyCheckpointSignature(kid, message, sig); err != nil {
+		t.Errorf("expected the old checkpoint to verify after both rotations: %v", err)
+	}
+	if kid, _, _ := utils.SignCheckpoint(message); kid != "checkpoint-2025-02" {
+		t.Errorf("expected the new checkpoint key to sign, got %q", kid)
+	}
+	if keys := utils.CheckpointJWKS(); len(keys) != 2 {
+		t.Errorf("expected both checkpoint keys to be published, got %d", len(keys))
+	}
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+func TestReconciliation(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+	ctx := context.Background()
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	seedTransactions(r, user, t)
+
+	run, err := model.Reconcile(ctx, pdb, model.ReconcileSourceCLI, true)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if run.WalletsChecked == 0 || run.Mismatches != 0 {
+		t.Errorf("expected every wallet to balance, got %d mismatches of %d", run.Mismatches, run.WalletsChecked)
+	}
+
+	// drift the cached balance the way a stray update would
+	userId := userIDByEmail(pdb, "customer@example.com", t)
+	if _, err := pdb.DB.ExecContext(ctx, `UPDATE wallets SET balance = balance + 50 WHERE user_id = ?`, userId); err != nil {
+		t.Fatalf("failed to drift the balance: %v", err)
+	}
+
+	run, err = model.Reconcile(ctx, pdb, model.ReconcileSourceJob, true)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if run.Mismatches != 1 || len(run.Drifts) != 1 {
+		t.Fatalf("expected one mismatch, got %+v", run.Drifts)
+	}
+	drift := run.Drifts[0]
+	if drift.Balance != 450 || drift.Expected != 400 || drift.Drift != 50 || !drift.Frozen {
+		t.Errorf("expected balance 450 against 400 and a frozen wallet, got %+v", drift)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"credit","amount":10}`); rr.Code == http.StatusOK {
+		t.Errorf("expected postings on the frozen wallet to be refused")
+	}
+
+	// the freeze is audited with the run that found the drift
+	freeze := new(model.AuditLog)
+	if err := pdb.DB.NewSelect().Model(freeze).Where("action = ?", model.AuditWalletFreeze).Scan(ctx); err != nil {
+		t.Fatalf("failed to load the freeze audit entry: %v", err)
+	}
+	if reason, _ := freeze.Details["reason"].(string); !strings.HasPrefix(reason, fmt.Sprintf("reconciliation run %d:", run.ID)) {
+		t.Errorf("expected the freeze reason to name run %d, got %q", run.ID, reason)
+	}
+
+	events, err := pdb.DB.NewSelect().
+		Model((*model.OutboxEvent)(nil)).
+		Where("event_type = ?", model.EventTypeReconciliationMismatch).
+		Count(ctx)
+	if err != nil || events != 1 {
+		t.Errorf("expected one mismatch event, got %d (%v)", events, err)
+	}
+
+	// a second run reports the drift again but leaves the frozen wallet be
+	run, err = model.Reconcile(ctx, pdb, model.ReconcileSourceJob, true)
+	if err != nil || run.Mismatches != 1 || run.Drifts[0].Frozen {
+		t.Errorf("expected the drift again without a new freeze, got %+v (%v)", run, err)
+	}
+
+	if rr := getWithToken(r, "/api/v1/admin/reconciliation-runs", user); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a customer, got %d", rr.Code)
+	}
+	auditor := createAndLoginStaff(r, pdb, "auditor@example.com", model.RoleAuditor, t)
+	rr := getWithToken(r, "/api/v1/admin/reconciliation-runs", auditor)
+	var runs struct {
+		Data []model.ReconciliationRun `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &runs); err != nil {
+		t.Fatalf("failed to decode runs: %v", err)
+	}
+	if len(runs.Data) != 3 || runs.Data[0].Mismatches != 1 || runs.Data[2].Source != model.ReconcileSourceCLI {
+		t.Errorf("expected three runs, newest first, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func TestCronNext(t *testing.T) {
+	after := time.Date(2026, time.January, 30, 10, 15, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/20 * * * *", time.Date(2026, time.January, 30, 10, 20, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2026, time.February, 2, 9, 0, 0, 0, time.UTC)},
+		{"30 8 31 * *", time.Date(2026, time.January, 31, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		// both day fields restricted: either one matches
+		{"0 12 15 * 6", time.Date(2026, time.January, 31, 12, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := utils.ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: failed to parse: %v", tt.expr, err)
+		}
+		if got := c.Next(after); !got.Equal(tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := utils.ParseCron(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestScheduledTransactions(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	if rr := postJSON(r, "/api/v1/transactions", user, `{"currency":"NGN","entry":"credit","amount":1000}`); rr.Code != http.StatusOK {
+		t.Fatalf("failed to fund wallet, got %d", rr.Code)
+	}
+
+	start := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	create := func(payload string) (int, int64) {
+		rr := postJSON(r, "/api/v1/schedules", user, payload)
+		var body struct {
+			Data struct {
+				ID int64 `json:"schedule_id"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+		return rr.Code, body.Data.ID
+	}
+	if code, _ := create(`{"currency":"NGN","entry":"debit","amount":400,"frequency":"daily"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a daily schedule without start_at, got %d", code)
+	}
+	code, daily := create(fmt.Sprintf(`{"currency":"NGN","entry":"debit","amount":400,"frequency":"daily","start_at":"%s",
+		"on_insufficient_funds":"retry","max_retries":1,"retry_interval":60}`, start.Format(time.RFC3339)))
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201 for a daily schedule, got %d", code)
+	}
+	code, weekly := create(fmt.Sprintf(`{"currency":"NGN","entry":"debit","amount":700,"frequency":"weekly","start_at":"%s",
+		"on_insufficient_funds":"fail"}`, start.Format(time.RFC3339)))
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201 for a weekly schedule, got %d", code)
+	}
+
+	tick := func(now time.Time) int {
+		executed, err := model.RunDueSchedules(context.Background(), pdb, now, 100)
+		if err != nil {
+			t.Fatalf("failed to run schedules: %v", err)
+		}
+		return executed
+	}
+	if n := tick(start.Add(-time.Minute)); n != 0 {
+		t.Errorf("expected nothing to run before start_at, ran %d", n)
+	}
+	// the daily debit goes first and leaves too little for the weekly one
+	if n := tick(start); n != 2 {
+		t.Errorf("expected 2 runs at start_at, ran %d", n)
+	}
+	if n := tick(start); n != 0 {
+		t.Errorf("expected an occurrence to run once, ran %d", n)
+	}
+	tick(start.Add(24 * time.Hour))
+	tick(start.Add(48 * time.Hour))
+	tick(start.Add(48*time.Hour + time.Minute))
+	if balance := getWalletBalance(r, user, t); balance != 200 {
+		t.Errorf("expected balance 200, got %d", balance)
+	}
+
+	rr := getWithToken(r, fmt.Sprintf("/api/v1/schedules/%d/runs", daily), user)
+	var runs struct {
+		Data []model.ScheduleRun `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &runs); err != nil {
+		t.Fatalf("failed to decode runs: %v", err)
+	}
+	var statuses []string
+	for _, run := range runs.Data {
+		statuses = append(statuses, fmt.Sprintf("%s/%d", run.Status, run.Attempts))
+	}
+	want := []string{"failed/2", "succeeded/1", "succeeded/1"}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("expected runs %v, got %v", want, statuses)
+	}
+	if len(runs.Data) == 3 && runs.Data[2].TransID != fmt.Sprintf("schedule:%d:%d", daily, start.Unix()) {
+		t.Errorf("unexpected trans_id %q", runs.Data[2].TransID)
+	}
+
+	rr = getWithToken(r, fmt.Sprintf("/api/v1/schedules/%d", weekly), user)
+	var schedule struct {
+		Data model.Schedule `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &schedule); err != nil || schedule.Data.Status != model.ScheduleStatusFailed {
+		t.Errorf("expected the weekly schedule to have failed, got %s", rr.Body.String())
+	}
+
+	path := fmt.Sprintf("/api/v1/schedules/%d", daily)
+	if rr := postJSON(r, path+"/pause", user, `{}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for pausing, got %d", rr.Code)
+	}
+	if rr := postJSON(r, path+"/pause", user, `{}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for pausing a paused schedule, got %d", rr.Code)
+	}
+	if rr := postJSON(r, path+"/resume", user, `{}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for resuming, got %d", rr.Code)
+	}
+	if rr := postJSON(r, path+"/cancel", user, `{}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for cancelling, got %d", rr.Code)
+	}
+	if rr := postJSON(r, path+"/resume", user, `{}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for resuming a cancelled schedule, got %d", rr.Code)
+	}
+}
+
+func TestScheduleRunTransIDTaken(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	user := createAndLoginUserWithEmail(r, "customer@example.com", t)
+	userID := userIDByEmail(pdb, "customer@example.com", t)
+	if rr := postJSON(r, "/api/v1/wallets", user, `{"currency":"USD"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("failed to open USD wallet, got %d", rr.Code)
+	}
+
+	start := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	rr := postJSON(r, "/api/v1/schedules", user, fmt.Sprintf(
+		`{"currency":"NGN","entry":"credit","amount":400,"frequency":"once","start_at":"%s"}`, start.Format(time.RFC3339)))
+	var created struct {
+		Data struct {
+			ID int64 `json:"schedule_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for the schedule, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// the occurrence's trans_id is already on another wallet, so the
+	// duplicate is not an earlier attempt of the run
+	taken := &model.Transaction{Entry: "credit", Amount: 1, Currency: "USD",
+		TransID: fmt.Sprintf("schedule:%d:%d", created.Data.ID, start.Unix())}
+	if err := taken.CreateTransaction(pdb, userID); err != nil {
+		t.Fatalf("failed to take the trans_id: %v", err)
+	}
+	if _, err := model.RunDueSchedules(context.Background(), pdb, start, 100); err != nil {
+		t.Fatalf("failed to run schedules: %v", err)
+	}
+
+	rr = getWithToken(r, fmt.Sprintf("/api/v1/schedules/%d/runs", created.Data.ID), user)
+	var runs struct {
+		Data []model.ScheduleRun `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &runs); err != nil || len(runs.Data) != 1 {
+		t.Fatalf("expected one run, got %s", rr.Body.String())
+	}
+	if runs.Data[0].Status != model.RunStatusFailed {
+		t.Errorf("expected the run to fail, got %s", runs.Data[0].Status)
+	}
+	if balance := getWalletBalance(r, user, t); balance != 0 {
+		t.Errorf("expected the NGN wallet untouched, got %d", balance)
+	}
+}
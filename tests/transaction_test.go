@@ -1,13 +1,16 @@
 package tests
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
 
+	"github.com/lupppig/stream-ledger-api/model"
 	"github.com/lupppig/stream-ledger-api/repository/kafka"
 	"github.com/lupppig/stream-ledger-api/router"
 )
@@ -16,7 +19,7 @@ func TestConcurrentTransactions(t *testing.T) {
 	pdb, mockProducer := SetupTestDB(t)
 
 	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
-	router := router.Router(pdb, prod)
+	router := router.Router(pdb, prod, testMailer)
 
 	token := createAndLoginUser(router, t)
 
@@ -31,9 +34,9 @@ func TestConcurrentTransactions(t *testing.T) {
 
 			var payload string
 			if i%2 == 0 {
-				payload = `{"entry":"credit","amount":100}`
+				payload = `{"currency":"NGN","entry":"credit","amount":100}`
 			} else {
-				payload = `{"entry":"debit","amount":50}`
+				payload = `{"currency":"NGN","entry":"debit","amount":50}`
 			}
 
 			req, _ := http.NewRequest("POST", "/api/v1/transactions", strings.NewReader(payload))
@@ -78,8 +81,8 @@ func TestConcurrentTransactions(t *testing.T) {
 		t.Fatalf("failed to decode wallet response: %v\n", err)
 	}
 
-	if wr.Data.Wallet.Balance < 0 {
-		t.Fatalf("wallet balance went negative: %d\n", wr.Data.Wallet.Balance)
+	if wr.Data.Wallets[0].Balance < 0 {
+		t.Fatalf("wallet balance went negative: %d\n", wr.Data.Wallets[0].Balance)
 	}
 }
 
@@ -88,6 +91,7 @@ type transactionsResponse struct {
 		TransactionID int64  `json:"transaction_id"`
 		Entry         string `json:"entry"`
 		Amount        int64  `json:"amount"`
+		BalanceAfter  int64  `json:"balance_after"`
 	} `json:"data"`
 	Page       int `json:"page"`
 	TotalPages int `json:"total_pages"`
@@ -95,11 +99,11 @@ type transactionsResponse struct {
 
 func seedTransactions(router http.Handler, token string, t *testing.T) {
 	credits := []string{
-		`{"entry":"credit","amount":200}`,
-		`{"entry":"credit","amount":300}`,
+		`{"currency":"NGN","entry":"credit","amount":200}`,
+		`{"currency":"NGN","entry":"credit","amount":300}`,
 	}
 	debits := []string{
-		`{"entry":"debit","amount":100}`,
+		`{"currency":"NGN","entry":"debit","amount":100}`,
 	}
 
 	payloads := append(credits, debits...)
@@ -121,7 +125,7 @@ func TestGetTransactions(t *testing.T) {
 	pdb, mockProducer := SetupTestDB(t)
 
 	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
-	router := router.Router(pdb, prod)
+	router := router.Router(pdb, prod, testMailer)
 
 	token := createAndLoginUser(router, t)
 
@@ -163,3 +167,243 @@ func TestGetTransactions(t *testing.T) {
 		t.Error("expected at least one debit transaction, found none")
 	}
 }
+
+func TestLedgerMatchesWalletBalance(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+	seedTransactions(router, token, t)
+
+	ctx := context.Background()
+	wallet := new(model.Wallet)
+	if err := pdb.DB.NewSelect().Model(wallet).Limit(1).Scan(ctx); err != nil {
+		t.Fatalf("failed to load wallet: %v", err)
+	}
+
+	derived, err := wallet.LedgerBalance(ctx, pdb.DB)
+	if err != nil {
+		t.Fatalf("failed to derive ledger balance: %v", err)
+	}
+	if derived != wallet.Balance {
+		t.Errorf("wallet balance %d does not match ledger balance %d", wallet.Balance, derived)
+	}
+
+	var total int64
+	if err := pdb.DB.NewSelect().TableExpr("postings").ColumnExpr("COALESCE(SUM(amount), 0)").Scan(ctx, &total); err != nil {
+		t.Fatalf("failed to sum postings: %v", err)
+	}
+	if total != 0 {
+		t.Errorf("expected postings to sum to zero, got %d", total)
+	}
+}
+
+func TestTransactionWritesOutboxEvent(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+	seedTransactions(router, token, t)
+
+	ctx := context.Background()
+	var events []model.OutboxEvent
+	if err := pdb.DB.NewSelect().Model(&events).Where("event_type = ?", model.EventTypeTransaction).Scan(ctx); err != nil {
+		t.Fatalf("failed to load outbox events: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 outbox events, got %d", len(events))
+	}
+
+	var published []string
+	sent, err := model.PublishPendingEvents(ctx, pdb, 10, func(e *model.OutboxEvent) error {
+		published = append(published, e.EventID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to publish outbox events: %v", err)
+	}
+	if sent != 3 || len(published) != 3 {
+		t.Errorf("expected 3 events published, got %d", sent)
+	}
+
+	pending, err := pdb.DB.NewSelect().Model((*model.OutboxEvent)(nil)).Where("sent_at IS NULL").Count(ctx)
+	if err != nil {
+		t.Fatalf("failed to count pending events: %v", err)
+	}
+	if pending != 0 {
+		t.Errorf("expected no pending events after publishing, got %d", pending)
+	}
+}
+
+func TestReservedReferences(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+
+	// ids with ':' belong to the ledger, so a client cannot take one before
+	// an adjustment, a hold capture or a schedule run needs it
+	for path, payload := range map[string]string{
+		"/api/v1/transactions": `{"currency":"NGN","entry":"credit","amount":100,"trans_id":"adjustment:refund-1"}`,
+		"/api/v1/transfers":    `{"currency":"NGN","amount":100,"recipient_wallet_id":1,"transfer_ref":"conversion:abc"}`,
+		"/api/v1/holds":        `{"currency":"NGN","amount":100,"reference":"x:capture"}`,
+	} {
+		if rr := postJSON(router, path, token, payload); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for a reserved reference on %s, got %d: %s", path, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":100,"trans_id":"refund-1"}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for a plain trans_id, got %d", rr.Code)
+	}
+}
+
+func TestTransIDRetry(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+	payload := `{"currency":"NGN","entry":"credit","amount":100,"trans_id":"order-1"}`
+
+	post := func(token, payload string) (int, int64) {
+		rr := postJSON(router, "/api/v1/transactions", token, payload)
+		var body struct {
+			Data struct {
+				TransactionID int64 `json:"transaction_id"`
+			} `json:"data"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		return rr.Code, body.Data.TransactionID
+	}
+
+	code, first := post(token, payload)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 for the transaction, got %d", code)
+	}
+
+	// a retry gets the original back and posts nothing
+	code, retried := post(token, payload)
+	if code != http.StatusOK || retried != first {
+		t.Errorf("expected 200 with transaction %d for the retry, got %d with %d", first, code, retried)
+	}
+	count, err := pdb.DB.NewSelect().Model((*model.Transaction)(nil)).Where("trans_id = ?", "order-1").Count(context.Background())
+	if err != nil {
+		t.Fatalf("failed to count transactions: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 transaction after the retry, got %d", count)
+	}
+
+	if code, _ := post(token, `{"currency":"NGN","entry":"credit","amount":200,"trans_id":"order-1"}`); code != http.StatusConflict {
+		t.Errorf("expected 409 for a trans_id reused with another amount, got %d", code)
+	}
+
+	// trans_ids are per user, so another user can pick the same one
+	other := createAndLoginUserWithEmail(router, "other@example.com", t)
+	if code, id := post(other, payload); code != http.StatusOK || id == first {
+		t.Errorf("expected a new transaction for another user's trans_id, got %d with %d", code, id)
+	}
+}
+
+func TestReferencesArePerUser(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	first := createAndLoginUserWithEmail(router, "first@example.com", t)
+	second := createAndLoginUserWithEmail(router, "second@example.com", t)
+	recipient := createAndLoginUserWithEmail(router, "recipient@example.com", t)
+
+	// both users use the same references for the same kinds of requests
+	for _, token := range []string{first, second} {
+		rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":500,"trans_id":"fund-1"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to fund wallet, got %d", rr.Code)
+		}
+		var funded struct {
+			Data struct {
+				TransactionID int64 `json:"transaction_id"`
+			} `json:"data"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &funded)
+
+		requests := map[string]string{
+			"/api/v1/transfers": `{"currency":"NGN","recipient_email":"recipient@example.com","amount":100,"transfer_ref":"trf-1"}`,
+			"/api/v1/holds":     `{"currency":"NGN","amount":100,"reference":"hold-1"}`,
+			fmt.Sprintf("/api/v1/transactions/%d/reverse", funded.Data.TransactionID): `{"amount":50,"reference":"rev-1"}`,
+		}
+		for path, payload := range requests {
+			if rr := postJSON(router, path, token, payload); rr.Code != http.StatusOK {
+				t.Errorf("expected 200 on %s, got %d: %s", path, rr.Code, rr.Body.String())
+			}
+		}
+	}
+
+	// the recipient holds credits with trf-1 but never used it itself
+	payload := `{"currency":"NGN","recipient_email":"first@example.com","amount":50,"transfer_ref":"trf-1"}`
+	if rr := postJSON(router, "/api/v1/transfers", recipient, payload); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for the recipient's own trf-1, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(router, "/api/v1/transfers", recipient, payload); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a repeated transfer_ref, got %d", rr.Code)
+	}
+}
+
+func TestReverseTransaction(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+	rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":500}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to create transaction, got %d", rr.Code)
+	}
+	var created struct {
+		Data struct {
+			TransactionID int64 `json:"transaction_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("failed to decode transaction response: %v", err)
+	}
+
+	reverse := fmt.Sprintf("/api/v1/transactions/%d/reverse", created.Data.TransactionID)
+	if rr := postJSON(router, reverse, token, `{"amount":600}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when reversing more than the original, got %d", rr.Code)
+	}
+	if rr := postJSON(router, reverse, token, `{"amount":200,"reason":"partial refund"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for partial reversal, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if balance := getWalletBalance(router, token, t); balance != 300 {
+		t.Errorf("expected balance 300 after partial reversal, got %d", balance)
+	}
+
+	// an empty body reverses whatever is left
+	if rr := postJSON(router, reverse, token, ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for final reversal, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(router, reverse, token, ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for double reversal, got %d", rr.Code)
+	}
+	if balance := getWalletBalance(router, token, t); balance != 0 {
+		t.Errorf("expected balance 0 after full reversal, got %d", balance)
+	}
+
+	count, err := pdb.DB.NewSelect().
+		Model((*model.Transaction)(nil)).
+		Where("reversal_of = ?", created.Data.TransactionID).
+		Count(context.Background())
+	if err != nil {
+		t.Fatalf("failed to count reversals: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 reversal transactions, got %d", count)
+	}
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+)
+
+func postJSON(router http.Handler, path, token, payload string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func getWalletBalance(router http.Handler, token string, t *testing.T) int64 {
+	req, _ := http.NewRequest("GET", "/api/v1/wallet", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 when fetching wallet, got %d", rr.Code)
+	}
+
+	var wr walletResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &wr); err != nil {
+		t.Fatalf("failed to decode wallet response: %v", err)
+	}
+	if len(wr.Data.Wallets) == 0 {
+		t.Fatalf("expected at least one wallet")
+	}
+	return wr.Data.Wallets[0].Balance
+}
+
+func TestTransfer(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	sender := createAndLoginUserWithEmail(router, "sender@example.com", t)
+	recipient := createAndLoginUserWithEmail(router, "recipient@example.com", t)
+
+	if rr := postJSON(router, "/api/v1/transactions", sender, `{"currency":"NGN","entry":"credit","amount":500}`); rr.Code != http.StatusOK {
+		t.Fatalf("failed to fund sender wallet, got %d", rr.Code)
+	}
+
+	payload := `{"currency":"NGN","recipient_email":"recipient@example.com","amount":200,"transfer_ref":"trf-1"}`
+	rr := postJSON(router, "/api/v1/transfers", sender, payload)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for transfer, got %d: %s", rr.Code, rr.Body.String())
+	}
+	// the sender does not get to see the recipient's balance
+	var body struct {
+		Data struct {
+			Credit map[string]any `json:"credit"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode transfer: %v", err)
+	}
+	for _, field := range []string{"balance_after", "hash", "prev_hash"} {
+		if _, ok := body.Data.Credit[field]; ok {
+			t.Errorf("expected the credit leg without %s, got %v", field, body.Data.Credit)
+		}
+	}
+
+	if rr := postJSON(router, "/api/v1/transfers", sender, payload); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for repeated transfer_ref, got %d", rr.Code)
+	}
+
+	tooMuch := `{"currency":"NGN","recipient_email":"recipient@example.com","amount":1000}`
+	if rr := postJSON(router, "/api/v1/transfers", sender, tooMuch); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for insufficient balance, got %d", rr.Code)
+	}
+
+	if balance := getWalletBalance(router, sender, t); balance != 300 {
+		t.Errorf("expected sender balance 300, got %d", balance)
+	}
+	if balance := getWalletBalance(router, recipient, t); balance != 200 {
+		t.Errorf("expected recipient balance 200, got %d", balance)
+	}
+}
+
+func TestTransferToSelf(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+	postJSON(router, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":100}`)
+
+	payload := `{"currency":"NGN","recipient_email":"wallet@example.com","amount":50}`
+	if rr := postJSON(router, "/api/v1/transfers", token, payload); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for self transfer, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lupppig/stream-ledger-api/model"
+	"github.com/lupppig/stream-ledger-api/repository/kafka"
+	"github.com/lupppig/stream-ledger-api/router"
+	"github.com/lupppig/stream-ledger-api/utils"
+)
+
+func TestTOTPCodes(t *testing.T) {
+	// RFC 6238 appendix B vectors for SHA-1, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := utils.TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("failed to compute code: %v", err)
+		}
+		if code != want {
+			t.Errorf("at %d expected %s, got %s", unix, want, code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	previous, _ := utils.TOTPCode(secret, now.Add(-30*time.Second))
+	if counter, ok := utils.ValidateTOTP(secret, previous, now); !ok || counter != 1234567890/30-1 {
+		t.Errorf("expected the previous step to be accepted, got %d %v", counter, ok)
+	}
+	stale, _ := utils.TOTPCode(secret, now.Add(-90*time.Second))
+	if _, ok := utils.ValidateTOTP(secret, stale, now); ok {
+		t.Error("expected a code three steps old to be rejected")
+	}
+}
+
+type challengeResponse struct {
+	Data struct {
+		MFARequired    bool   `json:"mfa_required"`
+		ChallengeToken string `json:"challenge_token"`
+	} `json:"data"`
+}
+
+func TestTwoFactorSignIn(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUserWithEmail(r, "totp@example.com", t)
+
+	rr := postJSON(r, "/api/v1/auth/2fa/enroll", token, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on enroll, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var enrollment struct {
+		Data struct {
+			Secret string `json:"secret"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &enrollment); err != nil {
+		t.Fatalf("failed to decode enrollment: %v", err)
+	}
+	secret := enrollment.Data.Secret
+
+	code, _ := utils.TOTPCode(secret, time.Now())
+	rr = postJSON(r, "/api/v1/auth/2fa/confirm", token, fmt.Sprintf(`{"code":"%s"}`, code))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on confirm, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var confirmed struct {
+		Data struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &confirmed); err != nil {
+		t.Fatalf("failed to decode recovery codes: %v", err)
+	}
+	if len(confirmed.Data.RecoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got %d", len(confirmed.Data.RecoveryCodes))
+	}
+
+	signIn := func() string {
+		rr := postJSON(r, "/api/v1/auth/login", "", `{"email":"totp@example.com","password":"secret"}`)
+		var cr challengeResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &cr); err != nil {
+			t.Fatalf("failed to decode login response: %v", err)
+		}
+		if !cr.Data.MFARequired || cr.Data.ChallengeToken == "" {
+			t.Fatalf("expected a challenge instead of tokens, got %s", rr.Body.String())
+		}
+		return cr.Data.ChallengeToken
+	}
+
+	// the code used to confirm cannot be replayed
+	rr = postJSON(r, "/api/v1/auth/2fa/verify", "", fmt.Sprintf(`{"challenge_token":"%s","code":"%s"}`, signIn(), code))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a replayed code, got %d", rr.Code)
+	}
+
+	recovery := confirmed.Data.RecoveryCodes[0]
+	rr = postJSON(r, "/api/v1/auth/2fa/verify", "", fmt.Sprintf(`{"challenge_token":"%s","code":"%s"}`, signIn(), recovery))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 with a recovery code, got %d: %s", rr.Code, rr.Body.String())
+	}
+	token = decodeTokens(rr, t).Data.AccessToken.Token
+
+	rr = postJSON(r, "/api/v1/auth/2fa/verify", "", fmt.Sprintf(`{"challenge_token":"%s","code":"%s"}`, signIn(), recovery))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a used recovery code, got %d", rr.Code)
+	}
+
+	// debits above the step-up threshold need a fresh code
+	if rr := postJSON(r, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":5000000}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for credit, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", token, `{"currency":"NGN","entry":"debit","amount":2000000}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a large debit without a code, got %d", rr.Code)
+	}
+	next, _ := utils.TOTPCode(secret, time.Now().Add(30*time.Second))
+	debit := fmt.Sprintf(`{"currency":"NGN","entry":"debit","amount":2000000,"totp_code":"%s"}`, next)
+	if rr := postJSON(r, "/api/v1/transactions", token, debit); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for a large debit with a fresh code, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(r, "/api/v1/transactions", token, debit); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 when reusing the step-up code, got %d", rr.Code)
+	}
+	if rr := postJSON(r, "/api/v1/transactions", token, `{"currency":"NGN","entry":"debit","amount":1000}`); rr.Code != http.StatusOK {
+		t.Errorf("expected small debits to need no code, got %d", rr.Code)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	r := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUserWithEmail(r, "lockout@example.com", t)
+	createAndLoginUserWithEmail(r, "lockout-recipient@example.com", t)
+
+	secret := enableTwoFactor(r, token, t)
+	if rr := postJSON(r, "/api/v1/transactions", token, `{"currency":"NGN","entry":"credit","amount":5000000}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for credit, got %d", rr.Code)
+	}
+
+	// transfers take the same step-up as debits
+	transfer := func(code string) *httptest.ResponseRecorder {
+		return postJSON(r, "/api/v1/transfers", token, fmt.Sprintf(
+			`{"recipient_email":"lockout-recipient@example.com","currency":"NGN","amount":2000000,"totp_code":"%s"}`, code))
+	}
+	if rr := transfer(""); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a large transfer without a code, got %d", rr.Code)
+	}
+	// and so do transfer schedules, whose occurrences run unattended
+	schedule := fmt.Sprintf(`{"recipient_email":"lockout-recipient@example.com","currency":"NGN","entry":"transfer","amount":2000000,"frequency":"once","start_at":"%s"}`,
+		time.Now().Add(time.Hour).Format(time.RFC3339))
+	if rr := postJSON(r, "/api/v1/schedules", token, schedule); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a large transfer schedule without a code, got %d", rr.Code)
+	}
+	for i := 0; i < model.MaxTOTPFailures; i++ {
+		if rr := transfer("000000"); rr.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 for wrong code %d, got %d: %s", i+1, rr.Code, rr.Body.String())
+		}
+	}
+
+	// once locked even the right code is refused, for step-up and disable alike
+	next, _ := utils.TOTPCode(secret, time.Now().Add(30*time.Second))
+	if rr := transfer(next); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 while locked out, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(r, "/api/v1/auth/2fa/disable", token, fmt.Sprintf(`{"code":"%s"}`, next)); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 disabling while locked out, got %d", rr.Code)
+	}
+
+	if _, err := pdb.DB.NewUpdate().Model((*model.User)(nil)).
+		Set("totp_locked_until = ?", time.Now().Add(-time.Second)).
+		Where("email = ?", "lockout@example.com").
+		Exec(context.Background()); err != nil {
+		t.Fatalf("failed to end the lockout: %v", err)
+	}
+	if rr := transfer(next); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 after the lockout, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// enableTwoFactor enrolls and confirms TOTP for the user of token and returns
+// the secret. The current step's code is used up by the confirmation.
+func enableTwoFactor(r http.Handler, token string, t *testing.T) string {
+	t.Helper()
+	rr := postJSON(r, "/api/v1/auth/2fa/enroll", token, "")
+	var enrollment struct {
+		Data struct {
+			Secret string `json:"secret"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &enrollment); err != nil {
+		t.Fatalf("failed to decode enrollment: %v", err)
+	}
+	code, _ := utils.TOTPCode(enrollment.Data.Secret, time.Now())
+	if rr := postJSON(r, "/api/v1/auth/2fa/confirm", token, fmt.Sprintf(`{"code":"%s"}`, code)); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on confirm, got %d: %s", rr.Code, rr.Body.String())
+	}
+	return enrollment.Data.Secret
+}
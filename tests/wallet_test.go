@@ -2,10 +2,12 @@ package tests
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lupppig/stream-ledger-api/repository/kafka"
 	"github.com/lupppig/stream-ledger-api/router"
@@ -21,16 +23,21 @@ type loginResponse struct {
 
 type walletResponse struct {
 	Data struct {
-		Wallet struct {
-			WalletID int64  `json:"wallet_id"`
-			Balance  int64  `json:"balance"`
-			Currency string `json:"currency"`
-		} `json:"wallet"`
+		Wallets []struct {
+			WalletID         int64  `json:"wallet_id"`
+			Balance          int64  `json:"balance"`
+			AvailableBalance int64  `json:"available_balance"`
+			Currency         string `json:"currency"`
+		} `json:"wallets"`
 	} `json:"data"`
 }
 
 func createAndLoginUser(router http.Handler, t *testing.T) string {
-	signup := `{"first_name":"Wally","last_name":"Tester","email":"wallet@example.com","password":"secret"}`
+	return createAndLoginUserWithEmail(router, "wallet@example.com", t)
+}
+
+func createAndLoginUserWithEmail(router http.Handler, email string, t *testing.T) string {
+	signup := fmt.Sprintf(`{"first_name":"Wally","last_name":"Tester","email":"%s","password":"secret"}`, email)
 	reqSignup, _ := http.NewRequest("POST", "/api/v1/auth/signup", strings.NewReader(signup))
 	reqSignup.Header.Set("Content-Type", "application/json")
 	rrSignup := httptest.NewRecorder()
@@ -40,7 +47,12 @@ func createAndLoginUser(router http.Handler, t *testing.T) string {
 		t.Fatalf("failed to create test user, got %d\n", rrSignup.Code)
 	}
 
-	login := `{"email":"wallet@example.com","password":"secret"}`
+	verify := fmt.Sprintf(`{"token":"%s"}`, lastMailToken(email, t))
+	if rr := postJSON(router, "/api/v1/auth/verify-email", "", verify); rr.Code != http.StatusOK {
+		t.Fatalf("failed to verify test user email, got %d\n", rr.Code)
+	}
+
+	login := fmt.Sprintf(`{"email":"%s","password":"secret"}`, email)
 	reqLogin, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(login))
 	reqLogin.Header.Set("Content-Type", "application/json")
 	rrLogin := httptest.NewRecorder()
@@ -67,7 +79,7 @@ func TestGetWallet(t *testing.T) {
 	pdb, mockProducer := SetupTestDB(t)
 
 	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
-	router := router.Router(pdb, prod)
+	router := router.Router(pdb, prod, testMailer)
 
 	token := createAndLoginUser(router, t)
 
@@ -86,7 +98,132 @@ func TestGetWallet(t *testing.T) {
 		t.Fatalf("failed to decode wallet response: %v\n", err)
 	}
 
-	if wr.Data.Wallet.Currency != "NGN" {
-		t.Errorf("expected NGN as default currency, got %s\n", wr.Data.Wallet.Currency)
+	if len(wr.Data.Wallets) != 1 || wr.Data.Wallets[0].Currency != "NGN" {
+		t.Errorf("expected a single NGN wallet by default, got %+v\n", wr.Data.Wallets)
+	}
+}
+
+func TestMultiCurrencyWallets(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+
+	if rr := postJSON(router, "/api/v1/wallets", token, `{"currency":"usd"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for new wallet, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(router, "/api/v1/wallets", token, `{"currency":"USD"}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a second USD wallet, got %d", rr.Code)
+	}
+	if rr := postJSON(router, "/api/v1/wallets", token, `{"currency":"XYZ"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unsupported currency, got %d", rr.Code)
+	}
+
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"entry":"credit","amount":100}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when currency is missing, got %d", rr.Code)
+	}
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"EUR","entry":"credit","amount":100}`); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a EUR wallet, got %d", rr.Code)
+	}
+	if rr := postJSON(router, "/api/v1/transactions", token, `{"currency":"USD","entry":"credit","amount":700}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for USD credit, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/wallet", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var wr walletResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &wr); err != nil {
+		t.Fatalf("failed to decode wallet response: %v", err)
+	}
+	balances := map[string]int64{}
+	for _, w := range wr.Data.Wallets {
+		balances[w.Currency] = w.Balance
+	}
+	if len(balances) != 2 || balances["NGN"] != 0 || balances["USD"] != 700 {
+		t.Errorf("expected NGN 0 and USD 700, got %v", balances)
+	}
+}
+
+func TestBalanceHistory(t *testing.T) {
+	pdb, mockProducer := SetupTestDB(t)
+
+	prod := &kafka.Producer{Prod: mockProducer, Topic: "transaction"}
+	router := router.Router(pdb, prod, testMailer)
+
+	token := createAndLoginUser(router, t)
+	seedTransactions(router, token, t)
+
+	var list transactionsResponse
+	if err := json.Unmarshal(getWithToken(router, "/api/v1/transactions", token).Body.Bytes(), &list); err != nil {
+		t.Fatalf("failed to decode transactions response: %v", err)
+	}
+	after := map[int64]int64{}
+	for _, tx := range list.Transactions {
+		after[tx.Amount] = tx.BalanceAfter
+	}
+	if after[200] != 200 || after[300] != 500 || after[100] != 400 {
+		t.Errorf("expected balance_after 200, 500 and 400, got %v", after)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	balanceAt := func(query string) int64 {
+		rr := getWithToken(router, "/api/v1/wallet/balance"+query, token)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 for balance%s, got %d: %s", query, rr.Code, rr.Body.String())
+		}
+		var body struct {
+			Data struct {
+				Balance int64 `json:"balance"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &body)
+		return body.Data.Balance
+	}
+	if balance := balanceAt(""); balance != 400 {
+		t.Errorf("expected the current balance 400, got %d", balance)
+	}
+	if balance := balanceAt("?at=" + today.AddDate(0, 0, -1).Format("2006-01-02")); balance != 0 {
+		t.Errorf("expected balance 0 at the close of yesterday, got %d", balance)
+	}
+	if rr := getWithToken(router, "/api/v1/wallet/balance?currency=USD", token); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a USD wallet, got %d", rr.Code)
+	}
+
+	path := fmt.Sprintf("/api/v1/wallet/balance-history?from=%s&to=%s&interval=day",
+		today.AddDate(0, 0, -1).Format("2006-01-02"), today.AddDate(0, 0, 1).Format("2006-01-02"))
+	rr := getWithToken(router, path, token)
+	var history struct {
+		Data []struct {
+			PeriodStart    time.Time `json:"period_start"`
+			OpeningBalance int64     `json:"opening_balance"`
+			ClosingBalance int64     `json:"closing_balance"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+		t.Fatalf("failed to decode balance history: %v", err)
+	}
+	var points []string
+	for _, p := range history.Data {
+		points = append(points, fmt.Sprintf("%s:%d-%d", p.PeriodStart.Format("2006-01-02"), p.OpeningBalance, p.ClosingBalance))
+	}
+	want := []string{
+		fmt.Sprintf("%s:0-0", today.AddDate(0, 0, -1).Format("2006-01-02")),
+		fmt.Sprintf("%s:0-400", today.Format("2006-01-02")),
+		fmt.Sprintf("%s:400-400", today.AddDate(0, 0, 1).Format("2006-01-02")),
+	}
+	if fmt.Sprint(points) != fmt.Sprint(want) {
+		t.Errorf("expected history %v, got %v", want, points)
+	}
+
+	if rr := getWithToken(router, "/api/v1/wallet/balance-history?interval=year", token); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown interval, got %d", rr.Code)
+	}
+	if rr := getWithToken(router, "/api/v1/wallet/balance-history?from=2000-01-01&interval=hour", token); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for too many periods, got %d", rr.Code)
 	}
 }
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrorInvalidCron = errors.New("invalid cron expression")
+
+// cronHorizon bounds the search for the next time, so expressions that never
+// match, such as the 30th of February, end instead of looping forever.
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+// Cron is a parsed five field cron expression: minute, hour, day of month,
+// month and day of week. Times are matched in UTC.
+type Cron struct {
+	minute, hour, dom, month, dow uint64 // bit n is set when value n matches
+	domAny, dowAny                bool
+}
+
+// ParseCron parses a standard cron expression. Each field takes *, a value,
+// a range a-b, a step */n or a-b/n, or a comma separated list of those. Day
+// of week runs from 0 (Sunday) to 6, and 7 is Sunday too.
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields, got %d", ErrorInvalidCron, len(fields))
+	}
+
+	c := &Cron{}
+	var err error
+	if c.minute, err = cronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = cronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = cronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = cronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = cronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// like vixie cron, a field starting with * counts as unrestricted
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+func cronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%w: bad step in %q", ErrorInvalidCron, part)
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("%w: bad value in %q", ErrorInvalidCron, part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("%w: bad value in %q", ErrorInvalidCron, part)
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 to the end in steps of 15
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%w: %q is out of range %d-%d", ErrorInvalidCron, part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches applies the cron rule that when both day fields are restricted
+// a day matching either of them is enough.
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<t.Weekday()) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after after that matches, or the zero time
+// when nothing matches within the next five years.
+func (c *Cron) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(cronHorizon)
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,377 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const minRSABits = 2048
+
+var ErrorNoCheckpointKeys = errors.New("no checkpoint signing keys are configured")
+
+// KeySet holds the key access tokens are signed with and every public key
+// tokens are still accepted from. Keeping the previous keys around after a
+// new signing key is added lets tokens issued before a rotation live out
+// their expiry.
+type KeySet struct {
+	SigningKID string
+
+	signer crypto.Signer
+	public map[string]crypto.PublicKey
+}
+
+var activeKeys atomic.Pointer[KeySet]
+
+// checkpointKeys sign ledger checkpoints. A checkpoint has to verify for as
+// long as the ledger is kept, far longer than any token, so these keys are
+// kept apart from the token keys, which are dropped once their tokens expire.
+var checkpointKeys atomic.Pointer[KeySet]
+
+// UseKeySet makes ks the key set CreateToken and ParseToken use.
+func UseKeySet(ks *KeySet) {
+	activeKeys.Store(ks)
+}
+
+// keySet returns the active key set. Without one, for example in tests, an
+// ephemeral key is generated so tokens only verify within this process.
+func keySet() *KeySet {
+	if ks := activeKeys.Load(); ks != nil {
+		return ks
+	}
+	ks, err := GenerateKeySet()
+	if err != nil {
+		panic(err)
+	}
+	activeKeys.CompareAndSwap(nil, ks)
+	return activeKeys.Load()
+}
+
+// UseCheckpointKeySet makes ks the key set SignCheckpoint and
+// VerifyCheckpointSignature use. With nil no checkpoints can be signed.
+func UseCheckpointKeySet(ks *KeySet) {
+	checkpointKeys.Store(ks)
+}
+
+// CheckpointKeySetFromEnv loads the checkpoint keys from the directory in
+// CHECKPOINT_KEYS_DIR, like LoadKeySet, with CHECKPOINT_SIGNING_KID picking
+// the signing key. Retired keys stay in the directory as public keys for
+// good. It returns nil when CHECKPOINT_KEYS_DIR is not set: the token keys
+// are rotated out, and often ephemeral, so they cannot stand in.
+func CheckpointKeySetFromEnv() (*KeySet, error) {
+	dir := os.Getenv("CHECKPOINT_KEYS_DIR")
+	if dir == "" {
+		log.Println("CHECKPOINT_KEYS_DIR is not set, ledger checkpoints are not signed")
+		return nil, nil
+	}
+	return LoadKeySet(dir, os.Getenv("CHECKPOINT_SIGNING_KID"))
+}
+
+// CheckpointKeysConfigured reports whether checkpoints can be signed.
+func CheckpointKeysConfigured() bool {
+	return checkpointKeys.Load() != nil
+}
+
+// KeySetFromEnv loads the keys from the directory in JWT_KEYS_DIR or the PEM
+// encoded private key in JWT_SIGNING_KEY. JWT_SIGNING_KID picks the signing
+// key of a directory or names the key from the environment. With neither
+// set an ephemeral key is generated, which logs everyone out on restart.
+func KeySetFromEnv() (*KeySet, error) {
+	kid := os.Getenv("JWT_SIGNING_KID")
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		return LoadKeySet(dir, kid)
+	}
+	if key := os.Getenv("JWT_SIGNING_KEY"); key != "" {
+		signer, err := parsePrivateKey([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY: %w", err)
+		}
+		if kid == "" {
+			kid = thumbprint(signer.Public())
+		}
+		return newKeySet(kid, signer, nil), nil
+	}
+	log.Println("JWT_KEYS_DIR and JWT_SIGNING_KEY are not set, signing tokens with an ephemeral key")
+	return GenerateKeySet()
+}
+
+// LoadKeySet reads every *.pem file in dir. The file name without its
+// extension is the kid. Private keys (PKCS#8, or PKCS#1 for RSA) can sign;
+// public keys (PKIX) only verify, which is how a retired key is kept until
+// the tokens it signed expire. The signing key is signingKID, or the private
+// key whose kid sorts last when it is empty, so naming keys by date rotates
+// them in order.
+func LoadKeySet(dir, signingKID string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	public := map[string]crypto.PublicKey{}
+	signers := map[string]crypto.Signer{}
+	var last string
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if signer, err := parsePrivateKey(data); err == nil {
+			signers[kid] = signer
+			public[kid] = signer.Public()
+			last = kid
+			continue
+		}
+		pub, err := parsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		public[kid] = pub
+	}
+
+	if signingKID == "" {
+		signingKID = last
+	}
+	signer, ok := signers[signingKID]
+	if !ok {
+		return nil, fmt.Errorf("no private key for kid %q in %s", signingKID, dir)
+	}
+	return newKeySet(signingKID, signer, public), nil
+}
+
+// GenerateKeySet returns a key set with a new Ed25519 signing key.
+func GenerateKeySet() (*KeySet, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newKeySet(thumbprint(priv.Public()), priv, nil), nil
+}
+
+func newKeySet(kid string, signer crypto.Signer, public map[string]crypto.PublicKey) *KeySet {
+	if public == nil {
+		public = map[string]crypto.PublicKey{}
+	}
+	public[kid] = signer.Public()
+	return &KeySet{SigningKID: kid, signer: signer, public: public}
+}
+
+func (ks *KeySet) signingMethod() jwt.SigningMethod {
+	if _, ok := ks.signer.(*rsa.PrivateKey); ok {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// verificationKey is the jwt.Keyfunc for tokens signed by any key of ks.
+func (ks *KeySet) verificationKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.public[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	// the alg header has to match the key so one kind of key cannot be
+	// used to check a signature made for another
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	case ed25519.PublicKey:
+		if token.Method != jwt.SigningMethodEdDSA {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	}
+	return key, nil
+}
+
+// SignCheckpoint signs message with the checkpoint signing key and returns
+// the kid of the key and the signature. Ed25519 keys sign the message
+// itself, RSA keys its SHA-256 digest with PKCS #1 v1.5, the same as EdDSA
+// and RS256 in tokens, so the keys published by CheckpointJWKS verify it too.
+func SignCheckpoint(message []byte) (string, []byte, error) {
+	ks := checkpointKeys.Load()
+	if ks == nil {
+		return "", nil, ErrorNoCheckpointKeys
+	}
+	var sig []byte
+	var err error
+	if _, ok := ks.signer.(*rsa.PrivateKey); ok {
+		digest := sha256.Sum256(message)
+		sig, err = ks.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	} else {
+		sig, err = ks.signer.Sign(rand.Reader, message, crypto.Hash(0))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return ks.SigningKID, sig, nil
+}
+
+// VerifyCheckpointSignature checks a signature made by SignCheckpoint with
+// the key kid. The token keys are looked at too, for checkpoints signed
+// before checkpoint keys had to be configured.
+func VerifyCheckpointSignature(kid string, message, sig []byte) error {
+	var key crypto.PublicKey
+	ok := false
+	if ks := checkpointKeys.Load(); ks != nil {
+		key, ok = ks.public[kid]
+	}
+	if !ok {
+		key, ok = keySet().public[kid]
+	}
+	if !ok {
+		return fmt.Errorf("unknown signing key %q", kid)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// JWK is a public key in the JSON Web Key format of RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`   // RSA modulus
+	E         string `json:"e,omitempty"`   // RSA exponent
+	Curve     string `json:"crv,omitempty"` // Ed25519
+	X         string `json:"x,omitempty"`   // Ed25519 public key
+}
+
+// JWKS returns the public keys of the active key set, ordered by kid.
+func JWKS() []JWK {
+	return keySet().jwks()
+}
+
+// CheckpointJWKS returns the public keys ledger checkpoints are signed with,
+// ordered by kid.
+func CheckpointJWKS() []JWK {
+	ks := checkpointKeys.Load()
+	if ks == nil {
+		return []JWK{}
+	}
+	return ks.jwks()
+}
+
+func (ks *KeySet) jwks() []JWK {
+	kids := make([]string, 0, len(ks.public))
+	for kid := range ks.public {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	keys := make([]JWK, 0, len(kids))
+	for _, kid := range kids {
+		switch key := ks.public[kid].(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{
+				KeyType:   "RSA",
+				KeyID:     kid,
+				Use:       "sig",
+				Algorithm: "RS256",
+				N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     kid,
+				Use:       "sig",
+				Algorithm: "EdDSA",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(key),
+			})
+		}
+	}
+	return keys
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("not a private key: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA keys need at least %d bits", minRSABits)
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", key)
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("expected a PEM encoded private or public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA keys need at least %d bits", minRSABits)
+		}
+		return key, nil
+	case ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", key)
+}
+
+// thumbprint derives a kid from the public key for keys that are not named.
+func thumbprint(pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
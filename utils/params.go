@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PathInt64 reads a numeric route variable such as {id}.
+func PathInt64(r *http.Request, key string) (int64, error) {
+	value, ok := mux.Vars(r)[key]
+	if !ok {
+		return 0, fmt.Errorf("missing path parameter %q", key)
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid path parameter %q", key)
+	}
+	return id, nil
+}
+
+// ParseTime accepts an RFC 3339 timestamp or a YYYY-MM-DD date. A date on
+// its own means the start of that day in UTC, or the start of the next day
+// when endOfDay is set so it can be used as an exclusive upper bound.
+func ParseTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -7,7 +7,6 @@ func HashPassword(password string) string {
 	return string(pass)
 }
 
-
 func ComparePassword(password, hPassword string) bool {
 	if err := bcrypt.CompareHashAndPassword([]byte(hPassword), []byte(password)); err != nil {
 		return false
@@ -1,44 +1,47 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-var jwtSecret = []byte(os.Getenv("SECRET_KEY"))
-
 type Claims struct {
-	UserID int64 `json:"user_id"`
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role"` // role of the user when the token was issued
 	jwt.RegisteredClaims
 }
 
-func CreateToken(userID int64, ttl time.Duration) (string, error) {
+func CreateToken(userID int64, role string, ttl time.Duration) (string, error) {
 	now := time.Now().UTC()
 	claims := Claims{
 		UserID: userID,
+		Role:   role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 			Subject:   fmt.Sprintf("%d", userID),
+			ID:        uuid.New().String(), // jti, used to revoke the token
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	ks := keySet()
+	token := jwt.NewWithClaims(ks.signingMethod(), claims)
+	token.Header["kid"] = ks.SigningKID
+	return token.SignedString(ks.signer)
 }
 
 func ParseToken(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
-	tkn, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+	tkn, err := jwt.ParseWithClaims(tokenStr, claims, keySet().verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
 	if err != nil {
 		return nil, err
 	}
@@ -47,3 +50,21 @@ func ParseToken(tokenStr string) (*Claims, error) {
 	}
 	return claims, nil
 }
+
+// NewOpaqueToken returns a random token for the client and the hash of it
+// that is stored server side.
+func NewOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken hashes an opaque token for lookups. Tokens carry 256 bits of
+// randomness so a plain SHA-256 is enough; no salt or slow hash is needed.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}